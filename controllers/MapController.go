@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/khankhulgun/khanmap/maplayer"
 	"github.com/khankhulgun/khanmap/models"
 	"github.com/khankhulgun/khanmap/sprite"
 	"github.com/lambda-platform/lambda/DB"
@@ -20,13 +22,15 @@ import (
 	"gorm.io/gorm"
 )
 
-// DoCluster is set globally from khanmap.Set() to enable/disable clustering for all Point layers
+// DoCluster is set globally from khanmap.Set() and enables clustering for Point layers that set no cluster column
 var DoCluster bool
 
 func GetMapLayers(c *fiber.Ctx) error {
 	id := c.Params("id")
 	generate := c.Query("generate")
 	secure := c.Query("secure")
+	composite := c.Query("composite")
+	tileJSON := c.Query("tilejson")
 
 	if id == "" {
 		// Return a 400 Bad Request error if no ID is provided
@@ -87,7 +91,13 @@ func GetMapLayers(c *fiber.Ctx) error {
 		}
 	}
 
-	mapStyle, generateErr := generateVectorTileStyle(currentMap.Categories, secure, generate == "true")
+	mapStyle, generateErr := generateVectorTileStyle(currentMap.Categories, styleOptions{
+		MapID:     id,
+		Secure:    secure == "true",
+		Generate:  generate == "true",
+		Composite: composite == "true",
+		TileJSON:  tileJSON == "true",
+	})
 
 	currentMap.Version = mapStyle.Version
 	currentMap.Layers = mapStyle.Layers
@@ -164,6 +174,8 @@ func GetMapLayers(c *fiber.Ctx) error {
 func GetMapLayersWithAuth(c *fiber.Ctx) error {
 	id := c.Params("id")
 	secure := c.Query("secure")
+	composite := c.Query("composite")
+	tileJSON := c.Query("tilejson")
 	if id == "" {
 		// Return a 400 Bad Request error if no ID is provided
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -298,7 +310,12 @@ func GetMapLayersWithAuth(c *fiber.Ctx) error {
 		}
 	}
 
-	mapStyle, generateErr := generateVectorTileStyle(currentMap.Categories, secure, false)
+	mapStyle, generateErr := generateVectorTileStyle(currentMap.Categories, styleOptions{
+		MapID:     id,
+		Secure:    secure == "true",
+		Composite: composite == "true",
+		TileJSON:  tileJSON == "true",
+	})
 
 	currentMap.Version = mapStyle.Version
 	currentMap.Layers = mapStyle.Layers
@@ -324,7 +341,20 @@ func GetMapLayersWithAuth(c *fiber.Ctx) error {
 	return c.JSON(currentMap)
 }
 
-func generateVectorTileStyle(categories []models.ViewMapLayerCategories, secure string, generate bool) (models.VectorTileStyle, error) {
+// styleOptions controls how generateVectorTileStyle builds sources and sprites
+type styleOptions struct {
+	MapID string
+	// Secure points sources at the tiles-with-permission endpoints
+	Secure bool
+	// Generate writes sprite images for the markers
+	Generate bool
+	// Composite emits one source for the whole map served by /tiles/map/:mapId
+	Composite bool
+	// TileJSON references sources by their TileJSON url instead of inline tiles
+	TileJSON bool
+}
+
+func generateVectorTileStyle(categories []models.ViewMapLayerCategories, opts styleOptions) (models.VectorTileStyle, error) {
 	var style models.VectorTileStyle
 
 	// Initialize style properties
@@ -343,38 +373,131 @@ func generateVectorTileStyle(categories []models.ViewMapLayerCategories, secure
 
 	style.Sources = map[string]models.VectorSource{}
 
-	for _, category := range categories {
-
-		for _, layer := range category.Layers {
+	var tilePath string = "/tiles/"
+	if opts.Secure {
+		tilePath = "/tiles-with-permission/"
+	}
 
-			baseUrl := config.LambdaConfig.Domain
-			hasProtocol := strings.HasPrefix(baseUrl, "http://") || strings.HasPrefix(baseUrl, "https://")
+	// A composite source carries every layer of the map, each named by its layer ID
+	compositeSource := "map-" + opts.MapID
+	// TileJSON is only served under /tiles; secure=true points it at the permission tiles
+	tileJSONQuery := ""
+	if opts.Secure {
+		tileJSONQuery = "?secure=true"
+	}
 
-			if !hasProtocol {
-				// If no protocol, prepend https://
-				baseUrl = "https://" + baseUrl
+	if opts.Composite {
+		// Layers without integer IDs promote their ID field, keyed by source layer
+		var compositePromoteID interface{}
+		promoteIDs := map[string]string{}
+		// The composite tiles span the zoom ranges of all layers
+		compositeZoom := models.ZoomSettings{MinZoom: models.DefaultMaxZoom, MaxZoom: models.DefaultMinZoom}
+		for _, category := range categories {
+			for _, layer := range category.Layers {
+				if field := promoteID(layer); field != "" {
+					promoteIDs[layer.ID] = field
+				}
+				zoom := layer.Zoom.Settings()
+				compositeZoom.MinZoom = min(compositeZoom.MinZoom, zoom.MinZoom)
+				compositeZoom.MaxZoom = max(compositeZoom.MaxZoom, zoom.MaxZoom)
 			}
-			var tilePath string = "/tiles/"
+		}
+		if compositeZoom.MinZoom > compositeZoom.MaxZoom {
+			compositeZoom = models.ZoomConfig{}.Settings()
+		}
+		if len(promoteIDs) > 0 {
+			compositePromoteID = promoteIDs
+		}
 
-			if secure == "true" {
-				tilePath = "/tiles-with-permission/"
+		if opts.TileJSON {
+			style.Sources[compositeSource] = models.VectorSource{
+				Type:      "vector",
+				URL:       baseUrl + "/tiles/map/" + opts.MapID + ".json" + tileJSONQuery,
+				PromoteID: compositePromoteID,
 			}
-			style.Sources[layer.ID] = models.VectorSource{
-
-				Type:  "vector",
-				Tiles: []string{baseUrl + tilePath + layer.ID + "/{z}/{x}/{y}.pbf"},
+		} else {
+			style.Sources[compositeSource] = models.VectorSource{
+				Type:      "vector",
+				Tiles:     []string{baseUrl + tilePath + "map/" + opts.MapID + "/{z}/{x}/{y}.pbf" + mapVersionQuery(opts.MapID)},
+				PromoteID: compositePromoteID,
+				MinZoom:   compositeZoom.MinZoom,
+				MaxZoom:   compositeZoom.MaxZoom,
 			}
 		}
+	} else {
+		for _, category := range categories {
+
+			for _, layer := range category.Layers {
 
+				baseUrl := config.LambdaConfig.Domain
+				hasProtocol := strings.HasPrefix(baseUrl, "http://") || strings.HasPrefix(baseUrl, "https://")
+
+				if !hasProtocol {
+					// If no protocol, prepend https://
+					baseUrl = "https://" + baseUrl
+				}
+				var layerPromoteID interface{}
+				if field := promoteID(layer); field != "" {
+					layerPromoteID = field
+				}
+				if opts.TileJSON {
+					style.Sources[layer.ID] = models.VectorSource{
+						Type:      "vector",
+						URL:       baseUrl + "/tiles/" + layer.ID + ".json" + tileJSONQuery,
+						PromoteID: layerPromoteID,
+					}
+					continue
+				}
+				zoom := layer.Zoom.Settings()
+				style.Sources[layer.ID] = models.VectorSource{
+
+					Type:      "vector",
+					Tiles:     []string{baseUrl + tilePath + layer.ID + "/{z}/{x}/{y}.pbf" + layerVersionQuery(layer.ID)},
+					PromoteID: layerPromoteID,
+					MinZoom:   zoom.MinZoom,
+					MaxZoom:   zoom.MaxZoom,
+				}
+			}
+
+		}
 	}
 
+	// Hover and selection highlights are drawn above every layer, and labels above them
+	var highlightLayers, labelLayers []any
+
 	// Iterate through categories and layers, defining styles based on geometry type
 	for _, category := range categories {
 		for _, layer := range category.Layers {
+			source, sourceLayer := layer.ID, layer.DbSchema+"."+layer.DbTable
+			if opts.Composite {
+				source, sourceLayer = compositeSource, layer.ID
+			}
+			// The layer's style layers start at its min zoom, above its max zoom the tiles are overzoomed
+			firstLayer, firstHighlight, firstLabel := len(style.Layers), len(highlightLayers), len(labelLayers)
+			if layer.IDFieldname != "" {
+				highlightLayers = append(highlightLayers, featureStateLayers(layer, source, sourceLayer)...)
+			}
+
 			switch layer.GeometryType {
 			case "Point":
+				// Aggregated grid cells replace the points up to the aggregation max zoom
+				aggregation := layer.Aggregation.Settings()
+				pointMinZoom := 0
+				if aggregation.Enabled(layer.GeometryType) {
+					style.Layers = append(style.Layers, aggregationStyleLayer(layer.ID, source, sourceLayer, aggregation))
+					pointMinZoom = aggregation.MaxZoom + 1
+				}
+
+				// Heatmap layers are drawn as point density instead of markers
+				if heatmap := layer.Heatmap.Settings(); heatmap.Enabled {
+					// Points without a valid weight column all weigh the same
+					heatmap.WeightField = maplayer.HeatmapWeightColumn(layer.DbSchema, layer.DbTable, heatmap)
+					style.Layers = append(style.Layers, heatmapStyleLayer(layer.ID, source, sourceLayer, heatmap))
+					break
+				}
 
 				if len(layer.Legends) >= 1 {
+					cluster := layer.Cluster.Settings(DoCluster)
 
 					// Check if this layer uses unique value rendering (multiple markers per unique value)
 					hasUniqueValueField := layer.UniqueValueField != nil && *layer.UniqueValueField != ""
@@ -411,7 +534,7 @@ func generateVectorTileStyle(categories []models.ViewMapLayerCategories, secure
 
 							// Build filter: unique value match + optionally exclude clustered features
 							var symbolFilter []interface{}
-							if DoCluster {
+							if cluster.Enabled {
 								symbolFilter = []interface{}{
 									"all",
 									[]interface{}{"!", []interface{}{"has", "point_count"}},
@@ -426,8 +549,9 @@ func generateVectorTileStyle(categories []models.ViewMapLayerCategories, secure
 							pointSymbol := models.SymbolLayer{
 								ID:          spriteImageID,
 								Type:        "symbol",
-								Source:      layer.ID,
-								SourceLayer: layer.DbSchema + "." + layer.DbTable,
+								Source:      source,
+								SourceLayer: sourceLayer,
+								MinZoom:     pointMinZoom,
 								Filter:      symbolFilter,
 								Layout: models.SymbolLayerLayout{
 									IconImage:           spriteImageID,
@@ -443,7 +567,7 @@ func generateVectorTileStyle(categories []models.ViewMapLayerCategories, secure
 							style.Layers = append(style.Layers, pointSymbol)
 
 							// Generate sprite image for each unique marker
-							if generate {
+							if opts.Generate {
 								outputDir := fmt.Sprintf("./public/map/%s/sprite/images", category.MapID)
 								err := os.MkdirAll(outputDir, os.ModePerm)
 								if err != nil {
@@ -481,61 +605,9 @@ func generateVectorTileStyle(categories []models.ViewMapLayerCategories, secure
 							}
 						}
 
-						// Cluster layers — only if is_cluster is enabled
-						if DoCluster {
-							// Cluster circles layer (shared for all unique values)
-							clusterCircleLayer := models.CircleLayer{
-								ID:          layer.ID + "-clusters",
-								Type:        "circle",
-								Source:      layer.ID,
-								SourceLayer: layer.DbSchema + "." + layer.DbTable,
-								Filter:      []interface{}{"has", "point_count"},
-								Paint: models.CircleLayerPaint{
-									CircleColor: []interface{}{
-										"step",
-										[]interface{}{"get", "point_count"},
-										"#05a41b",
-										100,
-										"#02663a",
-										750,
-										"#024f34",
-									},
-									CircleRadius: []interface{}{
-										"step",
-										[]interface{}{"get", "point_count"},
-										20,
-										100,
-										30,
-										750,
-										40,
-									},
-									CircleOpacity:       1,
-									CircleStrokeWidth:   5,
-									CircleStrokeColor:   "#05a41b",
-									CircleStrokeOpacity: 0.4,
-								},
-							}
-							style.Layers = append(style.Layers, clusterCircleLayer)
-
-							// Cluster count text layer (shared)
-							clusterCountLayer := models.SymbolLayer{
-								ID:          layer.ID + "-cluster-count",
-								Type:        "symbol",
-								Source:      layer.ID,
-								SourceLayer: layer.DbSchema + "." + layer.DbTable,
-								Filter:      []interface{}{"has", "point_count"},
-								Layout: models.SymbolLayerLayout{
-									TextField:  []interface{}{"get", "point_count_abbreviated"},
-									TextFont:   []string{"Noto Sans Bold"},
-									TextSize:   12,
-									TextOffset: []float64{0, 0},
-									TextAnchor: "center",
-								},
-								Paint: models.SymbolLayerPaint{
-									TextColor: "#ffffff",
-								},
-							}
-							style.Layers = append(style.Layers, clusterCountLayer)
+						// Cluster layers — only if clustering is enabled for the layer
+						if cluster.Enabled {
+							style.Layers = append(style.Layers, clusterStyleLayers(layer.ID, source, sourceLayer, cluster)...)
 						}
 
 					} else if layer.Legends[0].Marker != nil {
@@ -543,15 +615,16 @@ func generateVectorTileStyle(categories []models.ViewMapLayerCategories, secure
 
 						// Build filter: optionally exclude clustered features if clustering is enabled
 						var symbolFilter []interface{}
-						if DoCluster {
+						if cluster.Enabled {
 							symbolFilter = []interface{}{"!", []interface{}{"has", "point_count"}}
 						}
 
 						pointSymbol := models.SymbolLayer{
 							ID:          layer.ID,
 							Type:        "symbol",
-							Source:      layer.ID,
-							SourceLayer: layer.DbSchema + "." + layer.DbTable,
+							Source:      source,
+							SourceLayer: sourceLayer,
+							MinZoom:     pointMinZoom,
 							Filter:      symbolFilter,
 							Layout: models.SymbolLayerLayout{
 								IconImage:           layer.ID,
@@ -566,62 +639,12 @@ func generateVectorTileStyle(categories []models.ViewMapLayerCategories, secure
 						}
 						style.Layers = append(style.Layers, pointSymbol)
 
-						// Cluster layers — only if is_cluster is enabled
-						if DoCluster {
-							clusterCircleLayer := models.CircleLayer{
-								ID:          layer.ID + "-clusters",
-								Type:        "circle",
-								Source:      layer.ID,
-								SourceLayer: layer.DbSchema + "." + layer.DbTable,
-								Filter:      []interface{}{"has", "point_count"},
-								Paint: models.CircleLayerPaint{
-									CircleColor: []interface{}{
-										"step",
-										[]interface{}{"get", "point_count"},
-										"#05a41b",
-										100,
-										"#02663a",
-										750,
-										"#024f34",
-									},
-									CircleRadius: []interface{}{
-										"step",
-										[]interface{}{"get", "point_count"},
-										20,
-										100,
-										30,
-										750,
-										40,
-									},
-									CircleOpacity:       1,
-									CircleStrokeWidth:   5,
-									CircleStrokeColor:   "#05a41b",
-									CircleStrokeOpacity: 0.4,
-								},
-							}
-							style.Layers = append(style.Layers, clusterCircleLayer)
-
-							clusterCountLayer := models.SymbolLayer{
-								ID:          layer.ID + "-cluster-count",
-								Type:        "symbol",
-								Source:      layer.ID,
-								SourceLayer: layer.DbSchema + "." + layer.DbTable,
-								Filter:      []interface{}{"has", "point_count"},
-								Layout: models.SymbolLayerLayout{
-									TextField:  []interface{}{"get", "point_count_abbreviated"},
-									TextFont:   []string{"Noto Sans Bold"},
-									TextSize:   12,
-									TextOffset: []float64{0, 0},
-									TextAnchor: "center",
-								},
-								Paint: models.SymbolLayerPaint{
-									TextColor: "#ffffff",
-								},
-							}
-							style.Layers = append(style.Layers, clusterCountLayer)
+						// Cluster layers — only if clustering is enabled for the layer
+						if cluster.Enabled {
+							style.Layers = append(style.Layers, clusterStyleLayers(layer.ID, source, sourceLayer, cluster)...)
 						}
 
-						if generate {
+						if opts.Generate {
 							outputDir := fmt.Sprintf("./public/map/%s/sprite/images", category.MapID)
 							err := os.MkdirAll(outputDir, os.ModePerm)
 							if err != nil {
@@ -673,8 +696,8 @@ func generateVectorTileStyle(categories []models.ViewMapLayerCategories, secure
 						lineLayer := models.LineLayer{
 							ID:          layer.ID,
 							Type:        "line",
-							Source:      layer.ID, // Use category source
-							SourceLayer: layer.DbSchema + "." + layer.DbTable,
+							Source:      source,
+							SourceLayer: sourceLayer,
 							Paint: models.LineLayerPaint{
 								LineColor: *lineColor,
 								LineWidth: 2.0,
@@ -686,14 +709,18 @@ func generateVectorTileStyle(categories []models.ViewMapLayerCategories, secure
 				}
 
 			case "Polygon":
+				if labels := layer.Label.Settings(); labels.Enabled(layer.GeometryType) {
+					labelLayers = append(labelLayers, labelStyleLayer(layer.ID, source, sourceLayer, labels))
+				}
+
 				if len(layer.Legends) >= 1 {
 					// Add Fill Layer if FillColor exists
 					if layer.Legends[0].FillColor != nil {
 						fillLayer := models.FillLayer{
 							ID:          layer.ID,
 							Type:        "fill",
-							Source:      layer.ID, // Use category source
-							SourceLayer: layer.DbSchema + "." + layer.DbTable,
+							Source:      source,
+							SourceLayer: sourceLayer,
 							Paint: models.FillLayerPaint{
 								FillColor:   *layer.Legends[0].FillColor,
 								FillOpacity: 0.6,
@@ -707,8 +734,8 @@ func generateVectorTileStyle(categories []models.ViewMapLayerCategories, secure
 						lineLayer := models.LineLayer{
 							ID:          layer.ID,
 							Type:        "line",
-							Source:      layer.ID, // Use category source
-							SourceLayer: layer.DbSchema + "." + layer.DbTable,
+							Source:      source,
+							SourceLayer: sourceLayer,
 							Paint: models.LineLayerPaint{
 								LineColor: *layer.Legends[0].StrokeColor,
 								LineWidth: 2.0,
@@ -718,8 +745,273 @@ func generateVectorTileStyle(categories []models.ViewMapLayerCategories, secure
 					}
 				}
 			}
+
+			minZoom := layer.Zoom.Settings().MinZoom
+			for _, added := range [][]any{style.Layers[firstLayer:], highlightLayers[firstHighlight:], labelLayers[firstLabel:]} {
+				for i := range added {
+					added[i] = withMinZoom(added[i], minZoom)
+				}
+			}
 		}
 	}
 
+	style.Layers = append(style.Layers, highlightLayers...)
+	style.Layers = append(style.Layers, labelLayers...)
+
 	return style, nil
 }
+
+// promoteID returns the ID field clients should use as feature id when the tiles do not
+// carry one, which is when the ID field is not an integer column
+func promoteID(layer models.MapLayers) string {
+	if layer.IDFieldname == "" || maplayer.IsIntegerColumn(layer.DbSchema, layer.DbTable, layer.IDFieldname) {
+		return ""
+	}
+	return layer.IDFieldname
+}
+
+// layerVersionQuery returns the data version query of a layer's tile URL, so the URL
+// changes whenever the layer's data or configuration does
+func layerVersionQuery(layerID string) string {
+	layer, err := maplayer.FetchLayerDetails(layerID)
+	if err != nil {
+		return ""
+	}
+	return "?" + maplayer.VersionParam + "=" + maplayer.DataVersion(layer)
+}
+
+// mapVersionQuery returns the data version query of a map's composite tile URL
+func mapVersionQuery(mapID string) string {
+	layerIDs, err := maplayer.FetchMapLayerIDs(mapID)
+	if err != nil {
+		return ""
+	}
+
+	var layers []models.MapLayersForTile
+	for _, layerID := range layerIDs {
+		if layer, err := maplayer.FetchLayerDetails(layerID); err == nil {
+			layers = append(layers, layer)
+		}
+	}
+	return "?" + maplayer.VersionParam + "=" + maplayer.MapDataVersion(layers)
+}
+
+const (
+	hoverColor    = "#ffeb3b"
+	selectedColor = "#ff9800"
+)
+
+// featureStateLayers returns the hover and selected highlight layers of a layer. They are
+// transparent until the client sets the "hover" or "selected" feature-state of a feature.
+func featureStateLayers(layer models.MapLayers, source, sourceLayer string) []any {
+	var layers []any
+	for _, state := range []struct {
+		name    string
+		color   string
+		opacity float64
+	}{
+		{"hover", hoverColor, 0.5},
+		{"selected", selectedColor, 0.8},
+	} {
+		opacity := []interface{}{"case", []interface{}{"boolean", []interface{}{"feature-state", state.name}, false}, state.opacity, 0}
+		highlight := models.FeatureStateLayer{
+			ID:          layer.ID + "-" + state.name,
+			Source:      source,
+			SourceLayer: sourceLayer,
+		}
+
+		switch layer.GeometryType {
+		case "Point":
+			highlight.Type = "circle"
+			highlight.Filter = []interface{}{"!", []interface{}{"has", "point_count"}}
+			highlight.Paint = map[string]interface{}{
+				"circle-radius":         12,
+				"circle-color":          state.color,
+				"circle-opacity":        opacity,
+				"circle-stroke-width":   2,
+				"circle-stroke-color":   state.color,
+				"circle-stroke-opacity": opacity,
+			}
+		case "LineString":
+			highlight.Type = "line"
+			highlight.Paint = map[string]interface{}{
+				"line-color":   state.color,
+				"line-width":   5,
+				"line-opacity": opacity,
+			}
+		case "Polygon":
+			highlight.Type = "fill"
+			highlight.Paint = map[string]interface{}{
+				"fill-color":         state.color,
+				"fill-opacity":       opacity,
+				"fill-outline-color": state.color,
+			}
+		default:
+			continue
+		}
+		layers = append(layers, highlight)
+	}
+	return layers
+}
+
+// clusterStyleLayers returns the cluster circle and count layers of a clustered Point layer
+func clusterStyleLayers(layerID, source, sourceLayer string, cluster models.ClusterSettings) []any {
+	circleColor := []interface{}{"step", []interface{}{"get", "point_count"}, cluster.Steps[0].Color}
+	circleRadius := []interface{}{"step", []interface{}{"get", "point_count"}, cluster.Steps[0].Radius}
+	for _, step := range cluster.Steps[1:] {
+		circleColor = append(circleColor, step.Count, step.Color)
+		circleRadius = append(circleRadius, step.Count, step.Radius)
+	}
+
+	clusterCircleLayer := models.CircleLayer{
+		ID:          layerID + "-clusters",
+		Type:        "circle",
+		Source:      source,
+		SourceLayer: sourceLayer,
+		Filter:      []interface{}{"has", "point_count"},
+		Paint: models.CircleLayerPaint{
+			CircleColor:         circleColor,
+			CircleRadius:        circleRadius,
+			CircleOpacity:       1,
+			CircleStrokeWidth:   5,
+			CircleStrokeColor:   cluster.Steps[0].Color,
+			CircleStrokeOpacity: 0.4,
+		},
+	}
+
+	clusterCountLayer := models.SymbolLayer{
+		ID:          layerID + "-cluster-count",
+		Type:        "symbol",
+		Source:      source,
+		SourceLayer: sourceLayer,
+		Filter:      []interface{}{"has", "point_count"},
+		Layout: models.SymbolLayerLayout{
+			TextField:  []interface{}{"get", "point_count_abbreviated"},
+			TextFont:   []string{"Noto Sans Bold"},
+			TextSize:   12,
+			TextOffset: []float64{0, 0},
+			TextAnchor: "center",
+		},
+		Paint: models.SymbolLayerPaint{
+			TextColor: "#ffffff",
+		},
+	}
+
+	return []any{clusterCircleLayer, clusterCountLayer}
+}
+
+// aggregationStyleLayer returns the graduated fill layer of an aggregated Point layer's grid cells
+func aggregationStyleLayer(layerID, source, sourceLayer string, aggregation models.AggregationSettings) models.GridFillLayer {
+	fillColor := []interface{}{"step", []interface{}{"get", "count"}, aggregation.Steps[0].Color}
+	for _, step := range aggregation.Steps[1:] {
+		fillColor = append(fillColor, step.Count, step.Color)
+	}
+
+	return models.GridFillLayer{
+		ID:          layerID + "-aggregation",
+		Type:        "fill",
+		Source:      source,
+		SourceLayer: sourceLayer,
+		MaxZoom:     aggregation.MaxZoom + 1,
+		Filter:      []interface{}{"has", "count"},
+		Paint: models.GridFillLayerPaint{
+			FillColor:        fillColor,
+			FillOpacity:      0.7,
+			FillOutlineColor: "#ffffff",
+		},
+	}
+}
+
+// heatmapStyleLayer returns the heatmap layer of a Point layer drawn as a heatmap
+func heatmapStyleLayer(layerID, source, sourceLayer string, heatmap models.HeatmapSettings) models.HeatmapLayer {
+	var weight interface{} = 1
+	if heatmap.WeightField != "" {
+		weight = []interface{}{
+			"interpolate", []interface{}{"linear"},
+			[]interface{}{"coalesce", []interface{}{"to-number", []interface{}{"get", heatmap.WeightField}}, 0},
+			0, 0,
+			heatmap.MaxWeight, 1,
+		}
+	}
+
+	// Colours are spread evenly over the density range
+	color := []interface{}{"interpolate", []interface{}{"linear"}, []interface{}{"heatmap-density"}}
+	for i, c := range heatmap.Colors {
+		color = append(color, float64(i)/float64(len(heatmap.Colors)-1), c)
+	}
+
+	return models.HeatmapLayer{
+		ID:          layerID + "-heatmap",
+		Type:        "heatmap",
+		Source:      source,
+		SourceLayer: sourceLayer,
+		Filter:      []interface{}{"==", []interface{}{"geometry-type"}, "Point"},
+		Paint: models.HeatmapLayerPaint{
+			HeatmapWeight: weight,
+			HeatmapIntensity: []interface{}{
+				"interpolate", []interface{}{"linear"}, []interface{}{"zoom"},
+				0, heatmap.Intensity,
+				15, heatmap.Intensity * 3,
+			},
+			HeatmapColor: color,
+			HeatmapRadius: []interface{}{
+				"interpolate", []interface{}{"linear"}, []interface{}{"zoom"},
+				0, math.Max(heatmap.Radius/5, 1),
+				9, heatmap.Radius,
+				15, heatmap.Radius * 2,
+			},
+			HeatmapOpacity: 0.8,
+		},
+	}
+}
+
+// labelStyleLayer returns the text layer of a Polygon layer's label anchors
+func labelStyleLayer(layerID, source, sourceLayer string, labels models.LabelSettings) models.SymbolLayer {
+	return models.SymbolLayer{
+		ID:          layerID + "-labels",
+		Type:        "symbol",
+		Source:      source,
+		SourceLayer: models.LabelLayerName(sourceLayer),
+		MinZoom:     labels.MinZoom,
+		MaxZoom:     labels.MaxZoom + 1,
+		Layout: models.SymbolLayerLayout{
+			TextField:  []interface{}{"to-string", []interface{}{"get", labels.Field}},
+			TextFont:   labels.Font,
+			TextSize:   labels.Size,
+			TextAnchor: "center",
+		},
+		Paint: models.SymbolLayerPaint{
+			TextColor:     labels.Color,
+			TextHaloColor: labels.HaloColor,
+			TextHaloWidth: labels.HaloWidth,
+		},
+	}
+}
+
+// withMinZoom raises the minzoom of a style layer to minZoom
+func withMinZoom(styleLayer any, minZoom int) any {
+	switch l := styleLayer.(type) {
+	case models.FillLayer:
+		l.MinZoom = max(l.MinZoom, minZoom)
+		return l
+	case models.GridFillLayer:
+		l.MinZoom = max(l.MinZoom, minZoom)
+		return l
+	case models.LineLayer:
+		l.MinZoom = max(l.MinZoom, minZoom)
+		return l
+	case models.SymbolLayer:
+		l.MinZoom = max(l.MinZoom, minZoom)
+		return l
+	case models.HeatmapLayer:
+		l.MinZoom = max(l.MinZoom, minZoom)
+		return l
+	case models.FeatureStateLayer:
+		l.MinZoom = max(l.MinZoom, minZoom)
+		return l
+	case models.CircleLayer:
+		l.MinZoom = max(l.MinZoom, minZoom)
+		return l
+	}
+	return styleLayer
+}
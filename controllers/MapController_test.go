@@ -0,0 +1,220 @@
+package controllers
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/khankhulgun/khanmap/models"
+)
+
+// assertStyleJSON fails the test unless the style layers encode to the same JSON as want
+func assertStyleJSON(t *testing.T, name string, got any, want string) {
+	t.Helper()
+	data, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotValue, wantValue interface{}
+	if err := json.Unmarshal(data, &gotValue); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+		t.Fatalf("%s: invalid golden JSON: %v", name, err)
+	}
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		t.Errorf("%s:\n got %s\nwant %s", name, data, want)
+	}
+}
+
+func TestClusterStyleLayers(t *testing.T) {
+	cluster := models.ClusterSettings{Steps: []models.ClusterStep{
+		{Count: 0, Color: "#51bbd6", Radius: 15},
+		{Count: 100, Color: "#f1f075", Radius: 20},
+		{Count: 750, Color: "#f28cb1", Radius: 25},
+	}}
+	assertStyleJSON(t, "clusterStyleLayers", clusterStyleLayers("7", "layer-7", "7", cluster), `[
+		{"id": "7-clusters", "type": "circle", "source": "layer-7", "source-layer": "7",
+			"filter": ["has", "point_count"],
+			"paint": {
+				"circle-color": ["step", ["get", "point_count"], "#51bbd6", 100, "#f1f075", 750, "#f28cb1"],
+				"circle-radius": ["step", ["get", "point_count"], 15, 100, 20, 750, 25],
+				"circle-opacity": 1,
+				"circle-stroke-width": 5,
+				"circle-stroke-color": "#51bbd6",
+				"circle-stroke-opacity": 0.4
+			}},
+		{"id": "7-cluster-count", "type": "symbol", "source": "layer-7", "source-layer": "7",
+			"filter": ["has", "point_count"],
+			"layout": {
+				"text-field": ["get", "point_count_abbreviated"],
+				"text-font": ["Noto Sans Bold"],
+				"text-size": 12,
+				"text-offset": [0, 0],
+				"text-anchor": "center"
+			},
+			"paint": {"text-color": "#ffffff"}}
+	]`)
+
+	single := models.ClusterSettings{Steps: []models.ClusterStep{{Count: 0, Color: "#51bbd6", Radius: 15}}}
+	layers := clusterStyleLayers("7", "layer-7", "7", single)
+	circle, ok := layers[0].(models.CircleLayer)
+	if !ok {
+		t.Fatalf("clusterStyleLayers()[0] is %T, want models.CircleLayer", layers[0])
+	}
+	assertStyleJSON(t, "single step circle-color", circle.Paint.CircleColor, `["step", ["get", "point_count"], "#51bbd6"]`)
+}
+
+func TestAggregationStyleLayer(t *testing.T) {
+	aggregation := models.AggregationSettings{
+		Mode:    models.AggregationHexagon,
+		MaxZoom: 10,
+		Steps:   []models.AggregationStep{{Count: 0, Color: "#c7e9c0"}, {Count: 10, Color: "#74c476"}, {Count: 100, Color: "#31a354"}},
+	}
+	// The grid is drawn through its last aggregated zoom, maxzoom is exclusive
+	assertStyleJSON(t, "aggregationStyleLayer", aggregationStyleLayer("7", "layer-7", "7", aggregation), `
+		{"id": "7-aggregation", "type": "fill", "source": "layer-7", "source-layer": "7",
+			"maxzoom": 11,
+			"filter": ["has", "count"],
+			"paint": {
+				"fill-color": ["step", ["get", "count"], "#c7e9c0", 10, "#74c476", 100, "#31a354"],
+				"fill-opacity": 0.7,
+				"fill-outline-color": "#ffffff"
+			}}`)
+}
+
+func TestHeatmapStyleLayer(t *testing.T) {
+	tests := []struct {
+		name    string
+		heatmap models.HeatmapSettings
+		want    string
+	}{
+		{"weighted", models.HeatmapSettings{
+			WeightField: "population",
+			MaxWeight:   50,
+			Radius:      15,
+			Intensity:   1,
+			Colors:      []string{"rgba(0,0,255,0)", "#00ffff", "#ff0000"},
+		}, `{"id": "7-heatmap", "type": "heatmap", "source": "layer-7", "source-layer": "7",
+			"filter": ["==", ["geometry-type"], "Point"],
+			"paint": {
+				"heatmap-weight": ["interpolate", ["linear"], ["coalesce", ["to-number", ["get", "population"]], 0], 0, 0, 50, 1],
+				"heatmap-intensity": ["interpolate", ["linear"], ["zoom"], 0, 1, 15, 3],
+				"heatmap-color": ["interpolate", ["linear"], ["heatmap-density"], 0, "rgba(0,0,255,0)", 0.5, "#00ffff", 1, "#ff0000"],
+				"heatmap-radius": ["interpolate", ["linear"], ["zoom"], 0, 3, 9, 15, 15, 30],
+				"heatmap-opacity": 0.8
+			}}`},
+		{"unweighted with a small radius", models.HeatmapSettings{
+			MaxWeight: 1,
+			Radius:    2,
+			Intensity: 0.5,
+			Colors:    []string{"#000000", "#ffffff"},
+		}, `{"id": "7-heatmap", "type": "heatmap", "source": "layer-7", "source-layer": "7",
+			"filter": ["==", ["geometry-type"], "Point"],
+			"paint": {
+				"heatmap-weight": 1,
+				"heatmap-intensity": ["interpolate", ["linear"], ["zoom"], 0, 0.5, 15, 1.5],
+				"heatmap-color": ["interpolate", ["linear"], ["heatmap-density"], 0, "#000000", 1, "#ffffff"],
+				"heatmap-radius": ["interpolate", ["linear"], ["zoom"], 0, 1, 9, 2, 15, 4],
+				"heatmap-opacity": 0.8
+			}}`},
+	}
+	for _, tt := range tests {
+		assertStyleJSON(t, tt.name, heatmapStyleLayer("7", "layer-7", "7", tt.heatmap), tt.want)
+	}
+}
+
+func TestLabelStyleLayer(t *testing.T) {
+	labels := models.LabelSettings{
+		Field:     "name",
+		Font:      []string{"Noto Sans Regular"},
+		Size:      12,
+		Color:     "#333333",
+		HaloColor: "#ffffff",
+		HaloWidth: 1,
+		MinZoom:   8,
+		MaxZoom:   14,
+	}
+	// Labels come from their own source layer, drawn through their last zoom
+	assertStyleJSON(t, "labelStyleLayer", labelStyleLayer("7", "layer-7", "7", labels), `
+		{"id": "7-labels", "type": "symbol", "source": "layer-7", "source-layer": "7-labels",
+			"minzoom": 8,
+			"maxzoom": 15,
+			"layout": {
+				"text-field": ["to-string", ["get", "name"]],
+				"text-font": ["Noto Sans Regular"],
+				"text-size": 12,
+				"text-anchor": "center"
+			},
+			"paint": {"text-color": "#333333", "text-halo-color": "#ffffff", "text-halo-width": 1}}`)
+}
+
+func TestFeatureStateLayers(t *testing.T) {
+	tests := []struct {
+		geometryType string
+		want         string
+	}{
+		{"Point", `[
+			{"id": "7-hover", "type": "circle", "source": "layer-7", "source-layer": "7",
+				"filter": ["!", ["has", "point_count"]],
+				"paint": {
+					"circle-radius": 12,
+					"circle-color": "#ffeb3b",
+					"circle-opacity": ["case", ["boolean", ["feature-state", "hover"], false], 0.5, 0],
+					"circle-stroke-width": 2,
+					"circle-stroke-color": "#ffeb3b",
+					"circle-stroke-opacity": ["case", ["boolean", ["feature-state", "hover"], false], 0.5, 0]
+				}},
+			{"id": "7-selected", "type": "circle", "source": "layer-7", "source-layer": "7",
+				"filter": ["!", ["has", "point_count"]],
+				"paint": {
+					"circle-radius": 12,
+					"circle-color": "#ff9800",
+					"circle-opacity": ["case", ["boolean", ["feature-state", "selected"], false], 0.8, 0],
+					"circle-stroke-width": 2,
+					"circle-stroke-color": "#ff9800",
+					"circle-stroke-opacity": ["case", ["boolean", ["feature-state", "selected"], false], 0.8, 0]
+				}}
+		]`},
+		{"LineString", `[
+			{"id": "7-hover", "type": "line", "source": "layer-7", "source-layer": "7",
+				"paint": {
+					"line-color": "#ffeb3b",
+					"line-width": 5,
+					"line-opacity": ["case", ["boolean", ["feature-state", "hover"], false], 0.5, 0]
+				}},
+			{"id": "7-selected", "type": "line", "source": "layer-7", "source-layer": "7",
+				"paint": {
+					"line-color": "#ff9800",
+					"line-width": 5,
+					"line-opacity": ["case", ["boolean", ["feature-state", "selected"], false], 0.8, 0]
+				}}
+		]`},
+		{"Polygon", `[
+			{"id": "7-hover", "type": "fill", "source": "layer-7", "source-layer": "7",
+				"paint": {
+					"fill-color": "#ffeb3b",
+					"fill-opacity": ["case", ["boolean", ["feature-state", "hover"], false], 0.5, 0],
+					"fill-outline-color": "#ffeb3b"
+				}},
+			{"id": "7-selected", "type": "fill", "source": "layer-7", "source-layer": "7",
+				"paint": {
+					"fill-color": "#ff9800",
+					"fill-opacity": ["case", ["boolean", ["feature-state", "selected"], false], 0.8, 0],
+					"fill-outline-color": "#ff9800"
+				}}
+		]`},
+		{"GeometryCollection", `null`},
+	}
+	for _, tt := range tests {
+		layer := models.MapLayers{ID: "7", GeometryType: tt.geometryType}
+		assertStyleJSON(t, tt.geometryType, featureStateLayers(layer, "layer-7", "7"), tt.want)
+	}
+}
+
+func TestPromoteIDWithoutIDField(t *testing.T) {
+	// Without an ID field there is nothing to promote, and the table is never looked up
+	if got := promoteID(models.MapLayers{DbSchema: "public", DbTable: "places"}); got != "" {
+		t.Errorf("promoteID without an ID field = %q, want none", got)
+	}
+}
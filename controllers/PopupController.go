@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"github.com/gofiber/fiber/v2"
 	"github.com/khankhulgun/khanmap/maplayer"
+	"github.com/khankhulgun/khanmap/metrics"
 	"github.com/khankhulgun/khanmap/models"
 	"github.com/khankhulgun/khanmap/spatial"
 	"github.com/lambda-platform/lambda/DB"
 	"strings"
+	"time"
 )
 
 func GetMapData(c *fiber.Ctx) error {
@@ -48,6 +50,11 @@ func GetMapData(c *fiber.Ctx) error {
 		Features  []map[string]interface{} `json:"features"`
 	})
 
+	start := time.Now()
+	defer func() {
+		metrics.QueryDuration.WithLabelValues("map_data").Observe(time.Since(start).Seconds())
+	}()
+
 	// Loop through each layer ID and perform a query
 	for _, layerID := range input.Layers {
 		// Fetch layer details
@@ -58,6 +65,12 @@ func GetMapData(c *fiber.Ctx) error {
 				"message": fmt.Sprintf("Layer %s not found", layerID),
 			})
 		}
+		if err := maplayer.CheckLayerAccess(layerDetails, nil); err != nil {
+			return c.Status(maplayer.AccessStatus(err)).JSON(fiber.Map{
+				"status":  "error",
+				"message": fmt.Sprintf("Layer %s: %v", layerID, err),
+			})
+		}
 
 		// Determine if buffering is needed for precision
 		queryGeometry := input.Geometry
@@ -74,9 +87,20 @@ func GetMapData(c *fiber.Ctx) error {
 
 			queryGeometry = ""
 		}
+		// Temporal layers are limited to the time, time_from and time_to query params
+		timeConditions, timeArgs, err := maplayer.TimeConditions(layerDetails, c.Queries())
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"status":  "error",
+				"message": err.Error(),
+			})
+		}
+		query += strings.Join(timeConditions, " ")
+
 		// Execute the query
-		layerResults, err := spatial.ExecuteSpatialQuery(query, queryGeometry)
+		layerResults, err := spatial.ExecuteSpatialQuery(query, queryGeometry, timeArgs...)
 		if err != nil {
+			metrics.DBErrors.WithLabelValues("map_data").Inc()
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"status":  "error",
 				"message": "Error executing spatial query",
@@ -1,8 +1,12 @@
 package controllers
 
 import (
+	"strings"
+	"time"
+
 	"github.com/gofiber/fiber/v2"
 	"github.com/khankhulgun/khanmap/maplayer"
+	"github.com/khankhulgun/khanmap/metrics"
 	"github.com/khankhulgun/khanmap/models"
 	"github.com/khankhulgun/khanmap/spatial"
 )
@@ -44,6 +48,12 @@ func Spatial(c *fiber.Ctx) error {
 			"message": "Layer not found",
 		})
 	}
+	if err := maplayer.CheckLayerAccess(layerDetails, nil); err != nil {
+		return c.Status(maplayer.AccessStatus(err)).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
 
 	// Get the corresponding PostGIS function for the relationship
 	sqlFunction, err := spatial.GetRelationshipFunction(relationship)
@@ -63,8 +73,22 @@ func Spatial(c *fiber.Ctx) error {
 
 	// Build and execute the spatial query
 	query := spatial.BuildSpatialQuery(layerDetails, sqlFunction, input.Geometry, input.ReturnGeometry)
-	results, err := spatial.ExecuteSpatialQuery(query, input.Geometry)
+
+	// Temporal layers are limited to the time, time_from and time_to query params
+	timeConditions, timeArgs, err := maplayer.TimeConditions(layerDetails, c.Queries())
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
+	query += strings.Join(timeConditions, " ")
+
+	start := time.Now()
+	results, err := spatial.ExecuteSpatialQuery(query, input.Geometry, timeArgs...)
+	metrics.QueryDuration.WithLabelValues("spatial").Observe(time.Since(start).Seconds())
 	if err != nil {
+		metrics.DBErrors.WithLabelValues("spatial").Inc()
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"status":  "error",
 			"message": "Error executing spatial query",
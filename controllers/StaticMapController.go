@@ -0,0 +1,220 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/khankhulgun/khanmap/maplayer"
+	"github.com/khankhulgun/khanmap/models"
+	"github.com/khankhulgun/khanmap/render"
+	"github.com/khankhulgun/khanmap/tiles"
+	"github.com/lambda-platform/lambda/DB"
+	"gorm.io/gorm"
+)
+
+const maxStaticMapSize = 2048
+
+// StaticMap renders a PNG snapshot of a map's layers over a bounding box.
+// Query params: bbox=minLon,minLat,maxLon,maxLat, width, height, layers (comma separated IDs),
+// overlay (WKT or GeoJSON in EPSG:4326) and markers (lon,lat|lon,lat). Any other params are
+// applied as layer filters like on the tile endpoints.
+func StaticMap(c *fiber.Ctx) error {
+	id := c.Params("mapId")
+
+	bbox, err := parseStaticBBox(c.Query("bbox"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
+
+	width := min(max(c.QueryInt("width", 800), 1), maxStaticMapSize)
+	height := min(max(c.QueryInt("height", 600), 1), maxStaticMapSize)
+
+	var currentMap models.Map
+	result := DB.DB.Preload("Categories", func(db *gorm.DB) *gorm.DB {
+		return db.Order("category_order ASC").Where("is_active = ?", true).
+			Preload("Layers", func(db *gorm.DB) *gorm.DB {
+				return db.Order("layer_order ASC").Where("is_active = ?", true).
+					Preload("Legends", func(db *gorm.DB) *gorm.DB {
+						return db.Order("legend_order ASC")
+					})
+			})
+	}).Where("id = ?", id).First(&currentMap)
+
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Map not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Error retrieving map",
+			"error":   result.Error.Error(),
+		})
+	}
+
+	// Keep only the requested layers
+	if requested := c.Query("layers"); requested != "" {
+		wanted := make(map[string]bool)
+		for _, layerID := range strings.Split(requested, ",") {
+			wanted[strings.TrimSpace(layerID)] = true
+		}
+		for i := range currentMap.Categories {
+			var layers []models.MapLayers
+			for _, layer := range currentMap.Categories[i].Layers {
+				if wanted[layer.ID] {
+					layers = append(layers, layer)
+				}
+			}
+			currentMap.Categories[i].Layers = layers
+		}
+	}
+
+	// Reuse the layer styles of the generated MapLibre style
+	mapStyle, err := generateVectorTileStyle(currentMap.Categories, styleOptions{MapID: id})
+	if err != nil {
+		log.Printf("Static map style error for map %s: %v", id, err)
+	}
+	styleLayers, err := render.ParseStyleLayers(mapStyle.Layers)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Error reading map style",
+			"error":   err.Error(),
+		})
+	}
+
+	filters, areaFilters := maplayer.SplitFilters(c.Queries(), "bbox", "width", "height", "layers", "overlay", "markers")
+
+	proj := render.FitBounds(bbox[0], bbox[1], bbox[2], bbox[3], width, height)
+	zoom := min(max(int(math.Floor(proj.Zoom)), 0), 22)
+	minX, maxX, minY, maxY := proj.TileRange(zoom, width, height)
+
+	// Fetch and decode every visible tile of every layer once
+	type tileKey struct {
+		source string
+		x, y   int
+	}
+	decoded := make(map[tileKey][]render.Layer)
+	for _, category := range currentMap.Categories {
+		for _, layer := range category.Layers {
+			layerDetails, err := maplayer.FetchLayerDetails(layer.ID)
+			if err != nil {
+				continue
+			}
+			for x := minX; x <= maxX; x++ {
+				for y := minY; y <= maxY; y++ {
+					data, err := tiles.GetLayerTile(c.UserContext(), layerDetails, zoom, x, y, nil, filters, areaFilters)
+					if err != nil {
+						log.Printf("Static map tile %d/%d/%d of layer %s skipped: %v", zoom, x, y, layer.ID, err)
+						continue
+					}
+					tileLayers, err := render.DecodeMVT(data)
+					if err != nil {
+						log.Printf("Static map tile %d/%d/%d of layer %s skipped: %v", zoom, x, y, layer.ID, err)
+						continue
+					}
+					decoded[tileKey{layer.ID, x, y}] = tileLayers
+				}
+			}
+		}
+	}
+
+	canvas := render.NewCanvas(width, height, 1)
+	sprites := render.SpriteImages(id)
+	for _, styleLayer := range styleLayers {
+		for x := minX; x <= maxX; x++ {
+			for y := minY; y <= maxY; y++ {
+				for _, tileLayer := range decoded[tileKey{styleLayer.Source, x, y}] {
+					if tileLayer.Name == styleLayer.SourceLayer {
+						canvas.DrawStyleLayer(tileLayer, styleLayer, proj.TileTransform(zoom, x, y), proj.Zoom, sprites)
+					}
+				}
+			}
+		}
+	}
+
+	if overlay := c.Query("overlay"); overlay != "" {
+		geojson, err := overlayGeoJSON(overlay)
+		if err == nil {
+			err = canvas.DrawGeoJSON(geojson, proj)
+		}
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Invalid overlay geometry",
+				"error":   err.Error(),
+			})
+		}
+	}
+
+	if markers := c.Query("markers"); markers != "" {
+		for _, marker := range strings.Split(markers, "|") {
+			parts := strings.Split(marker, ",")
+			if len(parts) != 2 {
+				continue
+			}
+			lon, errLon := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+			lat, errLat := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+			if errLon == nil && errLat == nil {
+				canvas.DrawPin(proj.Pixel(lon, lat))
+			}
+		}
+	}
+
+	png, err := canvas.EncodePNG()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
+
+	c.Set("Content-Type", "image/png")
+	return c.Send(png)
+}
+
+// parseStaticBBox reads minLon,minLat,maxLon,maxLat
+func parseStaticBBox(value string) ([4]float64, error) {
+	var bbox [4]float64
+	if value == "" {
+		return bbox, errors.New("bbox parameter is required")
+	}
+
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return bbox, errors.New("bbox must be minLon,minLat,maxLon,maxLat")
+	}
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return bbox, fmt.Errorf("invalid bbox value %q", part)
+		}
+		bbox[i] = v
+	}
+	if bbox[0] >= bbox[2] || bbox[1] >= bbox[3] {
+		return bbox, errors.New("bbox minimum must be below its maximum")
+	}
+	return bbox, nil
+}
+
+// overlayGeoJSON returns the overlay as GeoJSON, converting WKT through PostGIS
+func overlayGeoJSON(overlay string) ([]byte, error) {
+	overlay = strings.TrimSpace(overlay)
+	if strings.HasPrefix(overlay, "{") {
+		return []byte(overlay), nil
+	}
+
+	var geojson string
+	err := DB.DB.Raw("SELECT ST_AsGeoJSON(ST_GeomFromText(?, 4326))", overlay).Row().Scan(&geojson)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(geojson), nil
+}
@@ -1,9 +1,12 @@
 package controllers
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/gofiber/fiber/v2"
+	"github.com/khankhulgun/khanmap/maplayer"
 	"github.com/khankhulgun/khanmap/models"
+	"github.com/khankhulgun/khanmap/tiles"
 	"github.com/lambda-platform/lambda/DB"
 	"github.com/lambda-platform/lambda/datagrid"
 	"gorm.io/gorm"
@@ -13,6 +16,51 @@ import (
 
 func AfterSaveLayer(datePre interface{}) {
 	GenerateMapServerConfig()
+
+	// Tiles rendered with the old style, filters or budget are dropped
+	layerID := savedLayerID(datePre)
+	if layerID != "" {
+		maplayer.ForgetLayer(layerID)
+		tiles.PurgeLayerCache(layerID)
+	}
+
+	if tiles.Config.Invalidation {
+		installLayerTrigger(layerID, tiles.InstallChangeTrigger, tiles.InstallChangeTriggers)
+	} else if tiles.Config.DataVersions {
+		installLayerTrigger(layerID, tiles.InstallDataVersionTrigger, tiles.InstallDataVersionTriggers)
+	}
+}
+
+// savedLayerID returns the ID of the saved layer form, or "" when it carries none
+func savedLayerID(saved interface{}) string {
+	var form struct {
+		ID interface{} `json:"id"`
+	}
+	if data, err := json.Marshal(saved); err == nil {
+		json.Unmarshal(data, &form)
+	}
+	if form.ID == nil {
+		return ""
+	}
+	return fmt.Sprint(form.ID)
+}
+
+// installLayerTrigger (re)creates the triggers of the saved layer's table with install.
+// Without the layer ID every active layer's triggers are recreated with installAll.
+func installLayerTrigger(layerID string, install func(models.MapLayersForTile), installAll func()) {
+	if layerID == "" {
+		installAll()
+		return
+	}
+
+	var layer models.MapLayersForTile
+	if err := DB.DB.Where("id = ?", layerID).First(&layer).Error; err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if layer.IsActive {
+		install(layer)
+	}
 }
 
 func DeleteLayer(id interface{}, grid datagrid.Datagrid, query *gorm.DB, c *fiber.Ctx) (interface{}, *gorm.DB, bool, bool) {
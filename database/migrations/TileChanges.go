@@ -0,0 +1,120 @@
+package migrations
+
+import (
+	"fmt"
+
+	"github.com/lambda-platform/lambda/DB"
+)
+
+// Trigger names on layer tables. Transition tables allow a single event per trigger,
+// so changes are tracked by one trigger per event named after ChangeTrigger.
+const (
+	ChangeTrigger      = "khanmap_tile_change"
+	DataVersionTrigger = "khanmap_data_version"
+)
+
+// MigrateTileChanges creates the change log, the per-table data versions and the trigger functions
+// used to invalidate saved tiles.
+// Layer tables get statement triggers calling map_server.track_tile_change('<geometry column>')
+// and map_server.bump_data_version().
+func MigrateTileChanges() error {
+	if err := MigrateDataVersions(); err != nil {
+		return err
+	}
+
+	// Create tile_changes table
+	createTileChangesTable := `
+	CREATE TABLE IF NOT EXISTS "map_server"."tile_changes" (
+		"id" BIGSERIAL PRIMARY KEY,
+		"db_schema" VARCHAR(255) NOT NULL,
+		"db_table" VARCHAR(255) NOT NULL,
+		"min_x" DOUBLE PRECISION NOT NULL,
+		"min_y" DOUBLE PRECISION NOT NULL,
+		"max_x" DOUBLE PRECISION NOT NULL,
+		"max_y" DOUBLE PRECISION NOT NULL,
+		"created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+		"processed_at" TIMESTAMPTZ
+	);
+	ALTER TABLE "map_server"."tile_changes" ADD COLUMN IF NOT EXISTS "claimed_at" TIMESTAMPTZ;
+	CREATE INDEX IF NOT EXISTS "tile_changes_pending_idx" ON "map_server"."tile_changes" ("id") WHERE "processed_at" IS NULL;
+	`
+	if err := DB.DB.Exec(createTileChangesTable).Error; err != nil {
+		return fmt.Errorf("failed to create tile_changes table: %w", err)
+	}
+
+	// Record the lon/lat extent of the rows changed by a statement and wake up listeners.
+	// The changed rows are read from the statement's transition tables, new_rows and old_rows.
+	// The notification names the table, so a transaction notifies once per changed table.
+	createTrackFunction := `
+	CREATE OR REPLACE FUNCTION map_server.track_tile_change() RETURNS trigger AS $$
+	DECLARE
+		geom_col text := TG_ARGV[0];
+		changed text;
+		extent geometry;
+	BEGIN
+		changed := CASE TG_OP
+			WHEN 'INSERT' THEN format('SELECT %1$I::geometry AS geom FROM new_rows', geom_col)
+			WHEN 'DELETE' THEN format('SELECT %1$I::geometry AS geom FROM old_rows', geom_col)
+			ELSE format('SELECT %1$I::geometry AS geom FROM old_rows UNION ALL SELECT %1$I::geometry FROM new_rows', geom_col)
+		END;
+		EXECUTE format('SELECT ST_SetSRID(ST_Extent(geom)::geometry, MAX(ST_SRID(geom))) FROM (%s) AS changed', changed)
+		INTO extent;
+
+		IF extent IS NULL OR ST_IsEmpty(extent) THEN
+			RETURN NULL;
+		END IF;
+		IF ST_SRID(extent) NOT IN (0, 4326) THEN
+			extent := ST_Transform(extent, 4326);
+		END IF;
+
+		INSERT INTO map_server.tile_changes (db_schema, db_table, min_x, min_y, max_x, max_y)
+		VALUES (TG_TABLE_SCHEMA, TG_TABLE_NAME, ST_XMin(extent), ST_YMin(extent), ST_XMax(extent), ST_YMax(extent));
+
+		PERFORM pg_notify('khanmap_tile_changes', TG_TABLE_SCHEMA || '.' || TG_TABLE_NAME);
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+	`
+	if err := DB.DB.Exec(createTrackFunction).Error; err != nil {
+		return fmt.Errorf("failed to create track_tile_change function: %w", err)
+	}
+
+	return nil
+}
+
+// MigrateDataVersions creates the per-table data versions and their trigger function.
+// Layer tables get a statement trigger calling map_server.bump_data_version().
+func MigrateDataVersions() error {
+	// Count the changes of each table; the count is the data version in tile URLs
+	createDataVersionsTable := `
+	CREATE TABLE IF NOT EXISTS "map_server"."layer_data_versions" (
+		"db_schema" VARCHAR(255) NOT NULL,
+		"db_table" VARCHAR(255) NOT NULL,
+		"version" BIGINT NOT NULL DEFAULT 0,
+		"updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY ("db_schema", "db_table")
+	);
+	`
+	if err := DB.DB.Exec(createDataVersionsTable).Error; err != nil {
+		return fmt.Errorf("failed to create layer_data_versions table: %w", err)
+	}
+
+	// Bump the table's data version once per statement, so bulk edits and concurrent writers
+	// do not queue up on the version row once for every changed row
+	createVersionFunction := `
+	CREATE OR REPLACE FUNCTION map_server.bump_data_version() RETURNS trigger AS $$
+	BEGIN
+		INSERT INTO map_server.layer_data_versions (db_schema, db_table, version)
+		VALUES (TG_TABLE_SCHEMA, TG_TABLE_NAME, 1)
+		ON CONFLICT (db_schema, db_table)
+		DO UPDATE SET version = layer_data_versions.version + 1, updated_at = now();
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+	`
+	if err := DB.DB.Exec(createVersionFunction).Error; err != nil {
+		return fmt.Errorf("failed to create bump_data_version function: %w", err)
+	}
+
+	return nil
+}
@@ -108,4 +108,8 @@ func Migrate() {
 
 	MigrateLookupTables()
 
+	if err := MigrateTileChanges(); err != nil {
+		log.Fatalf("Failed to migrate tile change tracking: %v", err)
+	}
+
 }
@@ -1,10 +1,13 @@
 package khanmap
 
 import (
+	"strings"
+
 	"github.com/gofiber/fiber/v2"
 	"github.com/khankhulgun/khanmap/controllers"
 	"github.com/khankhulgun/khanmap/database/migrations"
 	"github.com/khankhulgun/khanmap/database/seeds"
+	"github.com/khankhulgun/khanmap/metrics"
 	"github.com/khankhulgun/khanmap/tiles"
 	"github.com/lambda-platform/lambda/agent/agentMW"
 	"github.com/lambda-platform/lambda/config"
@@ -15,12 +18,36 @@ func Set(app *fiber.App, doCluster bool) {
 	tiles.DoCluster = doCluster
 	controllers.DoCluster = doCluster
 
+	app.Get("/tiles/map/:mapId.json", tiles.MapTileJSONHandler)
+	app.Get("/tiles/map/:mapId/:z/:x/:y.pbf", tiles.MapTileHandler)
+	app.Get("/tiles-with-permission/map/:mapId/:z/:x/:y.pbf", agentMW.IsLoggedIn(), tiles.MapTileHandlerWithPermission)
+	app.Get("/tiles/:layer.json", tiles.LayerTileJSONHandler)
 	app.Get("/tiles/:layer/:z/:x/:y.pbf", tiles.VectorTileHandler)
 	app.Get("/tiles-with-permission/:layer/:z/:x/:y.pbf", agentMW.IsLoggedIn(), tiles.VectorTileHandlerWithPermission)
+	app.Get("/raster/:layer/:z/:x/:y.png", tiles.RasterTileHandler)
+	app.Get("/raster-with-permission/:layer/:z/:x/:y.png", agentMW.IsLoggedIn(), tiles.RasterTileHandlerWithPermission)
 	app.Get("/saved-tiles/:layer/:z/:x/:y.pbf", tiles.SaveVectorTileHandler)
+	app.Get("/saved-tiles/:layer.:format", tiles.ArchiveHandler)
+	app.Get("/saved-tiles-with-permission/:layer.:format", agentMW.IsLoggedIn(), tiles.ArchiveHandlerWithPermission)
 	app.Get("/save-tile/:layer", tiles.SaveHandler)
+	app.Post("/seed-jobs/:layer", agentMW.IsLoggedIn(), tiles.StartSeedJobHandler)
+	app.Get("/seed-jobs", agentMW.IsLoggedIn(), tiles.SeedJobsHandler)
+	app.Get("/seed-jobs/:id", agentMW.IsLoggedIn(), tiles.SeedJobHandler)
+	app.Delete("/seed-jobs/:id", agentMW.IsLoggedIn(), tiles.CancelSeedJobHandler)
 	app.Get("/fonts/:fontstack/:range.pbf", tiles.FontHandler)
 	app.Get("/layer-bounds/:layer", tiles.LayerBoundsHandler)
+	app.Get("/layer-time-extent/:layer", tiles.LayerTimeExtentHandler)
+	app.Get("/metrics", metrics.Handler())
+
+	// OGC API - Features; the permission API serves the logged in user's layers
+	for _, ogc := range []fiber.Router{app.Group("/ogc"), app.Group("/ogc-with-permission", agentMW.IsLoggedIn())} {
+		ogc.Get("/", tiles.OGCLandingHandler)
+		ogc.Get("/conformance", tiles.OGCConformanceHandler)
+		ogc.Get("/collections", tiles.OGCCollectionsHandler)
+		ogc.Get("/collections/:layer", tiles.OGCCollectionHandler)
+		ogc.Get("/collections/:layer/items", tiles.OGCItemsHandler)
+		ogc.Get("/collections/:layer/items/:id", tiles.OGCItemHandler)
+	}
 
 	a := app.Group("/mapserver/api")
 	a.Get("/geometry-tables", agentMW.IsLoggedIn(), controllers.GeometryTables)
@@ -30,8 +57,14 @@ func Set(app *fiber.App, doCluster bool) {
 	a.Post("/spatial/:layer/:relationship", controllers.Spatial)
 	a.Post("/map-data", controllers.GetMapData)
 	a.Get("/filter-options", controllers.FilterOptions)
+	a.Get("/static/:mapId", controllers.StaticMap)
+	a.Get("/cluster/:layer", tiles.ClusterHandler)
+	a.Get("/cluster-with-permission/:layer", agentMW.IsLoggedIn(), tiles.ClusterHandlerWithPermission)
 
-	app.Static("/", "public")
+	// Saved tiles and exports are only served by the handlers above, which check layer access
+	app.Static("/", "public", fiber.Static{Next: func(c *fiber.Ctx) bool {
+		return strings.HasPrefix(c.Path(), "/saved-tiles")
+	}})
 
 	if config.Config.App.Migrate == "true" {
 		migrations.Migrate()
@@ -39,4 +72,11 @@ func Set(app *fiber.App, doCluster bool) {
 	if config.Config.App.Seed == "true" {
 		seeds.Seed()
 	}
+
+	tiles.ResumeSeedJobs()
+	if tiles.Config.Invalidation {
+		tiles.StartInvalidation()
+	} else if tiles.Config.DataVersions {
+		tiles.StartDataVersions()
+	}
 }
@@ -0,0 +1,91 @@
+package maplayer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/khankhulgun/khanmap/metrics"
+	"github.com/khankhulgun/khanmap/models"
+)
+
+var (
+	// ErrLayerNotFound is returned for inactive layers so they look the same as missing ones
+	ErrLayerNotFound = errors.New("layer not found")
+	// ErrLayerForbidden is returned when the user may not see the layer's data
+	ErrLayerForbidden = errors.New("layer access denied")
+)
+
+// CheckLayerAccess is the access policy every layer data endpoint applies before reading the
+// layer. Inactive layers are not found, non-public layers need a logged in user and permission
+// layers need the user's role and id to be granted. user is nil on public endpoints.
+func CheckLayerAccess(layer models.MapLayersForTile, user interface{}) error {
+	if !layer.IsActive {
+		return ErrLayerNotFound
+	}
+
+	userMap, loggedIn := user.(map[string]interface{})
+	if !layer.IsPublic && !loggedIn {
+		metrics.PermissionDenials.WithLabelValues(layer.ID).Inc()
+		return fmt.Errorf("%w: login required", ErrLayerForbidden)
+	}
+
+	if layer.IsPermission {
+		if err := CheckLayerPermissions(layer.RolePermissions, layer.UserPermissions, layer.IsRoleException, userMap); err != nil {
+			metrics.PermissionDenials.WithLabelValues(layer.ID).Inc()
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckLayerPermissions checks the user's role and id against a layer's role and user permissions.
+// With isRoleException set the permissions list who is excluded instead of who is allowed.
+func CheckLayerPermissions(rolePermissions []models.SubMapLayerRolePermissions, userPermissions []models.SubMapLayerUserPermissions, isRoleException *int, user map[string]interface{}) error {
+	exception := isRoleException != nil && *isRoleException != 0
+
+	if len(rolePermissions) > 0 {
+		roleFloat, isFloat := user["role"].(float64)
+		if !isFloat {
+			return fmt.Errorf("%w: user role is missing or not a float", ErrLayerForbidden)
+		}
+
+		roleFound := false
+		for _, perm := range rolePermissions {
+			if int(roleFloat) == perm.RoleID {
+				roleFound = true
+				break
+			}
+		}
+		if roleFound == exception {
+			return fmt.Errorf("%w: user role does not have permission for this layer", ErrLayerForbidden)
+		}
+	}
+
+	if len(userPermissions) > 0 {
+		idInt64, isInt64 := user["id"].(int64)
+		if !isInt64 {
+			return fmt.Errorf("%w: user id is missing or not an int64", ErrLayerForbidden)
+		}
+
+		userFound := false
+		for _, perm := range userPermissions {
+			if idInt64 == int64(perm.UserID) {
+				userFound = true
+				break
+			}
+		}
+		if userFound == exception {
+			return fmt.Errorf("%w: user does not have permission for this layer", ErrLayerForbidden)
+		}
+	}
+	return nil
+}
+
+// AccessStatus returns the HTTP status of a CheckLayerAccess error
+func AccessStatus(err error) int {
+	if errors.Is(err, ErrLayerNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusForbidden
+}
@@ -0,0 +1,75 @@
+package maplayer
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/khankhulgun/khanmap/models"
+)
+
+func TestCheckLayerAccess(t *testing.T) {
+	exception := 1
+	roles := []models.SubMapLayerRolePermissions{{RoleID: 3}}
+	users := []models.SubMapLayerUserPermissions{{UserID: 42}}
+
+	tests := []struct {
+		name  string
+		layer models.MapLayersForTile
+		user  interface{}
+		want  error
+	}{
+		{"inactive", models.MapLayersForTile{IsPublic: true}, nil, ErrLayerNotFound},
+		{"inactive with a user", models.MapLayersForTile{}, map[string]interface{}{"role": 3.0}, ErrLayerNotFound},
+		{"public", models.MapLayersForTile{IsActive: true, IsPublic: true}, nil, nil},
+		{"private without a user", models.MapLayersForTile{IsActive: true}, nil, ErrLayerForbidden},
+		{"private with a user", models.MapLayersForTile{IsActive: true}, map[string]interface{}{}, nil},
+		{"permission without permissions", models.MapLayersForTile{IsActive: true, IsPermission: true}, map[string]interface{}{}, nil},
+		{"role granted", models.MapLayersForTile{IsActive: true, IsPermission: true, RolePermissions: roles},
+			map[string]interface{}{"role": 3.0}, nil},
+		{"role not granted", models.MapLayersForTile{IsActive: true, IsPermission: true, RolePermissions: roles},
+			map[string]interface{}{"role": 4.0}, ErrLayerForbidden},
+		{"role missing", models.MapLayersForTile{IsActive: true, IsPermission: true, RolePermissions: roles},
+			map[string]interface{}{"role": "3"}, ErrLayerForbidden},
+		{"role excepted", models.MapLayersForTile{IsActive: true, IsPermission: true, RolePermissions: roles, IsRoleException: &exception},
+			map[string]interface{}{"role": 3.0}, ErrLayerForbidden},
+		{"role not excepted", models.MapLayersForTile{IsActive: true, IsPermission: true, RolePermissions: roles, IsRoleException: &exception},
+			map[string]interface{}{"role": 4.0}, nil},
+		{"user granted", models.MapLayersForTile{IsActive: true, IsPermission: true, UserPermissions: users},
+			map[string]interface{}{"id": int64(42)}, nil},
+		{"user not granted", models.MapLayersForTile{IsActive: true, IsPermission: true, UserPermissions: users},
+			map[string]interface{}{"id": int64(7)}, ErrLayerForbidden},
+		{"user id not an int64", models.MapLayersForTile{IsActive: true, IsPermission: true, UserPermissions: users},
+			map[string]interface{}{"id": 42.0}, ErrLayerForbidden},
+		{"user excepted", models.MapLayersForTile{IsActive: true, IsPermission: true, UserPermissions: users, IsRoleException: &exception},
+			map[string]interface{}{"id": int64(42)}, ErrLayerForbidden},
+		{"role granted, user not", models.MapLayersForTile{IsActive: true, IsPermission: true, RolePermissions: roles, UserPermissions: users},
+			map[string]interface{}{"role": 3.0, "id": int64(7)}, ErrLayerForbidden},
+		{"public permission layer without a user", models.MapLayersForTile{IsActive: true, IsPublic: true, IsPermission: true, RolePermissions: roles},
+			nil, ErrLayerForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckLayerAccess(tt.layer, tt.user)
+			if tt.want == nil && err != nil || tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("CheckLayerAccess = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{ErrLayerNotFound, http.StatusNotFound},
+		{ErrLayerForbidden, http.StatusForbidden},
+		{CheckLayerAccess(models.MapLayersForTile{IsActive: true}, nil), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if got := AccessStatus(tt.err); got != tt.want {
+			t.Errorf("AccessStatus(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
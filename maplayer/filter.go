@@ -2,9 +2,11 @@ package maplayer
 
 import (
 	"fmt"
+	"slices"
 	"strings"
 	"sync"
 
+	"github.com/khankhulgun/khanmap/models"
 	"github.com/lambda-platform/lambda/DB"
 )
 
@@ -55,6 +57,92 @@ func getTableSchema(schema, table string) (map[string]string, error) {
 	return columnTypes, nil
 }
 
+// LayerFields returns the attribute names of the layer's tiles with their TileJSON types
+func LayerFields(layer models.MapLayersForTile) map[string]string {
+	colTypes, _ := getTableSchema(layer.DbSchema, layer.DbTable)
+
+	fields := make(map[string]string)
+	for _, col := range LayerColumns(layer, true) {
+		fields[col] = fieldType(colTypes[col])
+	}
+	return fields
+}
+
+// HasColumn reports whether the table has the column
+func HasColumn(schema, table, column string) bool {
+	colTypes, _ := getTableSchema(schema, table)
+	_, ok := colTypes[column]
+	return ok
+}
+
+// IsNumericColumn reports whether the table has the column with a numeric type
+func IsNumericColumn(schema, table, column string) bool {
+	colTypes, _ := getTableSchema(schema, table)
+	dataType, ok := colTypes[column]
+	return ok && fieldType(dataType) == "Number"
+}
+
+// IsIntegerColumn reports whether the table has the column with an integer type
+func IsIntegerColumn(schema, table, column string) bool {
+	colTypes, _ := getTableSchema(schema, table)
+	switch colTypes[column] {
+	case "smallint", "integer", "bigint":
+		return true
+	}
+	return false
+}
+
+// fieldType maps a PostgreSQL column type to a TileJSON field type
+func fieldType(dataType string) string {
+	switch {
+	case dataType == "boolean":
+		return "Boolean"
+	case dataType == "smallint", dataType == "integer", dataType == "bigint",
+		dataType == "real", dataType == "double precision", strings.HasPrefix(dataType, "numeric"):
+		return "Number"
+	default:
+		return "String"
+	}
+}
+
+// SplitFilters separates request query params into attribute filters and the area filters, which
+// are applied through columns configured on each layer: districtID, regionID and the time params.
+// Reserved keys and the data version param are request options and are left out of both.
+func SplitFilters(query map[string]string, reserved ...string) (filters map[string]string, areaFilters map[string]string) {
+	filters = make(map[string]string)
+	areaFilters = make(map[string]string)
+
+	for key, value := range query {
+		if key == VersionParam || slices.Contains(reserved, key) {
+			continue
+		}
+		if key == "districtID" || key == "regionID" || slices.Contains(TimeParams, key) {
+			areaFilters[key] = value
+		} else {
+			filters[key] = value
+		}
+	}
+	return filters, areaFilters
+}
+
+// FiltersForTable drops filters on columns the table does not have, so one set of query
+// parameters can be applied to every layer of a map
+func FiltersForTable(filters map[string]string, schema, table string) map[string]string {
+	colTypes, err := getTableSchema(schema, table)
+	if err != nil || len(colTypes) == 0 {
+		return filters
+	}
+
+	result := make(map[string]string)
+	for key, value := range filters {
+		column := strings.TrimSuffix(key, "__like")
+		if _, ok := colTypes[column]; ok || key == "search" || key == "search_columns" {
+			result[key] = value
+		}
+	}
+	return result
+}
+
 // BuildFilterConditions generates SQL WHERE clauses and arguments from query parameters
 func BuildFilterConditions(filters map[string]string, schema, table string) ([]string, []interface{}) {
 	var conditions []string
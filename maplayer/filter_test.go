@@ -0,0 +1,64 @@
+package maplayer
+
+import (
+	"testing"
+
+	"github.com/khankhulgun/khanmap/models"
+)
+
+func TestColumnTypes(t *testing.T) {
+	schemaCache.Store("test.places", map[string]string{
+		"id":         "integer",
+		"code":       "character varying(20)",
+		"population": "bigint",
+		"area":       "numeric(10,2)",
+		"density":    "double precision",
+		"capital":    "boolean",
+	})
+	defer schemaCache.Delete("test.places")
+
+	tests := []struct {
+		column           string
+		integer, numeric bool
+	}{
+		{"id", true, true},
+		{"code", false, false},
+		{"population", true, true},
+		{"area", false, true},
+		{"density", false, true},
+		{"capital", false, false},
+		{"missing", false, false},
+	}
+	for _, tt := range tests {
+		if got := IsIntegerColumn("test", "places", tt.column); got != tt.integer {
+			t.Errorf("IsIntegerColumn(%q) = %v, want %v", tt.column, got, tt.integer)
+		}
+		if got := IsNumericColumn("test", "places", tt.column); got != tt.numeric {
+			t.Errorf("IsNumericColumn(%q) = %v, want %v", tt.column, got, tt.numeric)
+		}
+		if got := HasColumn("test", "places", tt.column); got != (tt.column != "missing") {
+			t.Errorf("HasColumn(%q) = %v, want %v", tt.column, got, tt.column != "missing")
+		}
+	}
+}
+
+func TestHeatmapWeightColumn(t *testing.T) {
+	schemaCache.Store("test.points", map[string]string{"population": "bigint", "name": "text"})
+	defer schemaCache.Delete("test.points")
+
+	tests := []struct {
+		weightField string
+		want        string
+	}{
+		{"", ""},
+		{"population", "population"},
+		{"name", ""},
+		{"missing", ""},
+	}
+	for _, tt := range tests {
+		heatmap := models.HeatmapSettings{Enabled: true, WeightField: tt.weightField}
+		if got := HeatmapWeightColumn("test", "points", heatmap); got != tt.want {
+			t.Errorf("HeatmapWeightColumn(%q) = %q, want %q", tt.weightField, got, tt.want)
+		}
+	}
+}
@@ -2,10 +2,12 @@ package maplayer
 
 import (
 	"log"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/dgraph-io/ristretto"
+	"github.com/khankhulgun/khanmap/metrics"
 	"github.com/khankhulgun/khanmap/models"
 	"github.com/lambda-platform/lambda/DB"
 )
@@ -17,10 +19,12 @@ func init() {
 		NumCounters: 1e7,     // number of keys to track frequency of (10M)
 		MaxCost:     1 << 30, // maximum cost of cache (1GB)
 		BufferItems: 64,      // number of keys per Get buffer
+		Metrics:     true,
 	})
 	if err != nil {
 		log.Fatalf("Failed to initialize cache: %v", err)
 	}
+	metrics.LayerCacheHitRatio(func() float64 { return layerCache.Metrics.Ratio() })
 }
 
 var layerCache *ristretto.Cache
@@ -31,10 +35,13 @@ func FetchLayerDetails(layerID string) (models.MapLayersForTile, error) {
 	if cachedLayer, found := layerCache.Get(layerID); found {
 		layerDetails, ok := cachedLayer.(models.MapLayersForTile)
 		if ok {
+			metrics.CacheLookup("layer", true)
 			return layerDetails, nil
 		}
 	}
 
+	metrics.CacheLookup("layer", false)
+
 	var layerDetails models.MapLayersForTile
 	err := DB.DB.Where("id = ?", layerID).
 		Preload("RolePermissions").
@@ -51,9 +58,19 @@ func FetchLayerDetails(layerID string) (models.MapLayersForTile, error) {
 	return layerDetails, nil
 }
 func ConstructSQLColumns(layer models.MapLayersForTile, ignoreGeometry bool) string {
+	var newColumns []string
+	for _, col := range LayerColumns(layer, ignoreGeometry) {
+		newColumns = append(newColumns, "\""+col+"\"")
+	}
+
+	return strings.Join(newColumns, ", ")
+}
+
+// LayerColumns returns the attribute columns selected for the layer, always including the ID field
+func LayerColumns(layer models.MapLayersForTile, ignoreGeometry bool) []string {
 	sqlColumns := layer.ColumnSelects
 	if sqlColumns == "" {
-		return "'" + layer.IDFieldName + "'"
+		return withHeatmapWeight(layer, []string{layer.IDFieldName})
 	}
 
 	columns := strings.Split(sqlColumns, ",")
@@ -84,12 +101,97 @@ func ConstructSQLColumns(layer models.MapLayersForTile, ignoreGeometry bool) str
 
 	var newColumns []string
 	for col := range columnMap {
-		newColumns = append(newColumns, "\""+col+"\"")
+		newColumns = append(newColumns, col)
 	}
 
 	if layer.UniqueValueField != nil && !uniqueValueFieldFound {
-		newColumns = append(newColumns, "\""+*layer.UniqueValueField+"\"")
+		newColumns = append(newColumns, *layer.UniqueValueField)
 	}
 
-	return strings.Join(newColumns, ", ")
+	return withHeatmapWeight(layer, newColumns)
+}
+
+// withHeatmapWeight adds the heatmap weight column when the layer is drawn as a weighted heatmap
+func withHeatmapWeight(layer models.MapLayersForTile, columns []string) []string {
+	weight := HeatmapWeightColumn(layer.DbSchema, layer.DbTable, layer.Heatmap.Settings())
+	if weight == "" || slices.Contains(columns, weight) {
+		return columns
+	}
+	return append(columns, weight)
+}
+
+// HeatmapWeightColumn returns the column weighting the heatmap of a table's points, or "" when
+// the heatmap is unweighted or its weight field is not a numeric column of the table
+func HeatmapWeightColumn(schema, table string, heatmap models.HeatmapSettings) string {
+	weight := heatmap.WeightColumn()
+	if weight == "" || IsNumericColumn(schema, table, weight) {
+		return weight
+	}
+	log.Printf("Heatmap weight field %s of %s.%s is not a numeric column", weight, schema, table)
+	return ""
+}
+
+// FetchMapLayerIDs returns the active layers of a map in category and layer order
+func FetchMapLayerIDs(mapID string) ([]string, error) {
+	mapID = strings.TrimSpace(mapID)
+	cacheKey := "map:" + mapID
+
+	if cachedIDs, found := layerCache.Get(cacheKey); found {
+		layerIDs, ok := cachedIDs.([]string)
+		if ok {
+			metrics.CacheLookup("map", true)
+			return layerIDs, nil
+		}
+	}
+
+	metrics.CacheLookup("map", false)
+
+	var layerIDs []string
+	err := DB.DB.Table("map_server.map_layers AS l").
+		Joins("JOIN map_server.view_map_layer_categories AS c ON c.id = l.map_layer_category_id").
+		Where("c.map_id = ? AND c.is_active = ? AND l.is_active = ?", mapID, true, true).
+		Order("c.category_order ASC, l.layer_order ASC").
+		Pluck("l.id", &layerIDs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	layerCache.SetWithTTL(cacheKey, layerIDs, 1, 5*time.Minute)
+	layerCache.Wait()
+
+	return layerIDs, nil
+}
+
+// ForgetLayer drops the cached details and legends of a layer after it was saved
+func ForgetLayer(layerID string) {
+	layerID = strings.TrimSpace(layerID)
+	layerCache.Del(layerID)
+	layerCache.Del("legends:" + layerID)
+}
+
+// FetchLayerLegends returns the legends of a layer in legend order
+func FetchLayerLegends(layerID string) ([]models.MapLayerLegends, error) {
+	layerID = strings.TrimSpace(layerID)
+	cacheKey := "legends:" + layerID
+
+	if cachedLegends, found := layerCache.Get(cacheKey); found {
+		legends, ok := cachedLegends.([]models.MapLayerLegends)
+		if ok {
+			metrics.CacheLookup("legends", true)
+			return legends, nil
+		}
+	}
+
+	metrics.CacheLookup("legends", false)
+
+	var legends []models.MapLayerLegends
+	err := DB.DB.Where("layer_id = ?", layerID).Order("legend_order ASC").Find(&legends).Error
+	if err != nil {
+		return nil, err
+	}
+
+	layerCache.SetWithTTL(cacheKey, legends, 1, 5*time.Minute)
+	layerCache.Wait()
+
+	return legends, nil
 }
@@ -0,0 +1,49 @@
+package maplayer
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/lambda-platform/lambda/DB"
+)
+
+var sridCache sync.Map
+
+// LayerSRID returns the SRID of a layer's geometry column as registered in geometry_columns.
+// Columns without a declared SRID are assumed to be stored in EPSG:4326.
+func LayerSRID(schema, table, geometryColumn string) int {
+	cacheKey := fmt.Sprintf("%s.%s.%s", schema, table, geometryColumn)
+
+	if cached, ok := sridCache.Load(cacheKey); ok {
+		return cached.(int)
+	}
+
+	var srid int
+	err := DB.DB.Raw(`
+		SELECT srid FROM geometry_columns
+		WHERE f_table_schema = ? AND f_table_name = ? AND f_geometry_column = ?`,
+		schema, table, geometryColumn).Row().Scan(&srid)
+	if err != nil {
+		log.Printf("SRID of %s not found, assuming 4326: %v", cacheKey, err)
+		return 4326
+	}
+	if srid == 0 {
+		srid = 4326
+	}
+
+	sridCache.Store(cacheKey, srid)
+	return srid
+}
+
+// TransformSQL wraps a geometry expression so it is returned in the target SRID
+func TransformSQL(expr string, srid, target int) string {
+	if srid == target {
+		return expr
+	}
+	if srid == 4326 {
+		// Undeclared columns may hold SRID 0 geometries that ST_Transform rejects
+		return fmt.Sprintf("ST_Transform(ST_SetSRID(%s, 4326), %d)", expr, target)
+	}
+	return fmt.Sprintf("ST_Transform(%s, %d)", expr, target)
+}
@@ -0,0 +1,90 @@
+package maplayer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/khankhulgun/khanmap/models"
+)
+
+// ErrInvalidTime is returned for time params that are not a year, month, day or instant
+var ErrInvalidTime = errors.New("invalid time")
+
+// TimeParams are the query params that filter temporal layers by their time fields
+var TimeParams = []string{"time", "time_from", "time_to"}
+
+// periodLayouts are the accepted time values, from a whole year down to an instant
+var periodLayouts = []struct {
+	layout string
+	next   func(time.Time) time.Time
+}{
+	{"2006", func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+	{"2006-01", func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+	{"2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }},
+	{"2006-01-02T15:04:05", func(t time.Time) time.Time { return t.Add(time.Second) }},
+	{time.RFC3339, func(t time.Time) time.Time { return t.Add(time.Second) }},
+}
+
+// ParsePeriod reads a year, month, day or instant and returns the period it covers.
+// start is inclusive and end exclusive, so "2024-05" covers all of May 2024.
+func ParsePeriod(value string) (start, end time.Time, err error) {
+	value = strings.TrimSpace(value)
+	for _, p := range periodLayouts {
+		if t, err := time.ParseInLocation(p.layout, value, time.UTC); err == nil {
+			return t, p.next(t), nil
+		}
+	}
+	return start, end, fmt.Errorf("%w %q", ErrInvalidTime, value)
+}
+
+// TimeConditions returns the WHERE conditions that keep a temporal layer's features overlapping
+// the requested time. time=P selects period P; time_from and time_to bound it from the start of
+// time_from to the end of time_to. Layers without a time field are not filtered.
+func TimeConditions(layer models.MapLayersForTile, params map[string]string) ([]string, []interface{}, error) {
+	if layer.TimeField == nil || *layer.TimeField == "" {
+		return nil, nil, nil
+	}
+
+	fromValue, toValue := params["time_from"], params["time_to"]
+	if value := params["time"]; value != "" {
+		fromValue, toValue = value, value
+	}
+	if fromValue == "" && toValue == "" {
+		return nil, nil, nil
+	}
+
+	startColumn, endColumn := TimeColumns(layer)
+
+	var conditions []string
+	var args []interface{}
+	if fromValue != "" {
+		from, _, err := ParsePeriod(fromValue)
+		if err != nil {
+			return nil, nil, err
+		}
+		conditions = append(conditions, "AND "+endColumn+" >= ?")
+		args = append(args, from)
+	}
+	if toValue != "" {
+		_, to, err := ParsePeriod(toValue)
+		if err != nil {
+			return nil, nil, err
+		}
+		conditions = append(conditions, "AND "+startColumn+" < ?")
+		args = append(args, to)
+	}
+	return conditions, args, nil
+}
+
+// TimeColumns returns the SQL expressions of a temporal layer's feature start and end times.
+// Features last from the time field to the end field, or are instants without one.
+func TimeColumns(layer models.MapLayersForTile) (start, end string) {
+	start = `"` + *layer.TimeField + `"`
+	end = start
+	if layer.TimeEndField != nil && *layer.TimeEndField != "" {
+		end = fmt.Sprintf(`COALESCE("%s", %s)`, *layer.TimeEndField, start)
+	}
+	return start, end
+}
@@ -0,0 +1,104 @@
+package maplayer
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/khankhulgun/khanmap/models"
+)
+
+func TestParsePeriod(t *testing.T) {
+	date := func(year int, month time.Month, day, hour, min, sec int) time.Time {
+		return time.Date(year, month, day, hour, min, sec, 0, time.UTC)
+	}
+	tests := []struct {
+		value      string
+		start, end time.Time
+	}{
+		{"2024", date(2024, 1, 1, 0, 0, 0), date(2025, 1, 1, 0, 0, 0)},
+		{"2024-05", date(2024, 5, 1, 0, 0, 0), date(2024, 6, 1, 0, 0, 0)},
+		{"2024-12", date(2024, 12, 1, 0, 0, 0), date(2025, 1, 1, 0, 0, 0)},
+		{"2024-02", date(2024, 2, 1, 0, 0, 0), date(2024, 3, 1, 0, 0, 0)},
+		{"2024-02-29", date(2024, 2, 29, 0, 0, 0), date(2024, 3, 1, 0, 0, 0)},
+		{"2024-12-31", date(2024, 12, 31, 0, 0, 0), date(2025, 1, 1, 0, 0, 0)},
+		{"2024-05-06T07:08:09", date(2024, 5, 6, 7, 8, 9), date(2024, 5, 6, 7, 8, 10)},
+		{"2024-05-06T07:08:09Z", date(2024, 5, 6, 7, 8, 9), date(2024, 5, 6, 7, 8, 10)},
+		{"2024-05-06T15:08:09+08:00", date(2024, 5, 6, 7, 8, 9), date(2024, 5, 6, 7, 8, 10)},
+		{"  2024-05 ", date(2024, 5, 1, 0, 0, 0), date(2024, 6, 1, 0, 0, 0)},
+	}
+	for _, tt := range tests {
+		start, end, err := ParsePeriod(tt.value)
+		if err != nil {
+			t.Errorf("ParsePeriod(%q) returned %v", tt.value, err)
+			continue
+		}
+		if !start.Equal(tt.start) || !end.Equal(tt.end) {
+			t.Errorf("ParsePeriod(%q) = %v, %v, want %v, %v", tt.value, start, end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestParsePeriodInvalid(t *testing.T) {
+	for _, value := range []string{
+		"",
+		" ",
+		"yesterday",
+		"24",
+		"2024-13",
+		"2024-5",
+		"2023-02-29",
+		"2024-05-06 07:08:09",
+		"2024-05-06T25:00:00",
+		"2024/05/06",
+	} {
+		if _, _, err := ParsePeriod(value); !errors.Is(err, ErrInvalidTime) {
+			t.Errorf("ParsePeriod(%q) returned %v, want ErrInvalidTime", value, err)
+		}
+	}
+}
+
+func TestTimeConditions(t *testing.T) {
+	field, endField := "observed_at", "ended_at"
+	layer := models.MapLayersForTile{TimeField: &field}
+	ranged := models.MapLayersForTile{TimeField: &field, TimeEndField: &endField}
+
+	tests := []struct {
+		name       string
+		layer      models.MapLayersForTile
+		params     map[string]string
+		conditions []string
+		args       []interface{}
+	}{
+		{"no time field", models.MapLayersForTile{}, map[string]string{"time": "2024"}, nil, nil},
+		{"no params", layer, map[string]string{}, nil, nil},
+		{"period", layer, map[string]string{"time": "2024-05"},
+			[]string{`AND "observed_at" >= ?`, `AND "observed_at" < ?`},
+			[]interface{}{time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)}},
+		{"period over range", layer, map[string]string{"time": "2024", "time_from": "2020", "time_to": "2021"},
+			[]string{`AND "observed_at" >= ?`, `AND "observed_at" < ?`},
+			[]interface{}{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}},
+		{"from only", ranged, map[string]string{"time_from": "2024-05-06"},
+			[]string{`AND COALESCE("ended_at", "observed_at") >= ?`},
+			[]interface{}{time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC)}},
+		{"to only", ranged, map[string]string{"time_to": "2024-05-06"},
+			[]string{`AND "observed_at" < ?`},
+			[]interface{}{time.Date(2024, 5, 7, 0, 0, 0, 0, time.UTC)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conditions, args, err := TimeConditions(tt.layer, tt.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(conditions, tt.conditions) || !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("TimeConditions() = %q, %v, want %q, %v", conditions, args, tt.conditions, tt.args)
+			}
+		})
+	}
+
+	if _, _, err := TimeConditions(layer, map[string]string{"time_to": "2024-13"}); !errors.Is(err, ErrInvalidTime) {
+		t.Errorf("TimeConditions with an invalid time_to returned %v, want ErrInvalidTime", err)
+	}
+}
@@ -0,0 +1,103 @@
+package maplayer
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/khankhulgun/khanmap/database/migrations"
+	"github.com/khankhulgun/khanmap/models"
+	"github.com/lambda-platform/lambda/DB"
+)
+
+// VersionParam is the query param carrying the data version in tile URLs. It is never a filter.
+const VersionParam = "v"
+
+// dataVersionTTL bounds how long a table's change counter is reused before it is read again
+const dataVersionTTL = 10 * time.Second
+
+// DataVersion identifies the current data and configuration of a layer. It combines the
+// change counter of the layer table, bumped by the data version trigger, with a hash of the
+// layer configuration, so editing either yields new tile URLs.
+func DataVersion(layer models.MapLayersForTile) string {
+	config, _ := json.Marshal(layer)
+	sum := sha256.Sum256(config)
+	return fmt.Sprintf("%d-%s", tableVersion(layer.DbSchema, layer.DbTable).version, hex.EncodeToString(sum[:4]))
+}
+
+// MapDataVersion identifies the current data of every layer of a map
+func MapDataVersion(layers []models.MapLayersForTile) string {
+	versions := make([]string, len(layers))
+	for i, layer := range layers {
+		versions[i] = layer.ID + "@" + DataVersion(layer)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(versions, ",")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// VersionTracked reports whether the layer table carries the data version trigger. Only then
+// does DataVersion change with the data, and tiles under it may be cached as immutable.
+func VersionTracked(layer models.MapLayersForTile) bool {
+	return tableVersion(layer.DbSchema, layer.DbTable).tracked
+}
+
+// MapVersionTracked reports whether the data version of every layer of a map is tracked
+func MapVersionTracked(layers []models.MapLayersForTile) bool {
+	for _, layer := range layers {
+		if !VersionTracked(layer) {
+			return false
+		}
+	}
+	return true
+}
+
+// ForgetDataVersion drops the cached change counter of a table after its rows changed
+func ForgetDataVersion(schema, table string) {
+	layerCache.Del("version:" + schema + "." + table)
+}
+
+// dataVersion is the change counter of a table and whether changes to it are counted
+type dataVersion struct {
+	version int64
+	tracked bool
+}
+
+// tableVersion returns the change counter of a table, 0 until its first tracked change.
+// Tables without the data version trigger, or whose version cannot be read, are untracked.
+func tableVersion(schema, table string) dataVersion {
+	cacheKey := "version:" + schema + "." + table
+	if cached, found := layerCache.Get(cacheKey); found {
+		if version, ok := cached.(dataVersion); ok {
+			return version
+		}
+	}
+
+	var version dataVersion
+	err := DB.DB.Raw(`
+		SELECT EXISTS (
+			SELECT 1 FROM pg_trigger t
+			JOIN pg_class c ON c.oid = t.tgrelid
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE n.nspname = ? AND c.relname = ? AND t.tgname = ? AND t.tgenabled <> 'D'
+		)`, schema, table, migrations.DataVersionTrigger).Row().Scan(&version.tracked)
+	if err == nil && version.tracked {
+		err = DB.DB.Raw(`SELECT version FROM map_server.layer_data_versions WHERE db_schema = ? AND db_table = ?`, schema, table).
+			Row().Scan(&version.version)
+		if errors.Is(err, sql.ErrNoRows) {
+			err = nil
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to read data version of %s.%s: %v", schema, table, err)
+		version = dataVersion{}
+	}
+
+	layerCache.SetWithTTL(cacheKey, version, 1, dataVersionTTL)
+	return version
+}
@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"sync/atomic"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// TileDuration is the time to serve a tile, cached or not
+	TileDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "khanmap_tile_duration_seconds",
+		Help:    "Time to serve a vector tile.",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"layer", "zoom"})
+
+	// TileBytes is the size of served tiles
+	TileBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "khanmap_tile_bytes",
+		Help:    "Size of served vector tiles in bytes.",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 8), // 256B .. 4MB
+	}, []string{"layer", "zoom"})
+
+	// DBErrors counts failed database queries by operation
+	DBErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "khanmap_db_errors_total",
+		Help: "Failed database queries.",
+	}, []string{"operation"})
+
+	// TileTimeouts counts tile queries cancelled by their statement timeout
+	TileTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "khanmap_tile_timeouts_total",
+		Help: "Tile queries cancelled by their statement timeout.",
+	}, []string{"layer"})
+
+	// MapTileDuration is the time to serve a map's composite tile, cached or not
+	MapTileDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "khanmap_map_tile_duration_seconds",
+		Help:    "Time to serve a composite map tile.",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"map", "zoom"})
+
+	// MapTileBytes is the size of served composite map tiles
+	MapTileBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "khanmap_map_tile_bytes",
+		Help:    "Size of served composite map tiles in bytes.",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 8), // 256B .. 4MB
+	}, []string{"map", "zoom"})
+
+	// MapTileTimeouts counts composite map tile queries cancelled by their statement timeout
+	MapTileTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "khanmap_map_tile_timeouts_total",
+		Help: "Composite map tile queries cancelled by their statement timeout.",
+	}, []string{"map"})
+
+	// CoalescedTiles counts tile requests whose query was shared with concurrent requests for the same tile
+	CoalescedTiles = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "khanmap_tile_coalesced_total",
+		Help: "Tile requests that shared one query with concurrent requests for the same tile.",
+	})
+
+	// PermissionDenials counts requests refused by a layer's role or user permissions
+	PermissionDenials = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "khanmap_permission_denials_total",
+		Help: "Layer requests refused by role or user permissions.",
+	}, []string{"layer"})
+
+	// FontCache counts glyph requests served from disk (hit) or downloaded (miss)
+	FontCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "khanmap_font_cache_total",
+		Help: "Glyph requests served from the local font cache or downloaded.",
+	}, []string{"result"})
+
+	// LayerCache counts lookups in the layer metadata cache by kind (layer, map, legends)
+	LayerCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "khanmap_layer_cache_total",
+		Help: "Layer metadata cache lookups.",
+	}, []string{"kind", "result"})
+
+	// QueryDuration is the time of feature queries such as map data and spatial lookups
+	QueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "khanmap_query_duration_seconds",
+		Help:    "Time of feature queries.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"query"})
+)
+
+// CacheLookup records a layer cache hit or miss
+func CacheLookup(kind string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	LayerCache.WithLabelValues(kind, result).Inc()
+}
+
+// layerCacheRatio reports the layer cache hit ratio, it is set by LayerCacheHitRatio
+var layerCacheRatio atomic.Pointer[func() float64]
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "khanmap_layer_cache_hit_ratio",
+		Help: "Hit ratio of the layer metadata cache.",
+	}, func() float64 {
+		if ratio := layerCacheRatio.Load(); ratio != nil {
+			return (*ratio)()
+		}
+		return 0
+	})
+}
+
+// LayerCacheHitRatio sets the source of the hit ratio reported by the layer cache itself.
+// A later call replaces the source.
+func LayerCacheHitRatio(ratio func() float64) {
+	layerCacheRatio.Store(&ratio)
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() fiber.Handler {
+	return adaptor.HTTPHandler(promhttp.Handler())
+}
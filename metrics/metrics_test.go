@@ -0,0 +1,27 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestLayerCacheHitRatio(t *testing.T) {
+	// The source may be set again, e.g. when the layer cache is rebuilt
+	LayerCacheHitRatio(func() float64 { return 0.25 })
+	LayerCacheHitRatio(func() float64 { return 0.75 })
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == "khanmap_layer_cache_hit_ratio" {
+			if got := family.GetMetric()[0].GetGauge().GetValue(); got != 0.75 {
+				t.Errorf("khanmap_layer_cache_hit_ratio = %v, want 0.75", got)
+			}
+			return
+		}
+	}
+	t.Error("khanmap_layer_cache_hit_ratio is not registered")
+}
@@ -0,0 +1,130 @@
+package models
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+)
+
+// AggregationConfig bins a Point layer into hexagon or square grid cells at low zoom levels.
+// Aggregation is off while AggregationMode is empty.
+type AggregationConfig struct {
+	AggregationMode     *string  `gorm:"column:aggregation_mode" json:"aggregation_mode"` // hexagon or square
+	AggregationCellSize *float64 `gorm:"column:aggregation_cell_size" json:"aggregation_cell_size"`
+	AggregationMaxZoom  *int     `gorm:"column:aggregation_max_zoom" json:"aggregation_max_zoom"`
+	AggregationField    *string  `gorm:"column:aggregation_field" json:"aggregation_field"`
+	AggregationSteps    *string  `gorm:"column:aggregation_steps;type:text" json:"aggregation_steps"`
+}
+
+// AggregationStep colours cells holding at least Count features.
+// Steps are stored as JSON, e.g. [{"count":0,"color":"#fee5d9"},{"count":50,"color":"#fb6a4a"}]
+// The step with the lowest count colours every smaller cell as well.
+type AggregationStep struct {
+	Count int    `json:"count"`
+	Color string `json:"color"`
+}
+
+// AggregationSettings is a layer's resolved aggregation setup
+type AggregationSettings struct {
+	Mode     string
+	CellSize float64 // square side or hexagon edge in screen pixels
+	MaxZoom  int     // last zoom level that is aggregated
+	Field    string  // numeric column summed and averaged per cell
+	Steps    []AggregationStep
+}
+
+const (
+	AggregationHexagon = "hexagon"
+	AggregationSquare  = "square"
+
+	DefaultAggregationCellSize = 32.0
+	DefaultAggregationMaxZoom  = 10
+)
+
+// DefaultAggregationSteps are the cell colours used when a layer defines none
+var DefaultAggregationSteps = []AggregationStep{
+	{Count: 0, Color: "#c7e9c0"},
+	{Count: 10, Color: "#74c476"},
+	{Count: 100, Color: "#31a354"},
+	{Count: 1000, Color: "#006d2c"},
+}
+
+// Settings resolves the layer's aggregation
+func (a AggregationConfig) Settings() AggregationSettings {
+	settings := AggregationSettings{
+		CellSize: DefaultAggregationCellSize,
+		MaxZoom:  DefaultAggregationMaxZoom,
+		Steps:    DefaultAggregationSteps,
+	}
+
+	if a.AggregationMode != nil && (*a.AggregationMode == AggregationHexagon || *a.AggregationMode == AggregationSquare) {
+		settings.Mode = *a.AggregationMode
+	}
+	if a.AggregationCellSize != nil && *a.AggregationCellSize > 0 {
+		settings.CellSize = *a.AggregationCellSize
+	}
+	if a.AggregationMaxZoom != nil {
+		settings.MaxZoom = *a.AggregationMaxZoom
+	}
+	if a.AggregationField != nil {
+		settings.Field = *a.AggregationField
+	}
+	if a.AggregationSteps != nil && *a.AggregationSteps != "" {
+		var steps []AggregationStep
+		if err := json.Unmarshal([]byte(*a.AggregationSteps), &steps); err != nil {
+			log.Printf("Invalid aggregation_steps %q: %v", *a.AggregationSteps, err)
+		} else if steps = validAggregationSteps(steps); len(steps) > 0 {
+			settings.Steps = steps
+		} else {
+			log.Printf("Invalid aggregation_steps %q: no valid step", *a.AggregationSteps)
+		}
+	}
+	return settings
+}
+
+// validAggregationSteps orders steps by count and drops the ones a MapLibre step expression
+// cannot take: negative counts and repeated counts.
+// The first step is the base of the expression, its count is not a threshold.
+func validAggregationSteps(steps []AggregationStep) []AggregationStep {
+	var valid []AggregationStep
+	for _, step := range steps {
+		if step.Count < 0 {
+			log.Printf("Aggregation step %+v skipped, counts must not be negative", step)
+			continue
+		}
+		valid = append(valid, step)
+	}
+	sort.SliceStable(valid, func(i, j int) bool { return valid[i].Count < valid[j].Count })
+
+	deduped := valid[:0]
+	for _, step := range valid {
+		if len(deduped) > 0 && deduped[len(deduped)-1].Count == step.Count {
+			log.Printf("Aggregation step %+v skipped, another step has the same count", step)
+			continue
+		}
+		deduped = append(deduped, step)
+	}
+	return deduped
+}
+
+// Enabled reports whether the layer is aggregated at any zoom
+func (s AggregationSettings) Enabled(geometryType string) bool {
+	return s.Mode != "" && geometryType == "Point"
+}
+
+// Aggregates reports whether tiles of the geometry type are aggregated at zoom z
+func (s AggregationSettings) Aggregates(geometryType string, z int) bool {
+	return s.Enabled(geometryType) && z <= s.MaxZoom
+}
+
+// Step returns the step that colours a cell of count features
+func (s AggregationSettings) Step(count float64) AggregationStep {
+	step := s.Steps[0]
+	for _, next := range s.Steps[1:] {
+		if count < float64(next.Count) {
+			break
+		}
+		step = next
+	}
+	return step
+}
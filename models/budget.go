@@ -0,0 +1,40 @@
+package models
+
+import "strings"
+
+// TileBudgetConfig caps the size of a layer's tiles. Tiles over MaxTileBytes are rebuilt
+// with simplified geometries, then with the budget columns only, then without small polygons.
+type TileBudgetConfig struct {
+	MaxTileBytes   *int     `gorm:"column:max_tile_bytes" json:"max_tile_bytes"`
+	BudgetColumns  *string  `gorm:"column:budget_columns" json:"budget_columns"`
+	MinFeatureArea *float64 `gorm:"column:min_feature_area" json:"min_feature_area"`
+}
+
+// TileBudgetSettings is a layer's resolved tile budget
+type TileBudgetSettings struct {
+	MaxBytes       int      // 0 means unlimited
+	Columns        []string // attributes kept once attributes are reduced, besides the ID field
+	MinFeatureArea float64  // smallest polygon area kept, in square screen pixels
+}
+
+const DefaultMinFeatureArea = 4.0
+
+// Settings resolves the layer's tile budget
+func (b TileBudgetConfig) Settings() TileBudgetSettings {
+	settings := TileBudgetSettings{MinFeatureArea: DefaultMinFeatureArea}
+
+	if b.MaxTileBytes != nil && *b.MaxTileBytes > 0 {
+		settings.MaxBytes = *b.MaxTileBytes
+	}
+	if b.BudgetColumns != nil {
+		for _, col := range strings.Split(*b.BudgetColumns, ",") {
+			if col = strings.TrimSpace(col); col != "" {
+				settings.Columns = append(settings.Columns, col)
+			}
+		}
+	}
+	if b.MinFeatureArea != nil && *b.MinFeatureArea > 0 {
+		settings.MinFeatureArea = *b.MinFeatureArea
+	}
+	return settings
+}
@@ -0,0 +1,137 @@
+package models
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+)
+
+// ClusterConfig is the per-layer clustering setup of Point layers.
+// Empty columns fall back to the defaults below. A layer that sets any cluster column is
+// clustered unless ClusterEnabled is false; only layers without cluster columns follow the
+// global setting.
+type ClusterConfig struct {
+	ClusterEnabled   *bool    `gorm:"column:cluster_enabled" json:"cluster_enabled"`
+	ClusterRadius    *float64 `gorm:"column:cluster_radius" json:"cluster_radius"`
+	ClusterMinPoints *int     `gorm:"column:cluster_min_points" json:"cluster_min_points"`
+	ClusterMaxZoom   *int     `gorm:"column:cluster_max_zoom" json:"cluster_max_zoom"`
+	ClusterSteps     *string  `gorm:"column:cluster_steps;type:text" json:"cluster_steps"`
+}
+
+// ClusterStep styles clusters with at least Count points.
+// Steps are stored as JSON, e.g. [{"count":0,"color":"#05a41b","radius":20},{"count":100,"color":"#02663a","radius":30}]
+// The step with the lowest count styles every smaller cluster as well.
+type ClusterStep struct {
+	Count  int     `json:"count"`
+	Color  string  `json:"color"`
+	Radius float64 `json:"radius"`
+}
+
+// ClusterSettings is a layer's resolved clustering setup
+type ClusterSettings struct {
+	Enabled   bool
+	Radius    float64 // cluster radius in screen pixels
+	MinPoints int
+	MaxZoom   int // last zoom level that is clustered
+	Steps     []ClusterStep
+}
+
+const (
+	DefaultClusterRadius    = 12.0
+	DefaultClusterMinPoints = 2
+	DefaultClusterMaxZoom   = 13
+)
+
+// DefaultClusterSteps are the cluster colours and sizes used when a layer defines none
+var DefaultClusterSteps = []ClusterStep{
+	{Count: 0, Color: "#05a41b", Radius: 20},
+	{Count: 100, Color: "#02663a", Radius: 30},
+	{Count: 750, Color: "#024f34", Radius: 40},
+}
+
+// Settings resolves the layer's clustering, using defaultEnabled when the layer sets no cluster column
+func (c ClusterConfig) Settings(defaultEnabled bool) ClusterSettings {
+	settings := ClusterSettings{
+		Enabled:   defaultEnabled,
+		Radius:    DefaultClusterRadius,
+		MinPoints: DefaultClusterMinPoints,
+		MaxZoom:   DefaultClusterMaxZoom,
+		Steps:     DefaultClusterSteps,
+	}
+
+	if c.ClusterEnabled != nil {
+		settings.Enabled = *c.ClusterEnabled
+	} else if c.configured() {
+		settings.Enabled = true
+	}
+	if c.ClusterRadius != nil && *c.ClusterRadius > 0 {
+		settings.Radius = *c.ClusterRadius
+	}
+	if c.ClusterMinPoints != nil && *c.ClusterMinPoints > 0 {
+		settings.MinPoints = *c.ClusterMinPoints
+	}
+	if c.ClusterMaxZoom != nil {
+		settings.MaxZoom = *c.ClusterMaxZoom
+	}
+	if c.ClusterSteps != nil && *c.ClusterSteps != "" {
+		var steps []ClusterStep
+		if err := json.Unmarshal([]byte(*c.ClusterSteps), &steps); err != nil {
+			log.Printf("Invalid cluster_steps %q: %v", *c.ClusterSteps, err)
+		} else if steps = validClusterSteps(steps); len(steps) > 0 {
+			settings.Steps = steps
+		} else {
+			log.Printf("Invalid cluster_steps %q: no valid step", *c.ClusterSteps)
+		}
+	}
+	return settings
+}
+
+// configured reports whether the layer sets any of its cluster columns
+func (c ClusterConfig) configured() bool {
+	return c.ClusterRadius != nil && *c.ClusterRadius > 0 ||
+		c.ClusterMinPoints != nil && *c.ClusterMinPoints > 0 ||
+		c.ClusterMaxZoom != nil ||
+		c.ClusterSteps != nil && *c.ClusterSteps != ""
+}
+
+// validClusterSteps orders steps by count and drops the ones a MapLibre step expression
+// cannot take: negative counts, repeated counts and steps without a positive radius.
+// The first step is the base of the expression, its count is not a threshold.
+func validClusterSteps(steps []ClusterStep) []ClusterStep {
+	var valid []ClusterStep
+	for _, step := range steps {
+		if step.Count < 0 || step.Radius <= 0 {
+			log.Printf("Cluster step %+v skipped, counts must not be negative and radii must be positive", step)
+			continue
+		}
+		valid = append(valid, step)
+	}
+	sort.SliceStable(valid, func(i, j int) bool { return valid[i].Count < valid[j].Count })
+
+	deduped := valid[:0]
+	for _, step := range valid {
+		if len(deduped) > 0 && deduped[len(deduped)-1].Count == step.Count {
+			log.Printf("Cluster step %+v skipped, another step has the same count", step)
+			continue
+		}
+		deduped = append(deduped, step)
+	}
+	return deduped
+}
+
+// Clusters reports whether tiles of the geometry type are clustered at zoom z
+func (s ClusterSettings) Clusters(geometryType string, z int) bool {
+	return s.Enabled && geometryType == "Point" && z <= s.MaxZoom
+}
+
+// Step returns the step that styles a cluster of count points
+func (s ClusterSettings) Step(count float64) ClusterStep {
+	step := s.Steps[0]
+	for _, next := range s.Steps[1:] {
+		if count < float64(next.Count) {
+			break
+		}
+		step = next
+	}
+	return step
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// HeatmapConfig draws a Point layer as a heatmap instead of markers
+type HeatmapConfig struct {
+	HeatmapEnabled     *bool    `gorm:"column:heatmap_enabled" json:"heatmap_enabled"`
+	HeatmapWeightField *string  `gorm:"column:heatmap_weight_field" json:"heatmap_weight_field"`
+	HeatmapMaxWeight   *float64 `gorm:"column:heatmap_max_weight" json:"heatmap_max_weight"`
+	HeatmapRadius      *float64 `gorm:"column:heatmap_radius" json:"heatmap_radius"`
+	HeatmapIntensity   *float64 `gorm:"column:heatmap_intensity" json:"heatmap_intensity"`
+	HeatmapColors      *string  `gorm:"column:heatmap_colors;type:text" json:"heatmap_colors"`
+}
+
+// HeatmapSettings is a layer's resolved heatmap setup
+type HeatmapSettings struct {
+	Enabled     bool
+	WeightField string  // numeric column weighting each point, every point weighs 1 without it
+	MaxWeight   float64 // weight value that counts as a full point
+	Radius      float64 // radius in pixels at zoom 9, shrinking towards zoom 0 and doubling towards zoom 15
+	Intensity   float64 // intensity at zoom 0, tripled towards zoom 15
+	Colors      []string
+}
+
+const (
+	DefaultHeatmapMaxWeight = 1.0
+	DefaultHeatmapRadius    = 15.0
+	DefaultHeatmapIntensity = 1.0
+)
+
+// DefaultHeatmapColors is the colour ramp from the lowest to the highest density.
+// Colors are stored as a JSON list, e.g. ["#fef0d9","#fdcc8a","#fc8d59","#d7301f"]
+var DefaultHeatmapColors = []string{
+	"rgba(33,102,172,0)",
+	"rgb(103,169,207)",
+	"rgb(209,229,240)",
+	"rgb(253,219,199)",
+	"rgb(239,138,98)",
+	"rgb(178,24,43)",
+}
+
+// Settings resolves the layer's heatmap
+func (h HeatmapConfig) Settings() HeatmapSettings {
+	settings := HeatmapSettings{
+		MaxWeight: DefaultHeatmapMaxWeight,
+		Radius:    DefaultHeatmapRadius,
+		Intensity: DefaultHeatmapIntensity,
+		Colors:    DefaultHeatmapColors,
+	}
+
+	if h.HeatmapEnabled != nil {
+		settings.Enabled = *h.HeatmapEnabled
+	}
+	if h.HeatmapWeightField != nil {
+		settings.WeightField = *h.HeatmapWeightField
+	}
+	if h.HeatmapMaxWeight != nil && *h.HeatmapMaxWeight > 0 {
+		settings.MaxWeight = *h.HeatmapMaxWeight
+	}
+	if h.HeatmapRadius != nil && *h.HeatmapRadius > 0 {
+		settings.Radius = *h.HeatmapRadius
+	}
+	if h.HeatmapIntensity != nil && *h.HeatmapIntensity > 0 {
+		settings.Intensity = *h.HeatmapIntensity
+	}
+	if h.HeatmapColors != nil && *h.HeatmapColors != "" {
+		var colors []string
+		if err := json.Unmarshal([]byte(*h.HeatmapColors), &colors); err != nil {
+			log.Printf("Invalid heatmap_colors %q: %v", *h.HeatmapColors, err)
+		} else if len(colors) >= 2 {
+			settings.Colors = colors
+		}
+	}
+	return settings
+}
+
+// WeightColumn returns the column the tiles must carry for the heatmap, if any
+func (s HeatmapSettings) WeightColumn() string {
+	if !s.Enabled {
+		return ""
+	}
+	return s.WeightField
+}
@@ -0,0 +1,102 @@
+package models
+
+import "strings"
+
+// LabelConfig names the features of a Polygon layer. Tiles carry a companion layer of
+// label anchors inside each polygon. Labelling is off while LabelField is empty.
+type LabelConfig struct {
+	LabelField     *string  `gorm:"column:label_field" json:"label_field"`
+	LabelFont      *string  `gorm:"column:label_font" json:"label_font"` // comma separated font stack
+	LabelSize      *float64 `gorm:"column:label_size" json:"label_size"`
+	LabelColor     *string  `gorm:"column:label_color" json:"label_color"`
+	LabelHaloColor *string  `gorm:"column:label_halo_color" json:"label_halo_color"`
+	LabelHaloWidth *float64 `gorm:"column:label_halo_width" json:"label_halo_width"`
+	LabelMinZoom   *int     `gorm:"column:label_min_zoom" json:"label_min_zoom"`
+	LabelMaxZoom   *int     `gorm:"column:label_max_zoom" json:"label_max_zoom"`
+}
+
+// LabelSettings is a layer's resolved label setup
+type LabelSettings struct {
+	Field     string
+	Font      []string
+	Size      float64
+	Color     string
+	HaloColor string
+	HaloWidth float64
+	MinZoom   int // first zoom level that is labelled
+	MaxZoom   int // last zoom level that is labelled
+}
+
+const (
+	DefaultLabelSize      = 12.0
+	DefaultLabelColor     = "#333333"
+	DefaultLabelHaloColor = "#ffffff"
+	DefaultLabelHaloWidth = 1.0
+	DefaultLabelMinZoom   = 0
+	DefaultLabelMaxZoom   = 22
+)
+
+// DefaultLabelFont is the font stack used when a layer defines none
+var DefaultLabelFont = []string{"Noto Sans Regular"}
+
+// Settings resolves the layer's labels
+func (l LabelConfig) Settings() LabelSettings {
+	settings := LabelSettings{
+		Font:      DefaultLabelFont,
+		Size:      DefaultLabelSize,
+		Color:     DefaultLabelColor,
+		HaloColor: DefaultLabelHaloColor,
+		HaloWidth: DefaultLabelHaloWidth,
+		MinZoom:   DefaultLabelMinZoom,
+		MaxZoom:   DefaultLabelMaxZoom,
+	}
+
+	if l.LabelField != nil {
+		settings.Field = strings.TrimSpace(*l.LabelField)
+	}
+	if l.LabelFont != nil {
+		var fonts []string
+		for _, font := range strings.Split(*l.LabelFont, ",") {
+			if font = strings.TrimSpace(font); font != "" {
+				fonts = append(fonts, font)
+			}
+		}
+		if len(fonts) > 0 {
+			settings.Font = fonts
+		}
+	}
+	if l.LabelSize != nil && *l.LabelSize > 0 {
+		settings.Size = *l.LabelSize
+	}
+	if l.LabelColor != nil && *l.LabelColor != "" {
+		settings.Color = *l.LabelColor
+	}
+	if l.LabelHaloColor != nil && *l.LabelHaloColor != "" {
+		settings.HaloColor = *l.LabelHaloColor
+	}
+	if l.LabelHaloWidth != nil && *l.LabelHaloWidth >= 0 {
+		settings.HaloWidth = *l.LabelHaloWidth
+	}
+	if l.LabelMinZoom != nil {
+		settings.MinZoom = *l.LabelMinZoom
+	}
+	if l.LabelMaxZoom != nil {
+		settings.MaxZoom = *l.LabelMaxZoom
+	}
+	return settings
+}
+
+// Enabled reports whether the layer is labelled at any zoom
+func (s LabelSettings) Enabled(geometryType string) bool {
+	return s.Field != "" && geometryType == "Polygon" && s.MinZoom <= s.MaxZoom
+}
+
+// Labels reports whether tiles of the geometry type carry labels at zoom z
+func (s LabelSettings) Labels(geometryType string, z int) bool {
+	return s.Enabled(geometryType) && z >= s.MinZoom && z <= s.MaxZoom
+}
+
+// LabelLayerName returns the name of the label layer that accompanies the tile layer layerName
+func LabelLayerName(layerName string) string {
+	return layerName + "-labels"
+}
@@ -29,6 +29,16 @@ type MapLayersForTile struct {
 	BaghIDField        *string                      `gorm:"column:bagh_id_field" json:"bagh_id_field"`
 	IsRoleException    *int                         `gorm:"column:is_role_exception" json:"is_role_exception"`
 	IsUserException    *int                         `gorm:"column:is_user_exception" json:"is_user_exception"`
+	CacheMaxAge        *int                         `gorm:"column:cache_max_age" json:"cache_max_age"`
+	StatementTimeout   *int                         `gorm:"column:statement_timeout" json:"statement_timeout"`
+	TimeField          *string                      `gorm:"column:time_field" json:"time_field"`
+	TimeEndField       *string                      `gorm:"column:time_end_field" json:"time_end_field"`
+	Cluster            ClusterConfig                `gorm:"embedded" json:"cluster"`
+	Aggregation        AggregationConfig            `gorm:"embedded" json:"aggregation"`
+	Heatmap            HeatmapConfig                `gorm:"embedded" json:"heatmap"`
+	Budget             TileBudgetConfig             `gorm:"embedded" json:"budget"`
+	Label              LabelConfig                  `gorm:"embedded" json:"label"`
+	Zoom               ZoomConfig                   `gorm:"embedded" json:"zoom"`
 	RolePermissions    []SubMapLayerRolePermissions `gorm:"foreignKey:LayerID" json:"role_permissions"`
 	UserPermissions    []SubMapLayerUserPermissions `gorm:"foreignKey:LayerID" json:"user_permissions"`
 	Filters            []SubMapLayerFilters         `gorm:"foreignKey:LayerID" json:"filters"`
@@ -74,6 +84,13 @@ type MapLayers struct {
 	BaghIDField        *string                      `gorm:"column:bagh_id_field" json:"bagh_id_field"`
 	IsRoleException    *int                         `gorm:"column:is_role_exception" json:"is_role_exception"`
 	IsUserException    *int                         `gorm:"column:is_user_exception" json:"is_user_exception"`
+	TimeField          *string                      `gorm:"column:time_field" json:"time_field"`
+	TimeEndField       *string                      `gorm:"column:time_end_field" json:"time_end_field"`
+	Cluster            ClusterConfig                `gorm:"embedded" json:"cluster"`
+	Aggregation        AggregationConfig            `gorm:"embedded" json:"aggregation"`
+	Heatmap            HeatmapConfig                `gorm:"embedded" json:"heatmap"`
+	Label              LabelConfig                  `gorm:"embedded" json:"label"`
+	Zoom               ZoomConfig                   `gorm:"embedded" json:"zoom"`
 	Layer              *interface{}                 `gorm:"-" json:"layer"`
 	Legends            []MapLayerLegends            `gorm:"foreignKey:LayerID" json:"legends"`
 	AdminFilters       []SubMapLayerAdminFilters    `gorm:"foreignKey:LayerID" json:"admin_filters"`
@@ -9,8 +9,12 @@ type VectorTileStyle struct {
 }
 
 type VectorSource struct {
-	Type  string   `json:"type"`
-	Tiles []string `json:"tiles"`
+	Type      string      `json:"type"`
+	URL       string      `json:"url,omitempty"`
+	Tiles     []string    `json:"tiles,omitempty"`
+	PromoteID interface{} `json:"promoteId,omitempty"` // property name, or source-layer to property name
+	MinZoom   int         `json:"minzoom,omitempty"`
+	MaxZoom   int         `json:"maxzoom,omitempty"` // clients overzoom the tiles above it
 }
 
 // Fill layer struct
@@ -19,6 +23,7 @@ type FillLayer struct {
 	Type        string         `json:"type"`
 	Source      string         `json:"source"`
 	SourceLayer string         `json:"source-layer"`
+	MinZoom     int            `json:"minzoom,omitempty"`
 	Paint       FillLayerPaint `json:"paint"`
 }
 
@@ -27,12 +32,31 @@ type FillLayerPaint struct {
 	FillOpacity float64 `json:"fill-opacity"`
 }
 
+// Graduated fill layer for aggregated grid cells
+type GridFillLayer struct {
+	ID          string             `json:"id"`
+	Type        string             `json:"type"`
+	Source      string             `json:"source"`
+	SourceLayer string             `json:"source-layer"`
+	MinZoom     int                `json:"minzoom,omitempty"`
+	MaxZoom     int                `json:"maxzoom"`
+	Filter      []interface{}      `json:"filter,omitempty"`
+	Paint       GridFillLayerPaint `json:"paint"`
+}
+
+type GridFillLayerPaint struct {
+	FillColor        interface{} `json:"fill-color"`
+	FillOpacity      float64     `json:"fill-opacity"`
+	FillOutlineColor string      `json:"fill-outline-color,omitempty"`
+}
+
 // Line layer struct
 type LineLayer struct {
 	ID          string         `json:"id"`
 	Type        string         `json:"type"`
 	Source      string         `json:"source"`
 	SourceLayer string         `json:"source-layer"`
+	MinZoom     int            `json:"minzoom,omitempty"`
 	Paint       LineLayerPaint `json:"paint"`
 }
 
@@ -47,6 +71,8 @@ type SymbolLayer struct {
 	Type        string            `json:"type"`
 	Source      string            `json:"source"`
 	SourceLayer string            `json:"source-layer"`
+	MinZoom     int               `json:"minzoom,omitempty"`
+	MaxZoom     int               `json:"maxzoom,omitempty"`
 	Filter      []interface{}     `json:"filter,omitempty"`
 	Layout      SymbolLayerLayout `json:"layout"`
 	Paint       SymbolLayerPaint  `json:"paint"`
@@ -66,8 +92,41 @@ type SymbolLayerLayout struct {
 }
 
 type SymbolLayerPaint struct {
-	IconColor string `json:"icon-color,omitempty"`
-	TextColor string `json:"text-color,omitempty"`
+	IconColor     string  `json:"icon-color,omitempty"`
+	TextColor     string  `json:"text-color,omitempty"`
+	TextHaloColor string  `json:"text-halo-color,omitempty"`
+	TextHaloWidth float64 `json:"text-halo-width,omitempty"`
+}
+
+// Heatmap layer struct for point density views
+type HeatmapLayer struct {
+	ID          string            `json:"id"`
+	Type        string            `json:"type"`
+	Source      string            `json:"source"`
+	SourceLayer string            `json:"source-layer"`
+	MinZoom     int               `json:"minzoom,omitempty"`
+	Filter      []interface{}     `json:"filter,omitempty"`
+	Paint       HeatmapLayerPaint `json:"paint"`
+}
+
+type HeatmapLayerPaint struct {
+	HeatmapWeight    interface{} `json:"heatmap-weight"`
+	HeatmapIntensity interface{} `json:"heatmap-intensity"`
+	HeatmapColor     interface{} `json:"heatmap-color"`
+	HeatmapRadius    interface{} `json:"heatmap-radius"`
+	HeatmapOpacity   float64     `json:"heatmap-opacity"`
+}
+
+// Highlight layer struct driven by feature-state. Paint holds the MapLibre
+// expressions of whichever layer type the highlight uses.
+type FeatureStateLayer struct {
+	ID          string                 `json:"id"`
+	Type        string                 `json:"type"`
+	Source      string                 `json:"source"`
+	SourceLayer string                 `json:"source-layer"`
+	MinZoom     int                    `json:"minzoom,omitempty"`
+	Filter      []interface{}          `json:"filter,omitempty"`
+	Paint       map[string]interface{} `json:"paint"`
 }
 
 // Circle layer struct for clustering
@@ -76,6 +135,7 @@ type CircleLayer struct {
 	Type        string           `json:"type"`
 	Source      string           `json:"source"`
 	SourceLayer string           `json:"source-layer"`
+	MinZoom     int              `json:"minzoom,omitempty"`
 	Filter      []interface{}    `json:"filter,omitempty"`
 	Paint       CircleLayerPaint `json:"paint"`
 }
@@ -0,0 +1,38 @@
+package models
+
+// ZoomConfig limits the zoom levels a layer's tiles are rendered at. Tiles below LayerMinZoom
+// are empty and tiles above LayerMaxZoom are cut out of the tile at LayerMaxZoom.
+type ZoomConfig struct {
+	LayerMinZoom *int `gorm:"column:min_zoom" json:"min_zoom"`
+	LayerMaxZoom *int `gorm:"column:max_zoom" json:"max_zoom"`
+}
+
+// ZoomSettings is a layer's resolved zoom range
+type ZoomSettings struct {
+	MinZoom int // first zoom level that is rendered
+	MaxZoom int // last zoom level that is rendered, higher zoom levels are overzoomed
+}
+
+const (
+	DefaultMinZoom = 0
+	DefaultMaxZoom = 22
+)
+
+// Settings resolves the layer's zoom range. Values outside 0-22 are clamped and a
+// max zoom below the min zoom is raised to it.
+func (z ZoomConfig) Settings() ZoomSettings {
+	settings := ZoomSettings{MinZoom: DefaultMinZoom, MaxZoom: DefaultMaxZoom}
+
+	if z.LayerMinZoom != nil {
+		settings.MinZoom = min(max(*z.LayerMinZoom, DefaultMinZoom), DefaultMaxZoom)
+	}
+	if z.LayerMaxZoom != nil {
+		settings.MaxZoom = min(max(*z.LayerMaxZoom, settings.MinZoom), DefaultMaxZoom)
+	}
+	return settings
+}
+
+// Overzoomed reports whether tile zoom z is above the range and cut out of a max zoom tile
+func (s ZoomSettings) Overzoomed(z int) bool {
+	return z > s.MaxZoom
+}
@@ -0,0 +1,333 @@
+package render
+
+import (
+	"errors"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// GeomType is the geometry type of a vector tile feature
+type GeomType int
+
+const (
+	GeomUnknown GeomType = iota
+	GeomPoint
+	GeomLineString
+	GeomPolygon
+)
+
+// Point is a position in tile coordinates, from 0 to the layer extent
+type Point struct {
+	X, Y float64
+}
+
+// Feature is one decoded vector tile feature. Geometry holds the points of a
+// multipoint, the lines of a multilinestring or the rings of a (multi)polygon.
+type Feature struct {
+	ID         uint64
+	Type       GeomType
+	Properties map[string]interface{}
+	Geometry   [][]Point
+}
+
+// Layer is one decoded vector tile layer
+type Layer struct {
+	Name     string
+	Extent   int
+	Features []Feature
+}
+
+var errMalformedTile = errors.New("malformed vector tile")
+
+// DecodeMVT decodes a Mapbox Vector Tile as produced by ST_AsMVT
+func DecodeMVT(data []byte) ([]Layer, error) {
+	var layers []Layer
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, errMalformedTile
+		}
+		data = data[n:]
+
+		if num == 3 && typ == protowire.BytesType {
+			raw, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return nil, errMalformedTile
+			}
+			data = data[n:]
+
+			layer, err := decodeLayer(raw)
+			if err != nil {
+				return nil, err
+			}
+			layers = append(layers, layer)
+			continue
+		}
+
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return nil, errMalformedTile
+		}
+		data = data[n:]
+	}
+	return layers, nil
+}
+
+type rawFeature struct {
+	id       uint64
+	geomType GeomType
+	tags     []uint64
+	geometry []uint64
+}
+
+func decodeLayer(data []byte) (Layer, error) {
+	layer := Layer{Extent: 4096}
+	var keys []string
+	var values []interface{}
+	var features []rawFeature
+
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return layer, errMalformedTile
+		}
+		data = data[n:]
+
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			name, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return layer, errMalformedTile
+			}
+			layer.Name = name
+			data = data[n:]
+		case num == 2 && typ == protowire.BytesType:
+			raw, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return layer, errMalformedTile
+			}
+			feature, err := decodeFeature(raw)
+			if err != nil {
+				return layer, err
+			}
+			features = append(features, feature)
+			data = data[n:]
+		case num == 3 && typ == protowire.BytesType:
+			key, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return layer, errMalformedTile
+			}
+			keys = append(keys, key)
+			data = data[n:]
+		case num == 4 && typ == protowire.BytesType:
+			raw, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return layer, errMalformedTile
+			}
+			value, err := decodeValue(raw)
+			if err != nil {
+				return layer, err
+			}
+			values = append(values, value)
+			data = data[n:]
+		case num == 5 && typ == protowire.VarintType:
+			extent, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return layer, errMalformedTile
+			}
+			layer.Extent = int(extent)
+			data = data[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return layer, errMalformedTile
+			}
+			data = data[n:]
+		}
+	}
+
+	// Keys and values may follow the features, so tags are resolved last
+	for _, raw := range features {
+		feature := Feature{
+			ID:         raw.id,
+			Type:       raw.geomType,
+			Properties: make(map[string]interface{}),
+			Geometry:   decodeGeometry(raw.geomType, raw.geometry),
+		}
+		for i := 0; i+1 < len(raw.tags); i += 2 {
+			k, v := int(raw.tags[i]), int(raw.tags[i+1])
+			if k < len(keys) && v < len(values) {
+				feature.Properties[keys[k]] = values[v]
+			}
+		}
+		layer.Features = append(layer.Features, feature)
+	}
+	return layer, nil
+}
+
+func decodeFeature(data []byte) (rawFeature, error) {
+	var feature rawFeature
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return feature, errMalformedTile
+		}
+		data = data[n:]
+
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			id, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return feature, errMalformedTile
+			}
+			feature.id = id
+			data = data[n:]
+		case num == 2 && typ == protowire.BytesType:
+			packed, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return feature, errMalformedTile
+			}
+			tags, err := decodePacked(packed)
+			if err != nil {
+				return feature, err
+			}
+			feature.tags = tags
+			data = data[n:]
+		case num == 3 && typ == protowire.VarintType:
+			geomType, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return feature, errMalformedTile
+			}
+			feature.geomType = GeomType(geomType)
+			data = data[n:]
+		case num == 4 && typ == protowire.BytesType:
+			packed, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return feature, errMalformedTile
+			}
+			geometry, err := decodePacked(packed)
+			if err != nil {
+				return feature, err
+			}
+			feature.geometry = geometry
+			data = data[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return feature, errMalformedTile
+			}
+			data = data[n:]
+		}
+	}
+	return feature, nil
+}
+
+func decodePacked(data []byte) ([]uint64, error) {
+	var result []uint64
+	for len(data) > 0 {
+		v, n := protowire.ConsumeVarint(data)
+		if n < 0 {
+			return nil, errMalformedTile
+		}
+		result = append(result, v)
+		data = data[n:]
+	}
+	return result, nil
+}
+
+func decodeValue(data []byte) (interface{}, error) {
+	var value interface{}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, errMalformedTile
+		}
+		data = data[n:]
+
+		switch num {
+		case 1:
+			s, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return nil, errMalformedTile
+			}
+			value = s
+			data = data[n:]
+		case 2:
+			f, n := protowire.ConsumeFixed32(data)
+			if n < 0 {
+				return nil, errMalformedTile
+			}
+			value = float64(math.Float32frombits(f))
+			data = data[n:]
+		case 3:
+			f, n := protowire.ConsumeFixed64(data)
+			if n < 0 {
+				return nil, errMalformedTile
+			}
+			value = math.Float64frombits(f)
+			data = data[n:]
+		case 4, 5, 6, 7:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return nil, errMalformedTile
+			}
+			switch num {
+			case 4:
+				value = int64(v)
+			case 5:
+				value = v
+			case 6:
+				value = protowire.DecodeZigZag(v)
+			case 7:
+				value = v != 0
+			}
+			data = data[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return nil, errMalformedTile
+			}
+			data = data[n:]
+		}
+	}
+	return value, nil
+}
+
+// decodeGeometry runs the MoveTo/LineTo/ClosePath command stream of a feature
+func decodeGeometry(geomType GeomType, commands []uint64) [][]Point {
+	var parts [][]Point
+	var current []Point
+	var x, y int64
+
+	for i := 0; i < len(commands); {
+		command := commands[i] & 0x7
+		count := int(commands[i] >> 3)
+		i++
+
+		switch command {
+		case 1, 2: // MoveTo, LineTo
+			for j := 0; j < count && i+1 < len(commands); j++ {
+				x += protowire.DecodeZigZag(commands[i])
+				y += protowire.DecodeZigZag(commands[i+1])
+				i += 2
+
+				if command == 1 && geomType != GeomPoint && len(current) > 0 {
+					parts = append(parts, current)
+					current = nil
+				}
+				current = append(current, Point{X: float64(x), Y: float64(y)})
+			}
+		case 7: // ClosePath
+			if len(current) > 0 {
+				current = append(current, current[0])
+			}
+		default:
+			return parts
+		}
+	}
+	if len(current) > 0 {
+		parts = append(parts, current)
+	}
+	return parts
+}
@@ -0,0 +1,182 @@
+package render
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"math"
+)
+
+// Projection maps lon/lat to canvas pixels in Web Mercator at a fractional zoom
+type Projection struct {
+	Zoom      float64
+	WorldSize float64
+	OffsetX   float64
+	OffsetY   float64
+}
+
+// FitBounds returns the projection that centers the lon/lat bounds in a width x height
+// canvas at the largest zoom showing all of them
+func FitBounds(minLon, minLat, maxLon, maxLat float64, width, height int) Projection {
+	x0, y0 := mercator(minLon, maxLat)
+	x1, y1 := mercator(maxLon, minLat)
+
+	dx, dy := math.Max(x1-x0, 1e-9), math.Max(y1-y0, 1e-9)
+	worldSize := math.Min(float64(width)/dx, float64(height)/dy)
+
+	centerX, centerY := (x0+x1)/2, (y0+y1)/2
+	return Projection{
+		Zoom:      math.Log2(worldSize / 256),
+		WorldSize: worldSize,
+		OffsetX:   float64(width)/2 - centerX*worldSize,
+		OffsetY:   float64(height)/2 - centerY*worldSize,
+	}
+}
+
+// mercator returns the position of lon/lat on the unit Web Mercator square
+func mercator(lon, lat float64) (float64, float64) {
+	lat = math.Max(math.Min(lat, 85.0511287798), -85.0511287798)
+	latRad := lat * math.Pi / 180
+	x := (lon + 180) / 360
+	y := (1 - math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi) / 2
+	return x, y
+}
+
+// Pixel returns the canvas position of lon/lat
+func (p Projection) Pixel(lon, lat float64) (float64, float64) {
+	x, y := mercator(lon, lat)
+	return x*p.WorldSize + p.OffsetX, y*p.WorldSize + p.OffsetY
+}
+
+// TileTransform places tile x/y of zoom z on the canvas
+func (p Projection) TileTransform(z, x, y int) Transform {
+	tileSize := p.WorldSize / math.Exp2(float64(z))
+	return Transform{
+		OriginX:  float64(x)*tileSize + p.OffsetX,
+		OriginY:  float64(y)*tileSize + p.OffsetY,
+		TileSize: tileSize,
+	}
+}
+
+// TileRange returns the tiles of zoom z visible on a width x height canvas
+func (p Projection) TileRange(z, width, height int) (minX, maxX, minY, maxY int) {
+	tileSize := p.WorldSize / math.Exp2(float64(z))
+	last := (1 << z) - 1
+
+	minX = max(int(math.Floor(-p.OffsetX/tileSize)), 0)
+	maxX = min(int(math.Floor((float64(width)-p.OffsetX)/tileSize)), last)
+	minY = max(int(math.Floor(-p.OffsetY/tileSize)), 0)
+	maxY = min(int(math.Floor((float64(height)-p.OffsetY)/tileSize)), last)
+	return
+}
+
+var (
+	overlayStroke = color.NRGBA{0xe5, 0x39, 0x35, 0xff}
+	overlayFill   = color.NRGBA{0xe5, 0x39, 0x35, 0x40}
+	pinStroke     = color.NRGBA{0xff, 0xff, 0xff, 0xff}
+)
+
+type geoJSON struct {
+	Type        string            `json:"type"`
+	Coordinates json.RawMessage   `json:"coordinates"`
+	Geometries  []json.RawMessage `json:"geometries"`
+	Geometry    json.RawMessage   `json:"geometry"`
+	Features    []json.RawMessage `json:"features"`
+}
+
+// DrawGeoJSON draws a lon/lat GeoJSON geometry, feature or feature collection as an overlay
+func (c *Canvas) DrawGeoJSON(data []byte, proj Projection) error {
+	var g geoJSON
+	if err := json.Unmarshal(data, &g); err != nil {
+		return fmt.Errorf("invalid GeoJSON: %w", err)
+	}
+
+	// Pixel coordinates are drawn with an identity transform
+	identity := Transform{TileSize: 1}
+	project := func(coords [][2]float64) []Point {
+		points := make([]Point, len(coords))
+		for i, coord := range coords {
+			x, y := proj.Pixel(coord[0], coord[1])
+			points[i] = Point{X: x, Y: y}
+		}
+		return points
+	}
+	drawPolygon := func(rings [][][2]float64) {
+		var paths [][]Point
+		for _, ring := range rings {
+			paths = append(paths, project(ring))
+		}
+		c.fillPaths(paths, 1, identity, overlayFill)
+		c.strokePaths(paths, 1, identity, overlayStroke, 3, true)
+	}
+
+	switch g.Type {
+	case "FeatureCollection":
+		for _, feature := range g.Features {
+			if err := c.DrawGeoJSON(feature, proj); err != nil {
+				return err
+			}
+		}
+	case "Feature":
+		if len(g.Geometry) > 0 && string(g.Geometry) != "null" {
+			return c.DrawGeoJSON(g.Geometry, proj)
+		}
+	case "GeometryCollection":
+		for _, geometry := range g.Geometries {
+			if err := c.DrawGeoJSON(geometry, proj); err != nil {
+				return err
+			}
+		}
+	case "Point":
+		var coord [2]float64
+		if err := json.Unmarshal(g.Coordinates, &coord); err != nil {
+			return err
+		}
+		c.DrawPin(proj.Pixel(coord[0], coord[1]))
+	case "MultiPoint":
+		var coords [][2]float64
+		if err := json.Unmarshal(g.Coordinates, &coords); err != nil {
+			return err
+		}
+		for _, coord := range coords {
+			c.DrawPin(proj.Pixel(coord[0], coord[1]))
+		}
+	case "LineString":
+		var coords [][2]float64
+		if err := json.Unmarshal(g.Coordinates, &coords); err != nil {
+			return err
+		}
+		c.strokePaths([][]Point{project(coords)}, 1, identity, overlayStroke, 3, false)
+	case "MultiLineString":
+		var lines [][][2]float64
+		if err := json.Unmarshal(g.Coordinates, &lines); err != nil {
+			return err
+		}
+		for _, line := range lines {
+			c.strokePaths([][]Point{project(line)}, 1, identity, overlayStroke, 3, false)
+		}
+	case "Polygon":
+		var rings [][][2]float64
+		if err := json.Unmarshal(g.Coordinates, &rings); err != nil {
+			return err
+		}
+		drawPolygon(rings)
+	case "MultiPolygon":
+		var polygons [][][][2]float64
+		if err := json.Unmarshal(g.Coordinates, &polygons); err != nil {
+			return err
+		}
+		for _, rings := range polygons {
+			drawPolygon(rings)
+		}
+	default:
+		return fmt.Errorf("unsupported GeoJSON type %q", g.Type)
+	}
+	return nil
+}
+
+// DrawPin draws a marker pin at the canvas position
+func (c *Canvas) DrawPin(x, y float64) {
+	c.fillCircle(x, y, 8*c.ratio, pinStroke)
+	c.fillCircle(x, y, 6*c.ratio, overlayStroke)
+}
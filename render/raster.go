@@ -0,0 +1,405 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/khankhulgun/khanmap/models"
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/fixed"
+)
+
+// Style is how the features of one layer are drawn
+type Style struct {
+	LayerID          string
+	Legends          []models.MapLayerLegends
+	UniqueValueField string
+	ClusterSteps     []models.ClusterStep
+	AggregationSteps []models.AggregationStep // set for aggregated layers
+}
+
+// Canvas draws decoded vector tile layers into an RGBA image.
+// Sizes given in CSS pixels are multiplied by the pixel ratio.
+type Canvas struct {
+	img     *image.RGBA
+	ratio   float64
+	filler  *rasterx.Filler
+	stroker *rasterx.Stroker
+}
+
+// Transform places a decoded tile on the canvas: tile coordinates are scaled so the
+// tile extent spans TileSize pixels, with the tile's top-left corner at OriginX, OriginY
+type Transform struct {
+	OriginX, OriginY float64
+	TileSize         float64
+}
+
+func (t Transform) apply(p Point, extent int) (float64, float64) {
+	scale := t.TileSize / float64(extent)
+	return t.OriginX + p.X*scale, t.OriginY + p.Y*scale
+}
+
+// NewCanvas returns a transparent canvas of width x height pixels
+func NewCanvas(width, height int, pixelRatio float64) *Canvas {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	scanner := rasterx.NewScannerGV(width, height, img, img.Bounds())
+
+	return &Canvas{
+		img:     img,
+		ratio:   pixelRatio,
+		filler:  rasterx.NewFiller(width, height, scanner),
+		stroker: rasterx.NewStroker(width, height, scanner),
+	}
+}
+
+// Image returns the rendered image
+func (c *Canvas) Image() *image.RGBA {
+	return c.img
+}
+
+// DrawLayer draws every feature of the layer using the layer's legends
+func (c *Canvas) DrawLayer(layer Layer, style Style, t Transform) {
+	if layer.Extent <= 0 {
+		return
+	}
+
+	for _, feature := range layer.Features {
+		if cluster, _ := feature.Properties["cluster"].(bool); cluster {
+			c.drawCluster(feature, layer.Extent, t, style.ClusterSteps)
+			continue
+		}
+		if _, cell := feature.Properties["count"]; cell && len(style.AggregationSteps) > 0 && feature.Type == GeomPolygon {
+			c.drawAggregate(feature, layer.Extent, t, style.AggregationSteps)
+			continue
+		}
+
+		legend, ok := style.legendFor(feature)
+		if !ok {
+			continue
+		}
+
+		switch feature.Type {
+		case GeomPolygon:
+			if fill, ok := parseColor(legend.FillColor, 0.6); ok {
+				c.fillPaths(feature.Geometry, layer.Extent, t, fill)
+			}
+			if stroke, ok := parseColor(legend.StrokeColor, 1); ok {
+				c.strokePaths(feature.Geometry, layer.Extent, t, stroke, 2, true)
+			}
+		case GeomLineString:
+			stroke, ok := parseColor(legend.StrokeColor, 1)
+			if !ok {
+				stroke, ok = parseColor(legend.FillColor, 1)
+			}
+			if ok {
+				c.strokePaths(feature.Geometry, layer.Extent, t, stroke, 2, false)
+			}
+		case GeomPoint:
+			marker := LoadMarker(style.LayerID, legend)
+			for _, part := range feature.Geometry {
+				for _, p := range part {
+					x, y := t.apply(p, layer.Extent)
+					c.drawMarker(marker, legend, x, y)
+				}
+			}
+		}
+	}
+}
+
+// legendFor picks the legend matching the feature's unique value, falling back to the first legend
+func (s Style) legendFor(feature Feature) (models.MapLayerLegends, bool) {
+	if len(s.Legends) == 0 {
+		return models.MapLayerLegends{}, false
+	}
+	if s.UniqueValueField != "" {
+		if value, ok := feature.Properties[s.UniqueValueField]; ok {
+			valueText := fmt.Sprint(value)
+			for _, legend := range s.Legends {
+				if legend.UniqueValue != nil && *legend.UniqueValue == valueText {
+					return legend, true
+				}
+			}
+		}
+	}
+	return s.Legends[0], true
+}
+
+func (c *Canvas) addPaths(adder rasterx.Adder, paths [][]Point, extent int, t Transform, closed bool) {
+	for _, path := range paths {
+		if len(path) == 0 {
+			continue
+		}
+		adder.Start(rasterx.ToFixedP(t.apply(path[0], extent)))
+		for _, p := range path[1:] {
+			adder.Line(rasterx.ToFixedP(t.apply(p, extent)))
+		}
+		adder.Stop(closed)
+	}
+}
+
+func (c *Canvas) fillPaths(paths [][]Point, extent int, t Transform, clr color.Color) {
+	c.filler.Clear()
+	c.filler.SetColor(clr)
+	c.addPaths(c.filler, paths, extent, t, true)
+	c.filler.Draw()
+}
+
+// strokePaths strokes the paths with a width in CSS pixels
+func (c *Canvas) strokePaths(paths [][]Point, extent int, t Transform, clr color.Color, width float64, closed bool) {
+	c.stroker.Clear()
+	c.stroker.SetColor(clr)
+	c.stroker.SetStroke(floatToFixed(width*c.ratio), floatToFixed(4), rasterx.RoundCap, nil, rasterx.RoundGap, rasterx.Round)
+	c.addPaths(c.stroker, paths, extent, t, closed)
+	c.stroker.Draw()
+}
+
+// drawCluster draws cluster circles with the same steps as the generated style
+func (c *Canvas) drawCluster(feature Feature, extent int, t Transform, steps []models.ClusterStep) {
+	if len(steps) == 0 {
+		steps = models.DefaultClusterSteps
+	}
+	count, _ := toFloat(feature.Properties["point_count"])
+	step := models.ClusterSettings{Steps: steps}.Step(count)
+
+	fill, ok := parseColorString(step.Color, 1)
+	if !ok {
+		fill = color.RGBA{0x05, 0xa4, 0x1b, 0xff}
+	}
+	halo, ok := parseColorString(steps[0].Color, 0.4)
+	if !ok {
+		halo = color.NRGBA{0x05, 0xa4, 0x1b, 0x66}
+	}
+
+	for _, part := range feature.Geometry {
+		for _, p := range part {
+			x, y := t.apply(p, extent)
+			c.fillCircle(x, y, (step.Radius/2+5)*c.ratio, halo)
+			c.fillCircle(x, y, step.Radius/2*c.ratio, fill)
+		}
+	}
+}
+
+// drawAggregate fills a grid cell with the colour of its count, like the generated style
+func (c *Canvas) drawAggregate(feature Feature, extent int, t Transform, steps []models.AggregationStep) {
+	count, _ := toFloat(feature.Properties["count"])
+	step := models.AggregationSettings{Steps: steps}.Step(count)
+
+	if fill, ok := parseColorString(step.Color, 0.7); ok {
+		c.fillPaths(feature.Geometry, extent, t, fill)
+	}
+	c.strokePaths(feature.Geometry, extent, t, color.White, 1, true)
+}
+
+func (c *Canvas) fillCircle(x, y, r float64, clr color.Color) {
+	c.filler.Clear()
+	c.filler.SetColor(clr)
+	rasterx.AddCircle(x, y, r, c.filler)
+	c.filler.Draw()
+}
+
+// drawMarker centers the marker image on the point, or draws a dot when the legend has none
+func (c *Canvas) drawMarker(marker image.Image, legend models.MapLayerLegends, x, y float64) {
+	if marker == nil {
+		fill, ok := parseColor(legend.FillColor, 1)
+		if !ok {
+			fill = color.RGBA{0x05, 0xa4, 0x1b, 0xff}
+		}
+		c.fillCircle(x, y, 5*c.ratio, fill)
+		return
+	}
+
+	c.drawImage(marker, x, y, 1)
+}
+
+// drawImage centers a sprite image on the point. Sprite images are generated for a pixel
+// ratio of 2, so they are drawn at half size times the canvas pixel ratio.
+func (c *Canvas) drawImage(img image.Image, x, y, size float64) {
+	bounds := img.Bounds()
+	w := float64(bounds.Dx()) / 2 * c.ratio * size
+	h := float64(bounds.Dy()) / 2 * c.ratio * size
+	target := image.Rect(int(x-w/2), int(y-h/2), int(x+w/2), int(y+h/2))
+	draw.ApproxBiLinear.Scale(c.img, target, img, bounds, draw.Over, nil)
+}
+
+func floatToFixed(v float64) fixed.Int26_6 {
+	return fixed.Int26_6(v * 64)
+}
+
+// EncodePNG writes the canvas as PNG
+func (c *Canvas) EncodePNG() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, c.img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// toFloat converts a decoded tile value to a number
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// parseColor reads #rgb, #rrggbb, #rrggbbaa and rgb()/rgba() colours with an extra opacity
+func parseColor(value *string, opacity float64) (color.Color, bool) {
+	if value == nil {
+		return nil, false
+	}
+	return parseColorString(*value, opacity)
+}
+
+func parseColorString(value string, opacity float64) (color.Color, bool) {
+	s := strings.TrimSpace(strings.ToLower(value))
+
+	var r, g, b uint8
+	a := 1.0
+
+	switch {
+	case strings.HasPrefix(s, "#"):
+		hex := s[1:]
+		if len(hex) == 3 {
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		}
+		if len(hex) != 6 && len(hex) != 8 {
+			return nil, false
+		}
+		v, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil {
+			return nil, false
+		}
+		if len(hex) == 8 {
+			a = float64(v&0xff) / 255
+			v >>= 8
+		}
+		r, g, b = uint8(v>>16), uint8(v>>8), uint8(v)
+	case strings.HasPrefix(s, "rgb"):
+		start, end := strings.Index(s, "("), strings.Index(s, ")")
+		if start < 0 || end < start {
+			return nil, false
+		}
+		parts := strings.Split(s[start+1:end], ",")
+		if len(parts) < 3 {
+			return nil, false
+		}
+		var channels [3]uint8
+		for i := 0; i < 3; i++ {
+			v, err := strconv.Atoi(strings.TrimSpace(parts[i]))
+			if err != nil {
+				return nil, false
+			}
+			channels[i] = uint8(min(max(v, 0), 255))
+		}
+		r, g, b = channels[0], channels[1], channels[2]
+		if len(parts) > 3 {
+			if v, err := strconv.ParseFloat(strings.TrimSpace(parts[3]), 64); err == nil {
+				a = v
+			}
+		}
+	default:
+		return nil, false
+	}
+
+	return color.NRGBA{R: r, G: g, B: b, A: uint8(min(max(a*opacity, 0), 1) * 255)}, true
+}
+
+type cachedMarker struct {
+	modTime int64
+	img     image.Image
+}
+
+var markerCache sync.Map
+
+// SpriteImages returns a loader for the generated sprite images of a map
+func SpriteImages(mapID string) func(id string) image.Image {
+	return func(id string) image.Image {
+		return loadImage(fmt.Sprintf("./public/map/%s/sprite/images/%s.png", mapID, id))
+	}
+}
+
+// LoadMarker returns the marker image of a legend. The sprite image generated for the
+// layer is preferred; the legend's own PNG or SVG marker under ./public is the fallback.
+func LoadMarker(layerID string, legend models.MapLayerLegends) image.Image {
+	if legend.Marker == nil || *legend.Marker == "" {
+		return nil
+	}
+
+	spriteID := layerID
+	if legend.UniqueValue != nil && *legend.UniqueValue != "" {
+		spriteID = layerID + "-" + *legend.UniqueValue
+	}
+
+	candidates, _ := filepath.Glob(fmt.Sprintf("./public/map/*/sprite/images/%s.png", spriteID))
+	candidates = append(candidates, "./public"+*legend.Marker)
+
+	for _, path := range candidates {
+		if img := loadImage(path); img != nil {
+			return img
+		}
+	}
+	return nil
+}
+
+func loadImage(path string) image.Image {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	if cached, ok := markerCache.Load(path); ok && cached.(cachedMarker).modTime == info.ModTime().UnixNano() {
+		return cached.(cachedMarker).img
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var img image.Image
+	switch {
+	case strings.HasSuffix(path, ".png"):
+		img, err = png.Decode(f)
+		if err != nil {
+			return nil
+		}
+	case strings.HasSuffix(path, ".svg"):
+		icon, err := oksvg.ReadIconStream(f, oksvg.WarnErrorMode)
+		if err != nil || icon.ViewBox.W == 0 {
+			return nil
+		}
+		// Same 72px width as the generated sprite images
+		w := 72
+		h := max(int(72*icon.ViewBox.H/icon.ViewBox.W), 1)
+		icon.SetTarget(0, 0, float64(w), float64(h))
+		rgba := image.NewRGBA(image.Rect(0, 0, w, h))
+		scanner := rasterx.NewScannerGV(w, h, rgba, rgba.Bounds())
+		icon.Draw(rasterx.NewDasher(w, h, scanner), 1)
+		img = rgba
+	default:
+		return nil
+	}
+
+	markerCache.Store(path, cachedMarker{modTime: info.ModTime().UnixNano(), img: img})
+	return img
+}
@@ -0,0 +1,371 @@
+package render
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// StyleLayer is one layer of a generated MapLibre style, decoded generically so every
+// style layer type can be drawn from its paint and layout properties
+type StyleLayer struct {
+	ID          string                 `json:"id"`
+	Type        string                 `json:"type"`
+	Source      string                 `json:"source"`
+	SourceLayer string                 `json:"source-layer"`
+	MinZoom     *float64               `json:"minzoom"`
+	MaxZoom     *float64               `json:"maxzoom"`
+	Filter      interface{}            `json:"filter"`
+	Paint       map[string]interface{} `json:"paint"`
+	Layout      map[string]interface{} `json:"layout"`
+}
+
+// ParseStyleLayers converts the typed layers of a generated style into StyleLayers
+func ParseStyleLayers(layers []any) ([]StyleLayer, error) {
+	data, err := json.Marshal(layers)
+	if err != nil {
+		return nil, err
+	}
+	var result []StyleLayer
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode style layers: %w", err)
+	}
+	return result, nil
+}
+
+// DrawStyleLayer draws the features of a decoded tile layer the way the style layer
+// would in MapLibre. Text and heatmap layers are not drawn.
+func (c *Canvas) DrawStyleLayer(layer Layer, style StyleLayer, t Transform, zoom float64, sprites func(id string) image.Image) {
+	if layer.Extent <= 0 {
+		return
+	}
+	if style.MinZoom != nil && zoom < *style.MinZoom {
+		return
+	}
+	if style.MaxZoom != nil && zoom >= *style.MaxZoom {
+		return
+	}
+
+	for _, feature := range layer.Features {
+		ctx := exprContext{properties: feature.Properties, zoom: zoom, geomType: feature.Type}
+		if style.Filter != nil && !truthy(ctx.eval(style.Filter)) {
+			continue
+		}
+
+		switch style.Type {
+		case "fill":
+			if feature.Type != GeomPolygon {
+				continue
+			}
+			opacity := ctx.number(style.Paint["fill-opacity"], 1)
+			if fill, ok := ctx.color(style.Paint["fill-color"], opacity); ok {
+				c.fillPaths(feature.Geometry, layer.Extent, t, fill)
+			}
+			if outline, ok := ctx.color(style.Paint["fill-outline-color"], opacity); ok {
+				c.strokePaths(feature.Geometry, layer.Extent, t, outline, 1, true)
+			}
+		case "line":
+			if feature.Type == GeomPoint {
+				continue
+			}
+			opacity := ctx.number(style.Paint["line-opacity"], 1)
+			if stroke, ok := ctx.color(style.Paint["line-color"], opacity); ok {
+				width := ctx.number(style.Paint["line-width"], 1)
+				c.strokePaths(feature.Geometry, layer.Extent, t, stroke, width, feature.Type == GeomPolygon)
+			}
+		case "circle":
+			radius := ctx.number(style.Paint["circle-radius"], 5)
+			opacity := ctx.number(style.Paint["circle-opacity"], 1)
+			strokeWidth := ctx.number(style.Paint["circle-stroke-width"], 0)
+			strokeOpacity := ctx.number(style.Paint["circle-stroke-opacity"], 1)
+			fill, hasFill := ctx.color(style.Paint["circle-color"], opacity)
+			stroke, hasStroke := ctx.color(style.Paint["circle-stroke-color"], strokeOpacity)
+
+			c.eachAnchor(feature, layer.Extent, t, func(x, y float64) {
+				if hasStroke && strokeWidth > 0 {
+					c.fillCircle(x, y, (radius+strokeWidth)*c.ratio, stroke)
+				}
+				if hasFill {
+					c.fillCircle(x, y, radius*c.ratio, fill)
+				}
+			})
+		case "symbol":
+			if sprites == nil {
+				continue
+			}
+			iconID, _ := ctx.eval(style.Layout["icon-image"]).(string)
+			if iconID == "" {
+				continue
+			}
+			icon := sprites(iconID)
+			if icon == nil {
+				continue
+			}
+			size := ctx.number(style.Layout["icon-size"], 1)
+			c.eachAnchor(feature, layer.Extent, t, func(x, y float64) {
+				c.drawImage(icon, x, y, size)
+			})
+		}
+	}
+}
+
+// eachAnchor calls fn for every point of a point feature, or the first vertex of other features
+func (c *Canvas) eachAnchor(feature Feature, extent int, t Transform, fn func(x, y float64)) {
+	for _, part := range feature.Geometry {
+		if len(part) == 0 {
+			continue
+		}
+		points := part
+		if feature.Type != GeomPoint {
+			points = part[:1]
+		}
+		for _, p := range points {
+			x, y := t.apply(p, extent)
+			fn(x, y)
+		}
+	}
+}
+
+// exprContext evaluates the subset of MapLibre expressions used by the generated styles
+type exprContext struct {
+	properties map[string]interface{}
+	zoom       float64
+	geomType   GeomType
+}
+
+func (ctx exprContext) number(expr interface{}, fallback float64) float64 {
+	if expr == nil {
+		return fallback
+	}
+	if v, ok := toFloat(ctx.eval(expr)); ok {
+		return v
+	}
+	return fallback
+}
+
+func (ctx exprContext) color(expr interface{}, opacity float64) (color.Color, bool) {
+	if expr == nil {
+		return nil, false
+	}
+	value, ok := ctx.eval(expr).(string)
+	if !ok {
+		return nil, false
+	}
+	return parseColorString(value, opacity)
+}
+
+func (ctx exprContext) eval(expr interface{}) interface{} {
+	args, ok := expr.([]interface{})
+	if !ok || len(args) == 0 {
+		return expr
+	}
+	op, ok := args[0].(string)
+	if !ok {
+		return expr
+	}
+
+	switch op {
+	case "get":
+		if len(args) < 2 {
+			return nil
+		}
+		key, _ := ctx.eval(args[1]).(string)
+		return ctx.properties[key]
+	case "has":
+		if len(args) < 2 {
+			return false
+		}
+		key, _ := ctx.eval(args[1]).(string)
+		_, found := ctx.properties[key]
+		return found
+	case "!has":
+		if len(args) < 2 {
+			return true
+		}
+		key, _ := ctx.eval(args[1]).(string)
+		_, found := ctx.properties[key]
+		return !found
+	case "geometry-type", "$type":
+		switch ctx.geomType {
+		case GeomPoint:
+			return "Point"
+		case GeomLineString:
+			return "LineString"
+		case GeomPolygon:
+			return "Polygon"
+		}
+		return nil
+	case "zoom":
+		return ctx.zoom
+	case "feature-state":
+		// Static images have no interactive state
+		return nil
+	case "boolean":
+		for _, arg := range args[1:] {
+			if v, ok := ctx.eval(arg).(bool); ok {
+				return v
+			}
+		}
+		return false
+	case "literal":
+		if len(args) < 2 {
+			return nil
+		}
+		return args[1]
+	case "!":
+		return len(args) > 1 && !truthy(ctx.eval(args[1]))
+	case "all":
+		for _, arg := range args[1:] {
+			if !truthy(ctx.eval(arg)) {
+				return false
+			}
+		}
+		return true
+	case "any":
+		for _, arg := range args[1:] {
+			if truthy(ctx.eval(arg)) {
+				return true
+			}
+		}
+		return false
+	case "==", "!=":
+		if len(args) < 3 {
+			return false
+		}
+		equal := valuesEqual(ctx.eval(args[1]), ctx.eval(args[2]))
+		return equal == (op == "==")
+	case "<", "<=", ">", ">=":
+		if len(args) < 3 {
+			return false
+		}
+		a, okA := toFloat(ctx.eval(args[1]))
+		b, okB := toFloat(ctx.eval(args[2]))
+		if !okA || !okB {
+			return false
+		}
+		switch op {
+		case "<":
+			return a < b
+		case "<=":
+			return a <= b
+		case ">":
+			return a > b
+		}
+		return a >= b
+	case "coalesce":
+		for _, arg := range args[1:] {
+			if v := ctx.eval(arg); v != nil {
+				return v
+			}
+		}
+		return nil
+	case "case":
+		for i := 1; i+1 < len(args); i += 2 {
+			if truthy(ctx.eval(args[i])) {
+				return ctx.eval(args[i+1])
+			}
+		}
+		return ctx.eval(args[len(args)-1])
+	case "match":
+		if len(args) < 3 {
+			return nil
+		}
+		input := ctx.eval(args[1])
+		for i := 2; i+1 < len(args); i += 2 {
+			labels, isList := args[i].([]interface{})
+			if !isList {
+				labels = []interface{}{args[i]}
+			}
+			for _, label := range labels {
+				if valuesEqual(input, label) {
+					return ctx.eval(args[i+1])
+				}
+			}
+		}
+		return ctx.eval(args[len(args)-1])
+	case "step":
+		if len(args) < 3 {
+			return nil
+		}
+		input, _ := toFloat(ctx.eval(args[1]))
+		result := ctx.eval(args[2])
+		for i := 3; i+1 < len(args); i += 2 {
+			stop, _ := toFloat(args[i])
+			if input < stop {
+				break
+			}
+			result = ctx.eval(args[i+1])
+		}
+		return result
+	case "interpolate":
+		// Linear interpolation between numeric stops; colors take the nearest lower stop
+		if len(args) < 5 {
+			return nil
+		}
+		input, _ := toFloat(ctx.eval(args[2]))
+		for i := 3; i+1 < len(args); i += 2 {
+			stop, _ := toFloat(args[i])
+			if input < stop {
+				if i == 3 {
+					return ctx.eval(args[i+1])
+				}
+				prevStop, _ := toFloat(args[i-2])
+				prev, next := ctx.eval(args[i-1]), ctx.eval(args[i+1])
+				a, okA := toFloat(prev)
+				b, okB := toFloat(next)
+				if !okA || !okB || stop == prevStop {
+					return prev
+				}
+				return a + (b-a)*(input-prevStop)/(stop-prevStop)
+			}
+		}
+		return ctx.eval(args[len(args)-1])
+	case "to-string":
+		if len(args) < 2 {
+			return ""
+		}
+		return fmt.Sprint(ctx.eval(args[1]))
+	case "to-number":
+		if len(args) < 2 {
+			return 0.0
+		}
+		v, _ := toFloat(ctx.eval(args[1]))
+		return v
+	}
+	return expr
+}
+
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	}
+	if f, ok := toFloat(value); ok {
+		return f != 0 && !math.IsNaN(f)
+	}
+	return true
+}
+
+// valuesEqual compares tile values with style literals, treating all numbers alike
+func valuesEqual(a, b interface{}) bool {
+	if fa, ok := numberValue(a); ok {
+		if fb, ok := numberValue(b); ok {
+			return fa == fb
+		}
+		return false
+	}
+	return a == b
+}
+
+func numberValue(value interface{}) (float64, bool) {
+	if _, isString := value.(string); isString {
+		return 0, false
+	}
+	return toFloat(value)
+}
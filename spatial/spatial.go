@@ -28,15 +28,15 @@ func GetRelationshipFunction(relationship string) (string, error) {
 	return sqlFunction, nil
 }
 
-// Execute the spatial query and return the results
-func ExecuteSpatialQuery(query, geometry string) ([]map[string]interface{}, error) {
+// Execute the spatial query and return the results. args are bound after the geometry.
+func ExecuteSpatialQuery(query, geometry string, args ...interface{}) ([]map[string]interface{}, error) {
 	var results []map[string]interface{}
 	if geometry == "" {
-		if err := DB.DB.Raw(query).Scan(&results).Error; err != nil {
+		if err := DB.DB.Raw(query, args...).Scan(&results).Error; err != nil {
 			return nil, fmt.Errorf("error executing spatial query: %w", err)
 		}
 	} else {
-		if err := DB.DB.Raw(query, geometry).Scan(&results).Error; err != nil {
+		if err := DB.DB.Raw(query, append([]interface{}{geometry}, args...)...).Scan(&results).Error; err != nil {
 			return nil, fmt.Errorf("error executing spatial query: %w", err)
 		}
 	}
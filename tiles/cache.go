@@ -0,0 +1,378 @@
+package tiles
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/gofiber/fiber/v2"
+	"github.com/khankhulgun/khanmap/maplayer"
+	"github.com/khankhulgun/khanmap/metrics"
+	"github.com/khankhulgun/khanmap/models"
+	"golang.org/x/sync/singleflight"
+)
+
+// immutableMaxAge is the browser cache lifetime of tiles requested with their current data version
+const immutableMaxAge = 365 * 24 * 60 * 60
+
+// TileCache stores rendered live tiles keyed by tileCacheKey
+type TileCache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, data []byte, ttl time.Duration)
+}
+
+var (
+	tileCache     TileCache
+	tileCacheOnce sync.Once
+
+	// cacheGenerations is bumped per layer to drop all of its cached tiles at once
+	cacheGenerations sync.Map
+
+	// tileFlights coalesces concurrent renders of the same tile cache key
+	tileFlights singleflight.Group
+)
+
+// getTileCache builds the backend selected by TILE_CACHE on first use
+func getTileCache() TileCache {
+	tileCacheOnce.Do(func() {
+		switch Config.Cache {
+		case "memory":
+			cache, err := newMemoryTileCache(int64(Config.CacheSizeMB) << 20)
+			if err != nil {
+				log.Printf("Tile cache disabled: %v", err)
+				return
+			}
+			tileCache = cache
+		case "disk":
+			cache := &diskTileCache{dir: Config.CacheDir, maxBytes: int64(Config.CacheSizeMB) << 20}
+			go cache.sweepLoop()
+			tileCache = cache
+		case "none", "":
+		default:
+			log.Printf("Unknown TILE_CACHE backend %q, tile cache disabled", Config.Cache)
+		}
+	})
+	return tileCache
+}
+
+// memoryTileCache keeps tiles in a ristretto cache bounded by total bytes
+type memoryTileCache struct {
+	cache *ristretto.Cache
+}
+
+func newMemoryTileCache(maxBytes int64) (*memoryTileCache, error) {
+	cache, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: 1e6,
+		MaxCost:     maxBytes,
+		BufferItems: 64,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &memoryTileCache{cache: cache}, nil
+}
+
+func (m *memoryTileCache) Get(key string) ([]byte, bool) {
+	value, ok := m.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	data, ok := value.([]byte)
+	return data, ok
+}
+
+func (m *memoryTileCache) Set(key string, data []byte, ttl time.Duration) {
+	// Empty tiles still cost something so they are not cached for free
+	m.cache.SetWithTTL(key, data, int64(len(data))+64, ttl)
+}
+
+// diskCacheSweep is how often expired and excess disk cache files are removed
+const diskCacheSweep = time.Minute
+
+// diskTileCache stores one file per key; entries expire by modification time.
+// A sweep removes expired files and keeps the directory under maxBytes.
+type diskTileCache struct {
+	dir      string
+	maxBytes int64
+}
+
+func (d *diskTileCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(d.dir, name[:2], name)
+}
+
+func (d *diskTileCache) Get(key string) ([]byte, bool) {
+	path := d.path(key)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+	// The TTL is encoded as the file's modification time in the future
+	if time.Now().After(info.ModTime()) {
+		os.Remove(path)
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+func (d *diskTileCache) Set(key string, data []byte, ttl time.Duration) {
+	path := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		log.Printf("Tile cache write failed: %v", err)
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "tile-*")
+	if err != nil {
+		log.Printf("Tile cache write failed: %v", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	expires := time.Now().Add(ttl)
+	if err == nil {
+		err = os.Chtimes(tmp.Name(), expires, expires)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Tile cache write failed: %v", err)
+	}
+}
+
+func (d *diskTileCache) sweepLoop() {
+	ticker := time.NewTicker(diskCacheSweep)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.sweep()
+	}
+}
+
+// sweep removes expired tiles, then the tiles closest to expiring until the cache fits maxBytes
+func (d *diskTileCache) sweep() {
+	type cacheFile struct {
+		path    string
+		size    int64
+		expires time.Time
+	}
+
+	now := time.Now()
+	var files []cacheFile
+	var total int64
+	filepath.WalkDir(d.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		// Files being written are left alone, abandoned ones expire with the rest
+		if strings.HasPrefix(entry.Name(), "tile-") && now.Sub(info.ModTime()) < diskCacheSweep {
+			return nil
+		}
+		if !info.ModTime().After(now) {
+			os.Remove(path)
+			return nil
+		}
+		files = append(files, cacheFile{path: path, size: info.Size(), expires: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+
+	if d.maxBytes <= 0 || total <= d.maxBytes {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].expires.Before(files[j].expires) })
+	for _, file := range files {
+		if total <= d.maxBytes {
+			break
+		}
+		if os.Remove(file.path) == nil {
+			total -= file.size
+		}
+	}
+}
+
+// cacheGeneration returns the current generation counter for a layer
+func cacheGeneration(layerID string) int64 {
+	value, _ := cacheGenerations.LoadOrStore(layerID, new(atomic.Int64))
+	return value.(*atomic.Int64).Load()
+}
+
+// PurgeLayerCache drops every cached live tile of the layer
+func PurgeLayerCache(layerID string) {
+	value, _ := cacheGenerations.LoadOrStore(layerID, new(atomic.Int64))
+	value.(*atomic.Int64).Add(1)
+}
+
+// tileScope identifies whose view of the layer a tile represents. Public layers without
+// permissions render the same for everyone and share a public scope; non-public layers
+// render the same for every logged in user.
+func tileScope(layer models.MapLayersForTile, user interface{}) string {
+	if layer.IsPermission {
+		userMap, _ := user.(map[string]interface{})
+		return fmt.Sprintf("role:%v|user:%v", userMap["role"], userMap["id"])
+	}
+	if !layer.IsPublic {
+		return "users"
+	}
+	return "public"
+}
+
+// tileCacheKey normalizes the tile request into a stable cache key. A composite tile lists
+// all of its layers so that a change to any one of them misses the cache. version is the
+// tracked data version the tile is rendered under, so a new version never finds tiles
+// rendered before it and cached tiles may be sent as immutable under their version.
+func tileCacheKey(layerIDs []string, version string, z, x, y int, filters map[string]string, areaFilters map[string]string, scope string) string {
+	params := make([]string, 0, len(filters)+len(areaFilters))
+	for key, value := range filters {
+		if value != "" {
+			params = append(params, key+"="+value)
+		}
+	}
+	for key, value := range areaFilters {
+		if value != "" {
+			params = append(params, key+"="+value)
+		}
+	}
+	sort.Strings(params)
+
+	layers := make([]string, len(layerIDs))
+	for i, layerID := range layerIDs {
+		layers[i] = fmt.Sprintf("%s@%d", layerID, cacheGeneration(layerID))
+	}
+
+	return fmt.Sprintf("%s|v%s|%d/%d/%d|%s|%s", strings.Join(layers, ","), version, z, x, y, strings.Join(params, "&"), scope)
+}
+
+// tileETag returns a strong validator for the tile bytes
+func tileETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// cacheMaxAge returns the browser cache lifetime of the layer's tiles in seconds
+func cacheMaxAge(layer models.MapLayersForTile) int {
+	if layer.CacheMaxAge != nil && *layer.CacheMaxAge >= 0 {
+		return *layer.CacheMaxAge
+	}
+	return Config.CacheMaxAge
+}
+
+// layerTileVersion returns the data version the layer's tiles are cached as immutable under,
+// or "" while changes to the layer table are not tracked and its URLs may serve new data
+func layerTileVersion(layer models.MapLayersForTile) string {
+	if !maplayer.VersionTracked(layer) {
+		return ""
+	}
+	return maplayer.DataVersion(layer)
+}
+
+// mapTileVersion returns the data version a map's composite tiles are cached as immutable under,
+// or "" unless changes to every layer table are tracked
+func mapTileVersion(layers []models.MapLayersForTile) string {
+	if !maplayer.MapVersionTracked(layers) {
+		return ""
+	}
+	return maplayer.MapDataVersion(layers)
+}
+
+// sendTile writes a vector tile with caching headers, answering conditional requests with 304.
+// version is the tracked data version the tile was rendered and cached under. A tile requested
+// with that version never changes under its URL and is cached as immutable; other versions get
+// the layer's usual max age.
+func sendTile(c *fiber.Ctx, data []byte, maxAge int, public bool, version string) error {
+	immutable := version != "" && c.Query(maplayer.VersionParam) == version
+	if immutable {
+		maxAge = immutableMaxAge
+	}
+	return sendCached(c, data, "application/vnd.mapbox-vector-tile", maxAge, public, immutable)
+}
+
+// sendCached writes a response body with ETag and Cache-Control headers
+func sendCached(c *fiber.Ctx, data []byte, contentType string, maxAge int, public bool, immutable bool) error {
+	etag := tileETag(data)
+
+	visibility := "private"
+	if public {
+		visibility = "public"
+	}
+	cacheControl := fmt.Sprintf("%s, max-age=%d", visibility, maxAge)
+	if immutable {
+		cacheControl += ", immutable"
+	}
+	c.Set("Cache-Control", cacheControl)
+	c.Set("ETag", etag)
+
+	if match := c.Get("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return c.SendStatus(fiber.StatusNotModified)
+			}
+		}
+	}
+
+	c.Set("Content-Type", contentType)
+	return c.Send(data)
+}
+
+// cachedTile returns the tile from the cache or renders and stores it. Concurrent requests for
+// the same key share one render, which runs with the context of the request that started it.
+func cachedTile(ctx context.Context, key string, render func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	cache := getTileCache()
+	if cache != nil {
+		if data, ok := cache.Get(key); ok {
+			return data, nil
+		}
+	}
+
+	for {
+		result := tileFlights.DoChan(key, func() (interface{}, error) {
+			data, err := render(ctx)
+			if err == nil && cache != nil {
+				cache.Set(key, data, time.Duration(Config.CacheTTL)*time.Second)
+			}
+			return data, err
+		})
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case res := <-result:
+			if res.Shared {
+				metrics.CoalescedTiles.Inc()
+			}
+			// The request that started the render went away, render again for this one
+			if res.Err != nil && errors.Is(res.Err, context.Canceled) && ctx.Err() == nil {
+				continue
+			}
+			if res.Err != nil {
+				return nil, res.Err
+			}
+			return res.Val.([]byte), nil
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package tiles
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/khankhulgun/khanmap/models"
+)
+
+// mapTileCache is a TileCache that stores tiles right away, unlike ristretto's buffered writes
+type mapTileCache struct {
+	mu    sync.Mutex
+	tiles map[string][]byte
+}
+
+func (m *mapTileCache) Get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.tiles[key]
+	return data, ok
+}
+
+func (m *mapTileCache) Set(key string, data []byte, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tiles[key] = data
+}
+
+// useTileCache makes cache the live tile cache for the rest of the test
+func useTileCache(t *testing.T, cache TileCache) {
+	getTileCache()
+	previous := tileCache
+	tileCache = cache
+	t.Cleanup(func() { tileCache = previous })
+}
+
+func TestTileCacheKey(t *testing.T) {
+	key := tileCacheKey([]string{"cache-key-1"}, "", 3, 4, 5, map[string]string{"b": "2", "a": "1"}, map[string]string{"districtID": "7"}, "public")
+
+	tests := []struct {
+		name string
+		key  string
+		same bool
+	}{
+		{"same params in another order", tileCacheKey([]string{"cache-key-1"}, "", 3, 4, 5, map[string]string{"a": "1", "b": "2"}, map[string]string{"districtID": "7"}, "public"), true},
+		{"empty params dropped", tileCacheKey([]string{"cache-key-1"}, "", 3, 4, 5, map[string]string{"a": "1", "b": "2", "c": ""}, map[string]string{"districtID": "7", "regionID": ""}, "public"), true},
+		{"other param value", tileCacheKey([]string{"cache-key-1"}, "", 3, 4, 5, map[string]string{"a": "1", "b": "3"}, map[string]string{"districtID": "7"}, "public"), false},
+		{"missing area filter", tileCacheKey([]string{"cache-key-1"}, "", 3, 4, 5, map[string]string{"a": "1", "b": "2"}, nil, "public"), false},
+		{"other tile", tileCacheKey([]string{"cache-key-1"}, "", 3, 5, 4, map[string]string{"a": "1", "b": "2"}, map[string]string{"districtID": "7"}, "public"), false},
+		{"other layer", tileCacheKey([]string{"cache-key-2"}, "", 3, 4, 5, map[string]string{"a": "1", "b": "2"}, map[string]string{"districtID": "7"}, "public"), false},
+		{"other version", tileCacheKey([]string{"cache-key-1"}, "12", 3, 4, 5, map[string]string{"a": "1", "b": "2"}, map[string]string{"districtID": "7"}, "public"), false},
+		{"other scope", tileCacheKey([]string{"cache-key-1"}, "", 3, 4, 5, map[string]string{"a": "1", "b": "2"}, map[string]string{"districtID": "7"}, "users"), false},
+	}
+	for _, tt := range tests {
+		if same := tt.key == key; same != tt.same {
+			t.Errorf("%s: key %q against %q, same = %v, want %v", tt.name, tt.key, key, same, tt.same)
+		}
+	}
+
+	PurgeLayerCache("cache-key-1")
+	if purged := tileCacheKey([]string{"cache-key-1"}, "", 3, 4, 5, map[string]string{"a": "1", "b": "2"}, map[string]string{"districtID": "7"}, "public"); purged == key {
+		t.Errorf("key %q is unchanged after PurgeLayerCache", purged)
+	}
+}
+
+func TestTileScope(t *testing.T) {
+	user := map[string]interface{}{"role": 3.0, "id": int64(42)}
+	tests := []struct {
+		name  string
+		layer models.MapLayersForTile
+		user  interface{}
+		want  string
+	}{
+		{"public", models.MapLayersForTile{IsPublic: true}, nil, "public"},
+		{"public with a user", models.MapLayersForTile{IsPublic: true}, user, "public"},
+		{"private", models.MapLayersForTile{}, user, "users"},
+		{"permission", models.MapLayersForTile{IsPublic: true, IsPermission: true}, user, "role:3|user:42"},
+		{"permission without a user", models.MapLayersForTile{IsPermission: true}, nil, "role:<nil>|user:<nil>"},
+	}
+	for _, tt := range tests {
+		if got := tileScope(tt.layer, tt.user); got != tt.want {
+			t.Errorf("%s: tileScope = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSendTile(t *testing.T) {
+	data := []byte("tile")
+	etag := tileETag(data)
+
+	tests := []struct {
+		name         string
+		public       bool
+		version      string
+		query        string
+		ifNoneMatch  string
+		status       int
+		cacheControl string
+	}{
+		{"public", true, "", "", "", http.StatusOK, "public, max-age=60"},
+		{"private", false, "", "", "", http.StatusOK, "private, max-age=60"},
+		{"current version", true, "12", "?v=12", "", http.StatusOK, "public, max-age=31536000, immutable"},
+		{"old version", true, "12", "?v=11", "", http.StatusOK, "public, max-age=60"},
+		{"untracked version", true, "", "?v=12", "", http.StatusOK, "public, max-age=60"},
+		{"matching etag", true, "", "", etag, http.StatusNotModified, "public, max-age=60"},
+		{"weak etag in a list", false, "", "", `"other", W/` + etag, http.StatusNotModified, "private, max-age=60"},
+		{"any etag", true, "", "", "*", http.StatusNotModified, "public, max-age=60"},
+		{"other etag", true, "", "", `"other"`, http.StatusOK, "public, max-age=60"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Get("/", func(c *fiber.Ctx) error {
+				return sendTile(c, data, 60, tt.public, tt.version)
+			})
+
+			req := httptest.NewRequest("GET", "/"+tt.query, nil)
+			if tt.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get("Cache-Control"); got != tt.cacheControl {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.cacheControl)
+			}
+			if got := resp.Header.Get("ETag"); got != etag {
+				t.Errorf("ETag = %q, want %q", got, etag)
+			}
+		})
+	}
+}
+
+func TestCachedTile(t *testing.T) {
+	cache := &mapTileCache{tiles: make(map[string][]byte)}
+	useTileCache(t, cache)
+
+	var renders atomic.Int32
+	render := func(ctx context.Context) ([]byte, error) {
+		renders.Add(1)
+		return []byte("tile"), nil
+	}
+	for i := 0; i < 2; i++ {
+		data, err := cachedTile(context.Background(), "cached-tile", render)
+		if err != nil || string(data) != "tile" {
+			t.Fatalf("cachedTile = %q, %v, want %q", data, err, "tile")
+		}
+	}
+	if got := renders.Load(); got != 1 {
+		t.Errorf("tile rendered %d times, want once", got)
+	}
+
+	failed := errors.New("render failed")
+	if _, err := cachedTile(context.Background(), "failed-tile", func(ctx context.Context) ([]byte, error) {
+		return nil, failed
+	}); !errors.Is(err, failed) {
+		t.Errorf("cachedTile = %v, want %v", err, failed)
+	}
+	if _, ok := cache.Get("failed-tile"); ok {
+		t.Error("a failed render was cached")
+	}
+}
+
+func TestCachedTileStarterCancelled(t *testing.T) {
+	useTileCache(t, nil)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var renders atomic.Int32
+	render := func(ctx context.Context) ([]byte, error) {
+		if renders.Add(1) == 1 {
+			close(started)
+			<-release
+			return nil, ctx.Err()
+		}
+		return []byte("tile"), nil
+	}
+
+	starterCtx, cancel := context.WithCancel(context.Background())
+	starterErr := make(chan error, 1)
+	go func() {
+		_, err := cachedTile(starterCtx, "cancelled-tile", render)
+		starterErr <- err
+	}()
+	<-started
+
+	// The second request joins the render, then its starter goes away
+	type result struct {
+		data []byte
+		err  error
+	}
+	joined := make(chan result, 1)
+	go func() {
+		data, err := cachedTile(context.Background(), "cancelled-tile", render)
+		joined <- result{data, err}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	if err := <-starterErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("starter cachedTile = %v, want %v", err, context.Canceled)
+	}
+	close(release)
+
+	res := <-joined
+	if res.err != nil || string(res.data) != "tile" {
+		t.Errorf("joined cachedTile = %q, %v, want %q", res.data, res.err, "tile")
+	}
+	if got := renders.Load(); got != 2 {
+		t.Errorf("tile rendered %d times, want 2", got)
+	}
+}
@@ -0,0 +1,186 @@
+package tiles
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/khankhulgun/khanmap/maplayer"
+	"github.com/khankhulgun/khanmap/models"
+	"github.com/lambda-platform/lambda/DB"
+	agentUtils "github.com/lambda-platform/lambda/agent/utils"
+)
+
+const maxClusterPageSize = 500
+
+// ClusterInfo describes one cluster of a clustered tile
+type ClusterInfo struct {
+	PointCount    int               `json:"point_count"`
+	ExpansionZoom int               `json:"expansion_zoom"`
+	BBox          []float64         `json:"bbox"`
+	Page          int               `json:"page"`
+	Limit         int               `json:"limit"`
+	Features      []json.RawMessage `json:"features"`
+}
+
+// ClusterHandler finds the cluster of tile z/x/y nearest to lon/lat and returns its expansion zoom,
+// the lon/lat bbox of its members and one page of member features.
+// Query params: z, x, y, lon, lat, page (from 1), limit; any other params are tile filters.
+func ClusterHandler(c *fiber.Ctx) error {
+	return clusterHandler(c, nil)
+}
+
+// ClusterHandlerWithPermission looks up a cluster of a layer's tile for the logged in user
+func ClusterHandlerWithPermission(c *fiber.Ctx) error {
+	user, err := agentUtils.AuthUserObject(c)
+	if err != nil {
+		log.Printf("User not found: %v", err)
+		return c.Status(fiber.StatusUnauthorized).SendString("User not found")
+	}
+	return clusterHandler(c, user)
+}
+
+func clusterHandler(c *fiber.Ctx, user interface{}) error {
+	layerDetails, err := maplayer.FetchLayerDetails(c.Params("layer"))
+	if err != nil {
+		log.Printf("Layer not found: %v", err)
+		return c.Status(fiber.StatusNotFound).SendString("Layer not found")
+	}
+	if err := maplayer.CheckLayerAccess(layerDetails, user); err != nil {
+		return c.Status(maplayer.AccessStatus(err)).SendString(err.Error())
+	}
+
+	z, x, y := c.QueryInt("z", -1), c.QueryInt("x", -1), c.QueryInt("y", -1)
+	if z < 0 || x < 0 || y < 0 || x >= 1<<z || y >= 1<<z {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid tile parameters")
+	}
+	lon, lat := c.QueryFloat("lon", 999), c.QueryFloat("lat", 999)
+	if lon < -180 || lon > 180 || lat < -90 || lat > 90 {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid cluster position")
+	}
+
+	page := max(c.QueryInt("page", 1), 1)
+	limit := min(max(c.QueryInt("limit", 50), 1), maxClusterPageSize)
+
+	cluster := clusterSettings(layerDetails)
+	if !cluster.Clusters(layerDetails.GeometryType, z) {
+		return c.Status(fiber.StatusBadRequest).SendString("Layer is not clustered at this zoom")
+	}
+
+	filters, areaFilters := maplayer.SplitFilters(c.Queries(), "z", "x", "y", "lon", "lat", "page", "limit")
+	info, err := findCluster(layerDetails, cluster, z, x, y, lon, lat, page, limit, user, filters, areaFilters)
+	if errors.Is(err, maplayer.ErrInvalidTime) {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	if err != nil {
+		log.Printf("Cluster lookup error: %v", err)
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
+	if info == nil {
+		return c.Status(fiber.StatusNotFound).SendString("Cluster not found")
+	}
+
+	return c.JSON(info)
+}
+
+// findCluster recomputes the tile's DBSCAN clusters exactly like buildTileQuery and
+// describes the one nearest to lon/lat, or returns nil when the tile has no clusters
+func findCluster(layer models.MapLayersForTile, cluster models.ClusterSettings, z, x, y int, lon, lat float64, page, limit int, user interface{}, adminFilters map[string]string, areaFilters map[string]string) (*ClusterInfo, error) {
+	filterConditions, filterValues, err := layerConditions(layer, user, adminFilters, areaFilters)
+	if err != nil {
+		return nil, err
+	}
+
+	srid := maplayer.LayerSRID(layer.DbSchema, layer.DbTable, layer.GeometryFieldName)
+	mercatorGeom := maplayer.TransformSQL(layer.GeometryFieldName, srid, 3857)
+	selectEnvelope := maplayer.TransformSQL("ST_TileEnvelope(?, ?, ?, margin => ?)", 3857, srid)
+	const bufferRatio = float64(tileExtent) / float64(tileSize)
+
+	// The expansion zoom is the first zoom at which DBSCAN no longer keeps every member in one cluster
+	query := fmt.Sprintf(`
+		WITH points AS (
+			SELECT
+				*,
+				`+mercatorGeom+` AS cluster_geom,
+				ST_ClusterDBSCAN(`+mercatorGeom+`, eps := ?, minpoints := ?) OVER () AS cluster_id
+			FROM `+layer.DbSchema+`.`+layer.DbTable+`
+			WHERE `+layer.GeometryFieldName+` && `+selectEnvelope+` %s
+		), target AS (
+			SELECT cluster_id
+			FROM points
+			WHERE cluster_id IS NOT NULL
+			GROUP BY cluster_id
+			ORDER BY ST_Centroid(ST_Collect(cluster_geom)) <-> ST_Transform(ST_SetSRID(ST_MakePoint(?, ?), 4326), 3857)
+			LIMIT 1
+		), members AS MATERIALIZED (
+			SELECT * FROM points WHERE cluster_id = (SELECT cluster_id FROM target)
+		)
+		SELECT
+			(SELECT count(*) FROM members)::int AS point_count,
+			ST_XMin(extent.geom), ST_YMin(extent.geom), ST_XMax(extent.geom), ST_YMax(extent.geom),
+			(
+				SELECT COALESCE(min(zoom), ?)
+				FROM generate_series(?::int, ?::int) AS zoom
+				WHERE (
+					SELECT count(DISTINCT cid) <> 1 OR bool_or(cid IS NULL)
+					FROM (
+						SELECT ST_ClusterDBSCAN(cluster_geom, eps := ?::float8 * 156543.03 / 2 ^ zoom, minpoints := ?) OVER () AS cid
+						FROM members
+					) split
+				)
+			) AS expansion_zoom,
+			(
+				SELECT COALESCE(json_agg(f), '[]')::text
+				FROM (
+					SELECT `+maplayer.ConstructSQLColumns(layer, true)+`, ST_AsGeoJSON(ST_Transform(cluster_geom, 4326))::json AS geometry
+					FROM members
+					ORDER BY "`+layer.IDFieldName+`"
+					LIMIT ? OFFSET ?
+				) f
+			) AS features
+		FROM (
+			SELECT ST_Transform(ST_SetSRID(ST_Extent(cluster_geom)::geometry, 3857), 4326) AS geom FROM members
+		) extent
+	`, strings.Join(filterConditions, " "))
+
+	args := []interface{}{
+		mercatorUnits(z, cluster.Radius), cluster.MinPoints,
+		z, x, y, bufferRatio,
+	}
+	args = append(args, filterValues...)
+	args = append(args,
+		lon, lat,
+		cluster.MaxZoom+1, z+1, cluster.MaxZoom, cluster.Radius, cluster.MinPoints,
+		limit, (page-1)*limit,
+	)
+
+	var (
+		pointCount             int
+		minX, minY, maxX, maxY sql.NullFloat64
+		expansionZoom          int
+		features               string
+	)
+	err = DB.DB.Raw(query, args...).Row().Scan(&pointCount, &minX, &minY, &maxX, &maxY, &expansionZoom, &features)
+	if err != nil {
+		return nil, err
+	}
+	if pointCount == 0 {
+		return nil, nil
+	}
+
+	info := &ClusterInfo{
+		PointCount:    pointCount,
+		ExpansionZoom: expansionZoom,
+		BBox:          []float64{minX.Float64, minY.Float64, maxX.Float64, maxY.Float64},
+		Page:          page,
+		Limit:         limit,
+	}
+	if err := json.Unmarshal([]byte(features), &info.Features); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
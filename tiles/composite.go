@@ -0,0 +1,165 @@
+package tiles
+
+import (
+	"context"
+	"errors"
+	"log"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/khankhulgun/khanmap/maplayer"
+	"github.com/khankhulgun/khanmap/metrics"
+	"github.com/khankhulgun/khanmap/models"
+	agentUtils "github.com/lambda-platform/lambda/agent/utils"
+)
+
+// getMapTile renders every given layer into one multi-layer tile with a single query.
+// Each layer is named by its ID inside the tile. Layers the user may not see are left out,
+// so are layers below their min zoom. Layers above their max zoom are rendered at the max
+// zoom and cut down to the tile afterwards. Layers with a tile size budget are rendered on
+// their own and fitted into their budget, the budget bounds each layer's part of the tile.
+func getMapTile(ctx context.Context, z, x, y int, layers []models.MapLayersForTile, user interface{}, adminFilters map[string]string, areaFilters map[string]string) ([]byte, error) {
+	var parts []string
+	var args []interface{}
+	// The combined query gets the longest timeout of its layers, none if one of them has none
+	timeout, unlimited := 0, false
+	overzoomed := make(map[string]int)
+	var budgeted []byte
+
+	for _, layer := range layers {
+		zoom := layer.Zoom.Settings()
+		if z < zoom.MinZoom {
+			continue
+		}
+		lz, lx, ly := z, x, y
+		if zoom.Overzoomed(z) {
+			dz := z - zoom.MaxZoom
+			lz, lx, ly = zoom.MaxZoom, x>>dz, y>>dz
+			maps.Copy(overzoomed, tileLayerZooms(layer.ID, zoom.MaxZoom))
+		}
+
+		layerFilters := maplayer.FiltersForTable(adminFilters, layer.DbSchema, layer.DbTable)
+		if layer.Budget.Settings().MaxBytes > 0 && reducible(layer, lz) {
+			data, err := budgetedTile(ctx, lz, lx, ly, layer, user, layerFilters, areaFilters, layer.ID)
+			if err != nil {
+				return nil, err
+			}
+			budgeted = append(budgeted, data...)
+			continue
+		}
+
+		query, layerArgs, err := buildTileQuery(lz, lx, ly, layer, user, layerFilters, areaFilters, layer.ID)
+		if errors.Is(err, maplayer.ErrInvalidTime) {
+			return nil, err
+		}
+		if err != nil {
+			// Denials are counted by layerConditions, anything else is a failed query build
+			log.Printf("Layer %s left out of map tile %d/%d/%d: %v", layer.ID, z, x, y, err)
+			if !errors.Is(err, maplayer.ErrLayerForbidden) {
+				metrics.DBErrors.WithLabelValues("tile").Inc()
+			}
+			continue
+		}
+		parts = append(parts, "COALESCE(("+query+"), ''::bytea)")
+		args = append(args, layerArgs...)
+		layerTimeout := statementTimeout(layer)
+		unlimited = unlimited || layerTimeout == 0
+		timeout = max(timeout, layerTimeout)
+	}
+
+	mvtData := budgeted
+	if len(parts) > 0 {
+		if unlimited {
+			timeout = 0
+		}
+		data, err := fetchTileData(ctx, timeout, "SELECT "+strings.Join(parts, " || "), args...)
+		if err != nil {
+			return nil, err
+		}
+		mvtData = append(mvtData, data...)
+	}
+
+	if mvtData == nil {
+		return []byte{}, nil
+	}
+	if len(overzoomed) == 0 {
+		return mvtData, nil
+	}
+	return overzoomTile(mvtData, z, x, y, overzoomed)
+}
+
+// mapTileHandler serves the composite tile of a map for the given user
+func mapTileHandler(c *fiber.Ctx, user interface{}) error {
+	z, x, y, err := parseTileParams(c)
+	if err != nil {
+		log.Printf("Invalid tile parameters: %v", err)
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid tile parameters")
+	}
+
+	mapID := c.Params("mapId")
+	layerIDs, err := maplayer.FetchMapLayerIDs(mapID)
+	if err != nil {
+		log.Printf("Map not found: %v", err)
+		return c.Status(fiber.StatusNotFound).SendString("Map not found")
+	}
+
+	// mapLayers are all layers of the map, layers the ones the user may see
+	var mapLayers, layers []models.MapLayersForTile
+	for _, layerID := range layerIDs {
+		layer, err := maplayer.FetchLayerDetails(layerID)
+		if err != nil {
+			log.Printf("Layer not found: %v", err)
+			continue
+		}
+		mapLayers = append(mapLayers, layer)
+		if maplayer.CheckLayerAccess(layer, user) == nil {
+			layers = append(layers, layer)
+		}
+	}
+
+	filters, areaFilters := maplayer.SplitFilters(c.Queries())
+
+	// The tile is public only when none of its layers depends on the user.
+	// A permission layer narrows the scope to the user, a non-public layer to logged in users.
+	scope := "public"
+	maxAge := Config.CacheMaxAge
+	for i, layer := range layers {
+		if layerScope := tileScope(layer, user); layer.IsPermission || layerScope != "public" && scope == "public" {
+			scope = layerScope
+		}
+		if layerMaxAge := cacheMaxAge(layer); i == 0 || layerMaxAge < maxAge {
+			maxAge = layerMaxAge
+		}
+	}
+
+	start := time.Now()
+	version := mapTileVersion(mapLayers)
+	key := tileCacheKey(layerIDs, version, z, x, y, filters, areaFilters, scope)
+	mvtData, err := cachedTile(c.UserContext(), key, func(ctx context.Context) ([]byte, error) {
+		return getMapTile(ctx, z, x, y, layers, user, filters, areaFilters)
+	})
+	if err != nil {
+		return sendTileError(c, "map "+mapID, metrics.MapTileTimeouts.WithLabelValues(mapID), err, true)
+	}
+	observeMapTile(mapID, z, start, mvtData)
+
+	return sendTile(c, mvtData, maxAge, scope == "public", version)
+}
+
+// MapTileHandler serves all public layers of a map as one tile
+func MapTileHandler(c *fiber.Ctx) error {
+	return mapTileHandler(c, nil)
+}
+
+// MapTileHandlerWithPermission serves all layers of a map the logged in user may see as one tile
+func MapTileHandlerWithPermission(c *fiber.Ctx) error {
+	user, err := agentUtils.AuthUserObject(c)
+	if err != nil {
+		log.Printf("User not found: %v", err)
+		return c.Status(fiber.StatusUnauthorized).SendString("User not found")
+	}
+
+	return mapTileHandler(c, user)
+}
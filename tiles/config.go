@@ -0,0 +1,60 @@
+package tiles
+
+import (
+	"log"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+// tileConfig holds tile server settings read from TILE_* environment variables
+type tileConfig struct {
+	SeedWorkers    int    `envconfig:"SEED_WORKERS" default:"4"`
+	SeedMaxWorkers int    `envconfig:"SEED_MAX_WORKERS" default:"16"` // upper bound of a job's workers param
+	Attribution    string `envconfig:"ATTRIBUTION" default:""`
+
+	// TrustedHosts are the hosts, with their port if any, that tile URLs may be built from when
+	// no domain is configured. Requests for any other host get URLs on the default local address.
+	TrustedHosts []string `envconfig:"TRUSTED_HOSTS" default:""`
+
+	// DataVersions installs the data version trigger on layer tables, so tile URLs change with the
+	// data and their tiles are cached as immutable. Invalidation installs it along with its own.
+	DataVersions bool `envconfig:"DATA_VERSIONS" default:"false"`
+
+	// Invalidation installs change triggers on layer tables and refreshes saved tiles
+	Invalidation           bool `envconfig:"INVALIDATION" default:"false"`
+	InvalidationPoll       int  `envconfig:"INVALIDATION_POLL" default:"30"`
+	InvalidationRegenerate bool `envconfig:"INVALIDATION_REGENERATE" default:"false"`
+
+	// Cache selects the live tile cache backend: memory, disk or none.
+	// CacheSizeMB bounds the memory cache and the files of the disk cache.
+	Cache       string `envconfig:"CACHE" default:"memory"`
+	CacheSizeMB int    `envconfig:"CACHE_SIZE_MB" default:"256"`
+	CacheDir    string `envconfig:"CACHE_DIR" default:"./tile-cache"`
+	CacheTTL    int    `envconfig:"CACHE_TTL" default:"300"`
+	CacheMaxAge int    `envconfig:"CACHE_MAX_AGE" default:"60"`
+
+	// StatementTimeout limits tile queries in milliseconds, 0 disables it; layers may override it.
+	// Timed out vector tiles are answered with a 503, or an uncached empty tile with TimeoutResponse "empty".
+	StatementTimeout int    `envconfig:"STATEMENT_TIMEOUT" default:"10000"`
+	TimeoutResponse  string `envconfig:"TIMEOUT_RESPONSE" default:"503"`
+
+	// Store selects where seeded tiles are kept: fs (files under StoreDir), mbtiles or s3.
+	// Instances sharing seeded tiles should use s3.
+	Store       string `envconfig:"STORE" default:"fs"`
+	StoreDir    string `envconfig:"STORE_DIR" default:"./public/saved-tiles"`
+	S3Endpoint  string `envconfig:"S3_ENDPOINT" default:""`
+	S3Bucket    string `envconfig:"S3_BUCKET" default:""`
+	S3Prefix    string `envconfig:"S3_PREFIX" default:"saved-tiles"`
+	S3Region    string `envconfig:"S3_REGION" default:""`
+	S3AccessKey string `envconfig:"S3_ACCESS_KEY" default:""`
+	S3SecretKey string `envconfig:"S3_SECRET_KEY" default:""`
+	S3UseSSL    bool   `envconfig:"S3_USE_SSL" default:"false"`
+}
+
+var Config tileConfig
+
+func init() {
+	if err := envconfig.Process("tile", &Config); err != nil {
+		log.Fatal(err.Error())
+	}
+}
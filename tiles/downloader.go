@@ -5,23 +5,21 @@ import (
 	"github.com/khankhulgun/khanmap/models"
 	"github.com/lambda-platform/lambda/DB"
 	"math"
-	"os"
-	"path/filepath"
 )
 
 // Constants for download directory and zoom levels
 const (
-	downloadDir = "./public/saved-tiles" // Directory to save tiles
+	downloadDir = "./public/saved-tiles" // Directory of the MBTiles and PMTiles exports
 	minZoom     = 0                      // Minimum zoom level
 	maxZoom     = 18                     // Maximum zoom level
 )
 
 // BoundingBox represents the spatial extent for a layer
 type BoundingBox struct {
-	MinLat float64 `gorm:"column:min_lat"`
-	MaxLat float64 `gorm:"column:max_lat"`
-	MinLon float64 `gorm:"column:min_lon"`
-	MaxLon float64 `gorm:"column:max_lon"`
+	MinLat float64 `gorm:"column:min_lat" json:"min_lat"`
+	MaxLat float64 `gorm:"column:max_lat" json:"max_lat"`
+	MinLon float64 `gorm:"column:min_lon" json:"min_lon"`
+	MaxLon float64 `gorm:"column:max_lon" json:"max_lon"`
 }
 
 // GetBoundingBox fetches the bounding box from the database for a given layerID using GORM
@@ -31,15 +29,15 @@ func GetBoundingBox(layer models.MapLayersForTile) (*BoundingBox, error) {
 	// Construct the query to get the bounding box for the entire layer as a single result
 	query := fmt.Sprintf(`
 		SELECT 
-			ST_YMin(ST_Extent(%s)) as min_lat, 
-			ST_YMax(ST_Extent(%s)) as max_lat, 
-			ST_XMin(ST_Extent(%s)) as min_lon, 
-			ST_XMax(ST_Extent(%s)) as max_lon 
-		FROM %s.%s`,
-		layer.GeometryFieldName,
-		layer.GeometryFieldName,
-		layer.GeometryFieldName,
-		layer.GeometryFieldName,
+			ST_YMin(ext) as min_lat, 
+			ST_YMax(ext) as max_lat, 
+			ST_XMin(ext) as min_lon, 
+			ST_XMax(ext) as max_lon 
+		FROM (
+			SELECT %s as ext
+			FROM %s.%s
+		) as t`,
+		lonLatExtentSQL(layer),
 		layer.DbSchema,
 		layer.DbTable)
 
@@ -89,70 +87,57 @@ func ensureValidTileRange(minTileX, maxTileX, minTileY, maxTileY *int) {
 	}
 }
 
-// CreateTiles downloads all tiles for a given layerID and zoom levels
+// tileRange returns the tile columns and rows covering the bounding box at a zoom level
+func tileRange(bbox *BoundingBox, zoom int) (minTileX, maxTileX, minTileY, maxTileY int) {
+	// Get tile ranges for the bounding box
+	minTileX, minTileY = latLonToTileXY(bbox.MinLat, bbox.MinLon, zoom)
+	maxTileX, maxTileY = latLonToTileXY(bbox.MaxLat, bbox.MaxLon, zoom)
+
+	// Ensure the tile ranges are valid (swap if needed)
+	ensureValidTileRange(&minTileX, &maxTileX, &minTileY, &maxTileY)
+
+	// Keep the easternmost edge (lon = 180) inside the grid
+	if last := (1 << zoom) - 1; maxTileX > last {
+		maxTileX = last
+	}
+	if last := (1 << zoom) - 1; maxTileY > last {
+		maxTileY = last
+	}
+	return
+}
+
+// countTiles returns how many tiles cover the bounding box between the given zoom levels
+func countTiles(bbox *BoundingBox, fromZoom, toZoom int) int64 {
+	var total int64
+	for zoom := fromZoom; zoom <= toZoom; zoom++ {
+		minTileX, maxTileX, minTileY, maxTileY := tileRange(bbox, zoom)
+		total += int64(maxTileX-minTileX+1) * int64(maxTileY-minTileY+1)
+	}
+	return total
+}
+
+// CreateTiles seeds every tile of the layer into the configured tile store
 func CreateTiles(layer models.MapLayersForTile) error {
-	// Fetch the bounding box from the database
-	bbox, err := GetBoundingBox(layer)
+	return createTilesAs(layer, "files")
+}
+
+// CreateMBTiles seeds every tile of the layer into a single MBTiles file under downloadDir
+func CreateMBTiles(layer models.MapLayersForTile) error {
+	return createTilesAs(layer, "mbtiles")
+}
+
+// createTilesAs runs a seeding job over the full layer extent and waits for it to finish
+func createTilesAs(layer models.MapLayersForTile, format string) error {
+	job, err := StartSeedJob(layer, SeedOptions{Format: format, MinZoom: minZoom, MaxZoom: maxZoom})
 	if err != nil {
 		return err
 	}
+	return job.Wait()
+}
 
-	// Log the bounding box for debugging
-	fmt.Printf("Bounding Box: MinLat: %f, MaxLat: %f, MinLon: %f, MaxLon: %f\n", bbox.MinLat, bbox.MaxLat, bbox.MinLon, bbox.MaxLon)
-
-	// Loop through each zoom level
-	for zoom := minZoom; zoom <= maxZoom; zoom++ {
-		fmt.Println("Processing zoom level:", zoom)
-
-		// Get tile ranges for the bounding box
-		minTileX, minTileY := latLonToTileXY(bbox.MinLat, bbox.MinLon, zoom)
-		maxTileX, maxTileY := latLonToTileXY(bbox.MaxLat, bbox.MaxLon, zoom)
-
-		// Ensure the tile ranges are valid (swap if needed)
-		ensureValidTileRange(&minTileX, &maxTileX, &minTileY, &maxTileY)
-
-		// Log tile range for debugging
-		fmt.Printf("Zoom level %d: minTileX=%d, maxTileX=%d, minTileY=%d, maxTileY=%d\n", zoom, minTileX, maxTileX, minTileY, maxTileY)
-
-		if minTileX > maxTileX || minTileY > maxTileY {
-			fmt.Printf("Skipping zoom level %d due to invalid tile range.\n", zoom)
-			continue
-		}
-
-		// Iterate over the tiles within the bounding box
-		for x := minTileX; x <= maxTileX; x++ {
-			for y := minTileY; y <= maxTileY; y++ {
-				// Construct the local file path
-				filePath := filepath.Join(downloadDir, fmt.Sprintf("%s/%d/%d/%d.pbf", layer.ID, zoom, x, y))
-
-				// Create directories if they don't exist
-				err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
-				if err != nil {
-					fmt.Printf("Failed to create directories: %v\n", err)
-					continue
-				}
-
-				mvtData, err := getVectorTile(zoom, x, y, layer, nil, nil, nil)
-				if err != nil {
-					fmt.Printf("Failed to get vector tile for zoom %d, x=%d, y=%d: %v\n", zoom, x, y, err)
-					continue
-				}
-
-				// Create the file
-				file, err := os.Create(filePath)
-				if err != nil {
-					return fmt.Errorf("failed to create file: %w", err)
-				}
-				defer file.Close()
-
-				// Copy the tile data to the file
-				_, err = file.Write(mvtData)
-				if err != nil {
-					return fmt.Errorf("failed to save tile: %w", err)
-				}
-			}
-		}
+func ptrValue(ptr *string) string {
+	if ptr == nil {
+		return ""
 	}
-
-	return nil
+	return *ptr
 }
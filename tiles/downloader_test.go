@@ -0,0 +1,48 @@
+package tiles
+
+import "testing"
+
+func TestTileRange(t *testing.T) {
+	world := &BoundingBox{MinLon: -180, MinLat: -90, MaxLon: 180, MaxLat: 90}
+	ulaanbaatar := &BoundingBox{MinLon: 106.7, MinLat: 47.8, MaxLon: 107.1, MaxLat: 48.0}
+
+	tests := []struct {
+		name                   string
+		bbox                   *BoundingBox
+		zoom                   int
+		minX, maxX, minY, maxY int
+	}{
+		{"world at zoom 0", world, 0, 0, 0, 0, 0},
+		{"world at zoom 3", world, 3, 0, 7, 0, 7},
+		{"point-sized area at zoom 0", ulaanbaatar, 0, 0, 0, 0, 0},
+		{"area at zoom 10", ulaanbaatar, 10, 815, 816, 355, 356},
+		{"eastern edge, equator row below", &BoundingBox{MinLon: 170, MinLat: 0, MaxLon: 180, MaxLat: 10}, 2, 3, 3, 1, 2},
+	}
+	for _, tt := range tests {
+		minX, maxX, minY, maxY := tileRange(tt.bbox, tt.zoom)
+		if minX != tt.minX || maxX != tt.maxX || minY != tt.minY || maxY != tt.maxY {
+			t.Errorf("%s: tileRange = x %d-%d, y %d-%d, want x %d-%d, y %d-%d",
+				tt.name, minX, maxX, minY, maxY, tt.minX, tt.maxX, tt.minY, tt.maxY)
+		}
+	}
+}
+
+func TestCountTiles(t *testing.T) {
+	world := &BoundingBox{MinLon: -180, MinLat: -90, MaxLon: 180, MaxLat: 90}
+	tests := []struct {
+		bbox             *BoundingBox
+		fromZoom, toZoom int
+		want             int64
+	}{
+		{world, 0, 0, 1},
+		{world, 0, 2, 1 + 4 + 16},
+		{world, 3, 3, 64},
+		{world, 2, 1, 0},
+		{&BoundingBox{MinLon: 106.7, MinLat: 47.8, MaxLon: 107.1, MaxLat: 48.0}, 9, 10, 2*2 + 2*2},
+	}
+	for _, tt := range tests {
+		if got := countTiles(tt.bbox, tt.fromZoom, tt.toZoom); got != tt.want {
+			t.Errorf("countTiles(%+v, %d, %d) = %d, want %d", *tt.bbox, tt.fromZoom, tt.toZoom, got, tt.want)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/khankhulgun/khanmap/metrics"
 )
 
 // FontHandler serves font glyphs for map text rendering
@@ -21,6 +22,7 @@ func FontHandler(c *fiber.Ctx) error {
 
 	// Check if font exists locally
 	if _, err := os.Stat(fontPath); err == nil {
+		metrics.FontCache.WithLabelValues("hit").Inc()
 		// Serve local font file
 		c.Set("Content-Type", "application/x-protobuf")
 		c.Set("Cache-Control", "public, max-age=86400") // Cache for 1 day
@@ -28,6 +30,7 @@ func FontHandler(c *fiber.Ctx) error {
 	}
 
 	// Font not found locally, download from OpenMapTiles
+	metrics.FontCache.WithLabelValues("miss").Inc()
 	fontURL := "https://fonts.openmaptiles.org/" + fontstack + "/" + rangeParam + ".pbf"
 
 	resp, err := http.Get(fontURL)
@@ -0,0 +1,367 @@
+package tiles
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/khankhulgun/khanmap/database/migrations"
+	"github.com/khankhulgun/khanmap/maplayer"
+	"github.com/khankhulgun/khanmap/models"
+	"github.com/lambda-platform/lambda/DB"
+)
+
+const (
+	changeChannel     = "khanmap_tile_changes"
+	changeBatchSize   = 1000
+	changeClaimLease  = 15 * time.Minute
+	changeLogRetained = 7 * 24 * time.Hour
+)
+
+// tileChange is one row of map_server.tile_changes
+type tileChange struct {
+	ID       int64   `gorm:"column:id"`
+	DbSchema string  `gorm:"column:db_schema"`
+	DbTable  string  `gorm:"column:db_table"`
+	MinX     float64 `gorm:"column:min_x"`
+	MinY     float64 `gorm:"column:min_y"`
+	MaxX     float64 `gorm:"column:max_x"`
+	MaxY     float64 `gorm:"column:max_y"`
+}
+
+// StartInvalidation installs change triggers on every active layer table and starts
+// refreshing saved tiles as rows change. Notifications arrive through LISTEN/NOTIFY;
+// the change log is also polled so nothing is missed when the listener is down.
+func StartInvalidation() {
+	if err := migrations.MigrateTileChanges(); err != nil {
+		log.Printf("Tile invalidation disabled: %v", err)
+		return
+	}
+	InstallChangeTriggers()
+
+	wake := make(chan struct{}, 1)
+	go listenForChanges(wake)
+	go processChangesLoop(wake)
+}
+
+// StartDataVersions installs the data version trigger on every active layer table without
+// tracking changes for saved tiles, which StartInvalidation does along with it. Tile URLs then
+// carry a data version that changes with the data, and tiles under it are cached as immutable.
+func StartDataVersions() {
+	if err := migrations.MigrateDataVersions(); err != nil {
+		log.Printf("Data versions disabled: %v", err)
+		return
+	}
+	InstallDataVersionTriggers()
+}
+
+// InstallChangeTriggers (re)creates the change and data version triggers on each active layer's table
+func InstallChangeTriggers() {
+	forEachLayerTable(InstallChangeTrigger)
+}
+
+// InstallDataVersionTriggers (re)creates the data version trigger on each active layer's table
+func InstallDataVersionTriggers() {
+	forEachLayerTable(InstallDataVersionTrigger)
+}
+
+// forEachLayerTable calls install with one active layer of each layer table
+func forEachLayerTable(install func(layer models.MapLayersForTile)) {
+	var layers []models.MapLayersForTile
+	if err := DB.DB.Where("is_active = ?", true).Find(&layers).Error; err != nil {
+		log.Printf("Failed to load layers for change triggers: %v", err)
+		return
+	}
+
+	installed := make(map[string]bool)
+	for _, layer := range layers {
+		table := layer.DbSchema + "." + layer.DbTable
+		if installed[table] || layer.DbTable == "" {
+			continue
+		}
+		installed[table] = true
+		install(layer)
+	}
+}
+
+// InstallChangeTrigger (re)creates the change and data version triggers on the layer's table
+func InstallChangeTrigger(layer models.MapLayersForTile) {
+	if layer.DbTable == "" {
+		return
+	}
+	table := layer.DbSchema + "." + layer.DbTable
+	geomCol := strings.ReplaceAll(layer.GeometryFieldName, "'", "")
+
+	// Drop the row level trigger of earlier versions along with the current triggers
+	sql := fmt.Sprintf("DROP TRIGGER IF EXISTS %s ON %s;\n", migrations.ChangeTrigger, table)
+	for _, event := range []struct{ name, transitions string }{
+		{"INSERT", "NEW TABLE AS new_rows"},
+		{"UPDATE", "OLD TABLE AS old_rows NEW TABLE AS new_rows"},
+		{"DELETE", "OLD TABLE AS old_rows"},
+	} {
+		trigger := migrations.ChangeTrigger + "_" + strings.ToLower(event.name)
+		sql += fmt.Sprintf(`
+			DROP TRIGGER IF EXISTS %s ON %s;
+			CREATE TRIGGER %s AFTER %s ON %s REFERENCING %s
+			FOR EACH STATEMENT EXECUTE FUNCTION map_server.track_tile_change('%s');
+		`, trigger, table, trigger, event.name, table, event.transitions, geomCol)
+	}
+
+	if err := DB.DB.Exec(sql).Error; err != nil {
+		log.Printf("Failed to install change trigger on %s: %v", table, err)
+	}
+	InstallDataVersionTrigger(layer)
+}
+
+// InstallDataVersionTrigger (re)creates the trigger counting changes to the layer's table
+func InstallDataVersionTrigger(layer models.MapLayersForTile) {
+	if layer.DbTable == "" {
+		return
+	}
+	table := layer.DbSchema + "." + layer.DbTable
+
+	sql := fmt.Sprintf(`
+		DROP TRIGGER IF EXISTS %s ON %s;
+		CREATE TRIGGER %s AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON %s
+		FOR EACH STATEMENT EXECUTE FUNCTION map_server.bump_data_version();
+	`, migrations.DataVersionTrigger, table, migrations.DataVersionTrigger, table)
+
+	if err := DB.DB.Exec(sql).Error; err != nil {
+		log.Printf("Failed to install data version trigger on %s: %v", table, err)
+	}
+}
+
+// listenForChanges holds a dedicated connection on LISTEN and signals wake for each notification
+func listenForChanges(wake chan<- struct{}) {
+	for {
+		err := listenOnce(wake)
+		log.Printf("Tile change listener stopped, relying on polling until it reconnects: %v", err)
+		time.Sleep(time.Duration(Config.InvalidationPoll) * time.Second)
+	}
+}
+
+func listenOnce(wake chan<- struct{}) error {
+	sqlDB, err := DB.DB.DB()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		stdConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("LISTEN requires the pgx driver, got %T", driverConn)
+		}
+		pgConn := stdConn.Conn()
+
+		if _, err := pgConn.Exec(ctx, "LISTEN "+changeChannel); err != nil {
+			return err
+		}
+		for {
+			if _, err := pgConn.WaitForNotification(ctx); err != nil {
+				return err
+			}
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+	})
+}
+
+func processChangesLoop(wake <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(Config.InvalidationPoll) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-wake:
+		case <-ticker.C:
+		}
+
+		// Drain the backlog in batches
+		for {
+			n, err := processPendingChanges()
+			if err != nil {
+				log.Printf("Failed to process tile changes: %v", err)
+				break
+			}
+			if n < changeBatchSize {
+				break
+			}
+		}
+
+		DB.DB.Exec(`DELETE FROM map_server.tile_changes WHERE processed_at < ?`, time.Now().Add(-changeLogRetained))
+	}
+}
+
+// processPendingChanges invalidates the tiles touched by a batch of unprocessed changes.
+// The batch is claimed in a statement of its own, skipping rows another instance is claiming,
+// so no rows stay locked while tiles are regenerated. A claim expires after changeClaimLease,
+// when the changes of an instance that stopped before marking them processed are claimed again.
+func processPendingChanges() (int, error) {
+	var changes []tileChange
+	err := DB.DB.Raw(`
+		UPDATE map_server.tile_changes SET claimed_at = now()
+		WHERE id IN (
+			SELECT id FROM map_server.tile_changes
+			WHERE processed_at IS NULL AND (claimed_at IS NULL OR claimed_at < now() - ? * interval '1 second')
+			ORDER BY id
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, db_schema, db_table, min_x, min_y, max_x, max_y`,
+		int(changeClaimLease/time.Second), changeBatchSize).Scan(&changes).Error
+	if err != nil || len(changes) == 0 {
+		return 0, err
+	}
+
+	byTable := make(map[string][]tileChange)
+	var ids []int64
+	for _, change := range changes {
+		key := change.DbSchema + "." + change.DbTable
+		byTable[key] = append(byTable[key], change)
+		ids = append(ids, change.ID)
+	}
+
+	for _, tableChanges := range byTable {
+		maplayer.ForgetDataVersion(tableChanges[0].DbSchema, tableChanges[0].DbTable)
+
+		var layerIDs []string
+		err := DB.DB.Model(&models.MapLayersForTile{}).
+			Where("db_schema = ? AND db_table = ?", tableChanges[0].DbSchema, tableChanges[0].DbTable).
+			Pluck("id", &layerIDs).Error
+		if err != nil {
+			return 0, err
+		}
+
+		for _, layerID := range layerIDs {
+			layer, err := maplayer.FetchLayerDetails(layerID)
+			if err != nil {
+				continue
+			}
+			invalidateLayerTiles(layer, tableChanges)
+		}
+	}
+
+	return len(changes), DB.DB.Exec(`UPDATE map_server.tile_changes SET processed_at = now() WHERE id IN ?`, ids).Error
+}
+
+// invalidateLayerTiles drops the layer's cached live tiles and deletes or regenerates
+// the saved tiles covering the changed extents
+func invalidateLayerTiles(layer models.MapLayersForTile, changes []tileChange) {
+	PurgeLayerCache(layer.ID)
+
+	// The MBTiles export is refreshed along with the tile store, unless it is the store
+	var stores []TileStore
+	if store, err := getTileStore(); err == nil {
+		stores = append(stores, store)
+	}
+	if Config.Store != "mbtiles" {
+		stores = append(stores, &mbtilesTileStore{})
+	}
+
+	if _, err := os.Stat(pmtilesPath(layer.ID)); err == nil {
+		log.Printf("PMTiles export of layer %s is stale; re-seed it to pick up data changes", layer.ID)
+	}
+
+	regenerated := make(map[TileCoord][]byte)
+	refreshed := 0
+	for _, store := range stores {
+		zooms, err := store.Zooms(layer.ID)
+		if err != nil {
+			log.Printf("Failed to list saved zoom levels of layer %s: %v", layer.ID, err)
+			continue
+		}
+
+		for _, zoom := range zooms {
+			// Only the saved tiles around the changes are listed
+			ranges := changedTileRanges(changes, zoom)
+			saved, err := store.List(layer.ID, zoom, ranges.bounds())
+			if err != nil {
+				log.Printf("Failed to list saved tiles of layer %s at zoom %d: %v", layer.ID, zoom, err)
+				continue
+			}
+
+			for _, tile := range saved {
+				if !ranges.touch(tile) {
+					continue
+				}
+
+				data, ok := regenerated[tile]
+				if !ok && Config.InvalidationRegenerate {
+					data, err = getVectorTile(context.Background(), tile.Z, tile.X, tile.Y, layer, nil, nil, nil)
+					if err != nil {
+						log.Printf("Failed to regenerate tile %d/%d/%d of layer %s: %v", tile.Z, tile.X, tile.Y, layer.ID, err)
+						data = nil
+					}
+					regenerated[tile] = data
+				}
+
+				if data != nil {
+					err = store.Put(layer.ID, tile.Z, tile.X, tile.Y, data)
+				} else {
+					err = store.Delete(layer.ID, tile.Z, tile.X, tile.Y)
+				}
+				if err != nil {
+					log.Printf("Failed to refresh saved tile %d/%d/%d of layer %s: %v", tile.Z, tile.X, tile.Y, layer.ID, err)
+					continue
+				}
+				refreshed++
+			}
+		}
+	}
+
+	if refreshed > 0 {
+		log.Printf("Invalidated %d saved tiles of layer %s after %d changes", refreshed, layer.ID, len(changes))
+	}
+}
+
+// tileRanges are the tile columns and rows of one zoom touched by changes
+type tileRanges []TileBounds
+
+// changedTileRanges returns the tiles at zoom touching one of the changed extents.
+// Neighbouring tiles are included because features are rendered into the tile buffer.
+func changedTileRanges(changes []tileChange, zoom int) tileRanges {
+	ranges := make(tileRanges, len(changes))
+	for i, change := range changes {
+		bbox := &BoundingBox{MinLat: change.MinY, MaxLat: change.MaxY, MinLon: change.MinX, MaxLon: change.MaxX}
+		minTileX, maxTileX, minTileY, maxTileY := tileRange(bbox, zoom)
+		ranges[i] = TileBounds{MinX: minTileX - 1, MaxX: maxTileX + 1, MinY: minTileY - 1, MaxY: maxTileY + 1}
+	}
+	return ranges
+}
+
+// bounds returns the bounds covering all of the ranges
+func (r tileRanges) bounds() TileBounds {
+	var covering TileBounds
+	for i, bounds := range r {
+		if i == 0 {
+			covering = bounds
+			continue
+		}
+		covering.MinX, covering.MaxX = min(covering.MinX, bounds.MinX), max(covering.MaxX, bounds.MaxX)
+		covering.MinY, covering.MaxY = min(covering.MinY, bounds.MinY), max(covering.MaxY, bounds.MaxY)
+	}
+	return covering
+}
+
+// touch reports whether the tile lies in one of the ranges
+func (r tileRanges) touch(tile TileCoord) bool {
+	for _, bounds := range r {
+		if bounds.Contains(tile.X, tile.Y) {
+			return true
+		}
+	}
+	return false
+}
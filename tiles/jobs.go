@@ -0,0 +1,526 @@
+package tiles
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/khankhulgun/khanmap/maplayer"
+	"github.com/khankhulgun/khanmap/models"
+)
+
+// Seed job states
+const (
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// jobsDir holds one checkpoint file per seeding job; it is kept out of ./public on purpose
+const jobsDir = "./seed-jobs"
+
+// SeedOptions configures a seeding job
+type SeedOptions struct {
+	// Format is files for the configured tile store, or mbtiles or pmtiles for a single-file export
+	Format  string       `json:"format"`
+	MinZoom int          `json:"min_zoom"`
+	MaxZoom int          `json:"max_zoom"`
+	BBox    *BoundingBox `json:"bbox"`
+	Workers int          `json:"workers"`
+}
+
+// SeedJob is a background run that renders a layer's tiles into a tile sink
+type SeedJob struct {
+	ID      string      `json:"id"`
+	LayerID string      `json:"layer_id"`
+	Options SeedOptions `json:"options"`
+	Status  string      `json:"status"`
+	Error   string      `json:"error,omitempty"`
+
+	// Zoom levels below CheckpointZoom are fully written
+	CheckpointZoom int `json:"checkpoint_zoom"`
+
+	TilesTotal   int64 `json:"tiles_total"`
+	TilesDone    int64 `json:"tiles_done"`
+	TilesSkipped int64 `json:"tiles_skipped"`
+	TilesFailed  int64 `json:"tiles_failed"`
+
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	mu            sync.Mutex
+	cancel        context.CancelFunc
+	done          chan struct{}
+	runStartedAt  time.Time
+	runStartCount int64
+}
+
+var (
+	seedJobs sync.Map
+
+	// seedJobsMu serializes starting jobs, so two jobs never write the same output
+	seedJobsMu sync.Mutex
+
+	// errInvalidSeedOptions marks seeding options that are rejected before a job starts
+	errInvalidSeedOptions = errors.New("invalid seed options")
+
+	// errSeedJobRunning is returned when the layer is already being seeded into the same format
+	errSeedJobRunning = errors.New("a seed job for this layer and format is already running")
+)
+
+// StartSeedJob validates the options and starts seeding in the background
+func StartSeedJob(layer models.MapLayersForTile, opts SeedOptions) (*SeedJob, error) {
+	if opts.Format == "" {
+		opts.Format = "files"
+	}
+	opts.Workers = seedWorkers(opts.Workers)
+	if opts.MinZoom < 0 || opts.MaxZoom < opts.MinZoom || opts.MaxZoom > 22 {
+		return nil, fmt.Errorf("%w: invalid zoom range %d-%d", errInvalidSeedOptions, opts.MinZoom, opts.MaxZoom)
+	}
+	if opts.Format != "files" && opts.Format != "mbtiles" && opts.Format != "pmtiles" {
+		return nil, fmt.Errorf("%w: unsupported tile format %q", errInvalidSeedOptions, opts.Format)
+	}
+
+	seedJobsMu.Lock()
+	defer seedJobsMu.Unlock()
+	if runningSeedJob(layer.ID, opts.Format) != nil {
+		return nil, errSeedJobRunning
+	}
+
+	if opts.BBox == nil {
+		bbox, err := GetBoundingBox(layer)
+		if err != nil {
+			return nil, err
+		}
+		opts.BBox = bbox
+	}
+
+	now := time.Now()
+	job := &SeedJob{
+		ID:             uuid.NewString(),
+		LayerID:        layer.ID,
+		Options:        opts,
+		Status:         JobRunning,
+		CheckpointZoom: opts.MinZoom,
+		TilesTotal:     countTiles(opts.BBox, opts.MinZoom, opts.MaxZoom),
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+
+	job.start(layer)
+	return job, nil
+}
+
+// seedWorkers returns the number of workers a job runs with, SeedWorkers by default and at most SeedMaxWorkers
+func seedWorkers(requested int) int {
+	if requested <= 0 {
+		requested = Config.SeedWorkers
+	}
+	return max(min(requested, Config.SeedMaxWorkers), 1)
+}
+
+// runningSeedJob returns the running job seeding the layer into the format, if there is one
+func runningSeedJob(layerID, format string) *SeedJob {
+	var running *SeedJob
+	seedJobs.Range(func(_, value interface{}) bool {
+		job := value.(*SeedJob)
+		job.mu.Lock()
+		active := job.Status == JobRunning && job.LayerID == layerID && job.Options.Format == format
+		job.mu.Unlock()
+		if active {
+			running = job
+		}
+		return running == nil
+	})
+	return running
+}
+
+// seedJobStatus returns the HTTP status of a job that could not be started
+func seedJobStatus(err error) int {
+	switch {
+	case errors.Is(err, errSeedJobRunning):
+		return fiber.StatusConflict
+	case errors.Is(err, errInvalidSeedOptions):
+		return fiber.StatusBadRequest
+	}
+	return fiber.StatusInternalServerError
+}
+
+// ResumeSeedJobs restarts jobs that were still running when the server stopped
+func ResumeSeedJobs() {
+	files, err := filepath.Glob(filepath.Join(jobsDir, "*.json"))
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		job := &SeedJob{}
+		if err := json.Unmarshal(data, job); err != nil {
+			log.Printf("Invalid seed job checkpoint %s: %v", file, err)
+			continue
+		}
+		if job.Status != JobRunning {
+			seedJobs.Store(job.ID, job)
+			continue
+		}
+
+		layer, err := maplayer.FetchLayerDetails(job.LayerID)
+		if err != nil {
+			log.Printf("Cannot resume seed job %s, layer not found: %v", job.ID, err)
+			continue
+		}
+
+		seedJobsMu.Lock()
+		if running := runningSeedJob(job.LayerID, job.Options.Format); running != nil {
+			seedJobsMu.Unlock()
+			log.Printf("Cannot resume seed job %s, job %s is seeding the same output", job.ID, running.ID)
+			continue
+		}
+		log.Printf("Resuming seed job %s for layer %s from zoom %d", job.ID, job.LayerID, job.CheckpointZoom)
+		job.Options.Workers = seedWorkers(job.Options.Workers)
+		job.start(layer)
+		seedJobsMu.Unlock()
+	}
+}
+
+// GetSeedJob returns a registered job by id
+func GetSeedJob(id string) (*SeedJob, bool) {
+	job, ok := seedJobs.Load(id)
+	if !ok {
+		return nil, false
+	}
+	return job.(*SeedJob), true
+}
+
+// ListSeedJobs returns all known jobs, newest first
+func ListSeedJobs() []*SeedJob {
+	var jobs []*SeedJob
+	seedJobs.Range(func(_, value interface{}) bool {
+		jobs = append(jobs, value.(*SeedJob))
+		return true
+	})
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.After(jobs[j].CreatedAt) })
+	return jobs
+}
+
+func (j *SeedJob) start(layer models.MapLayersForTile) {
+	ctx, cancel := context.WithCancel(context.Background())
+	j.cancel = cancel
+	j.done = make(chan struct{})
+	j.runStartedAt = time.Now()
+	j.runStartCount = j.TilesDone + j.TilesSkipped + j.TilesFailed
+
+	seedJobs.Store(j.ID, j)
+	j.save()
+
+	go j.run(ctx, layer)
+}
+
+// Cancel stops a running job; already written tiles are kept
+func (j *SeedJob) Cancel() {
+	j.mu.Lock()
+	cancel := j.cancel
+	j.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// Wait blocks until the job finishes and returns its error, if any
+func (j *SeedJob) Wait() error {
+	if j.done != nil {
+		<-j.done
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.Error != "" {
+		return errors.New(j.Error)
+	}
+	return nil
+}
+
+func (j *SeedJob) run(ctx context.Context, layer models.MapLayersForTile) {
+	defer close(j.done)
+
+	opts := j.Options
+	if opts.Format == "pmtiles" {
+		// Archives are rebuilt from scratch, so progress restarts as well
+		j.mu.Lock()
+		j.CheckpointZoom = opts.MinZoom
+		j.TilesDone, j.TilesSkipped, j.TilesFailed = 0, 0, 0
+		j.runStartCount = 0
+		j.mu.Unlock()
+	}
+
+	sink, err := newTileSink(opts.Format, layer, opts.BBox, opts.MinZoom, opts.MaxZoom)
+	if err != nil {
+		j.finish(JobFailed, err)
+		return
+	}
+
+	type tileCoord struct{ z, x, y int }
+	coords := make(chan tileCoord)
+	var wg sync.WaitGroup
+
+	for i := 0; i < opts.Workers; i++ {
+		go func() {
+			for c := range coords {
+				j.seedTile(ctx, sink, layer, c.z, c.x, c.y)
+				wg.Done()
+			}
+		}()
+	}
+
+	for zoom := j.CheckpointZoom; zoom <= opts.MaxZoom && ctx.Err() == nil; zoom++ {
+		minTileX, maxTileX, minTileY, maxTileY := tileRange(opts.BBox, zoom)
+		log.Printf("Seed job %s: zoom %d, x=%d..%d, y=%d..%d", j.ID, zoom, minTileX, maxTileX, minTileY, maxTileY)
+
+	produce:
+		for x := minTileX; x <= maxTileX; x++ {
+			for y := minTileY; y <= maxTileY; y++ {
+				wg.Add(1)
+				select {
+				case coords <- tileCoord{zoom, x, y}:
+				case <-ctx.Done():
+					wg.Done()
+					break produce
+				}
+			}
+		}
+
+		// Checkpoint only once every tile of the zoom level is written
+		wg.Wait()
+		if ctx.Err() == nil {
+			j.mu.Lock()
+			j.CheckpointZoom = zoom + 1
+			j.mu.Unlock()
+			j.save()
+		}
+	}
+	close(coords)
+
+	if ctx.Err() != nil {
+		if err := sink.Close(false); err != nil {
+			log.Printf("Seed job %s: failed to close output: %v", j.ID, err)
+		}
+		j.finish(JobCancelled, nil)
+		return
+	}
+
+	if err := sink.Close(true); err != nil {
+		j.finish(JobFailed, err)
+		return
+	}
+	j.finish(JobCompleted, nil)
+}
+
+// seedTile renders one tile into the sink. Its queries run with the job context, so cancelling
+// the job also cancels the tiles being rendered.
+func (j *SeedJob) seedTile(ctx context.Context, sink tileSink, layer models.MapLayersForTile, z, x, y int) {
+	if ctx.Err() != nil {
+		return
+	}
+	if sink.Has(z, x, y) {
+		j.count(&j.TilesSkipped)
+		return
+	}
+
+	mvtData, err := getVectorTile(ctx, z, x, y, layer, nil, nil, nil)
+	if err == nil {
+		err = sink.Put(z, x, y, mvtData)
+	}
+	if err != nil && ctx.Err() != nil {
+		// The job was cancelled, the tile is seeded again when it resumes
+		return
+	}
+	if err != nil {
+		log.Printf("Seed job %s: tile %d/%d/%d failed: %v", j.ID, z, x, y, err)
+		j.count(&j.TilesFailed)
+		return
+	}
+	j.count(&j.TilesDone)
+}
+
+func (j *SeedJob) count(counter *int64) {
+	j.mu.Lock()
+	*counter++
+	j.UpdatedAt = time.Now()
+	j.mu.Unlock()
+}
+
+func (j *SeedJob) finish(status string, err error) {
+	now := time.Now()
+	j.mu.Lock()
+	j.Status = status
+	if err != nil {
+		j.Error = err.Error()
+		log.Printf("Seed job %s failed: %v", j.ID, err)
+	}
+	j.UpdatedAt = now
+	j.FinishedAt = &now
+	j.cancel = nil
+	j.mu.Unlock()
+	j.save()
+}
+
+// save writes the job checkpoint so it survives a restart
+func (j *SeedJob) save() {
+	j.mu.Lock()
+	data, err := json.MarshalIndent(j, "", "  ")
+	j.mu.Unlock()
+	if err != nil {
+		log.Printf("Seed job %s: failed to encode checkpoint: %v", j.ID, err)
+		return
+	}
+
+	if err := os.MkdirAll(jobsDir, os.ModePerm); err != nil {
+		log.Printf("Seed job %s: failed to create jobs directory: %v", j.ID, err)
+		return
+	}
+	tmp := filepath.Join(jobsDir, j.ID+".json.tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Printf("Seed job %s: failed to write checkpoint: %v", j.ID, err)
+		return
+	}
+	os.Rename(tmp, filepath.Join(jobsDir, j.ID+".json"))
+}
+
+// progress returns a snapshot of the job with its estimated time remaining
+func (j *SeedJob) progress() fiber.Map {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	processed := j.TilesDone + j.TilesSkipped + j.TilesFailed
+	var eta interface{}
+	if j.Status == JobRunning {
+		ranThisRun := processed - j.runStartCount
+		if ranThisRun > 0 {
+			perTile := time.Since(j.runStartedAt).Seconds() / float64(ranThisRun)
+			eta = int64(perTile * float64(j.TilesTotal-processed))
+		}
+	}
+
+	var percent float64
+	if j.TilesTotal > 0 {
+		percent = float64(processed) * 100 / float64(j.TilesTotal)
+	}
+
+	return fiber.Map{
+		"id":              j.ID,
+		"layer_id":        j.LayerID,
+		"options":         j.Options,
+		"status":          j.Status,
+		"error":           j.Error,
+		"checkpoint_zoom": j.CheckpointZoom,
+		"tiles_total":     j.TilesTotal,
+		"tiles_done":      j.TilesDone,
+		"tiles_skipped":   j.TilesSkipped,
+		"tiles_failed":    j.TilesFailed,
+		"percent":         percent,
+		"eta_seconds":     eta,
+		"created_at":      j.CreatedAt,
+		"updated_at":      j.UpdatedAt,
+		"finished_at":     j.FinishedAt,
+	}
+}
+
+// parseSeedOptions reads seeding options from query parameters
+func parseSeedOptions(c *fiber.Ctx) (SeedOptions, error) {
+	opts := SeedOptions{
+		Format:  c.Query("format", "files"),
+		MinZoom: c.QueryInt("min_zoom", minZoom),
+		MaxZoom: c.QueryInt("max_zoom", maxZoom),
+		Workers: c.QueryInt("workers", Config.SeedWorkers),
+	}
+
+	if bbox := c.Query("bbox"); bbox != "" {
+		parts := strings.Split(bbox, ",")
+		if len(parts) != 4 {
+			return opts, errors.New("bbox must be minLon,minLat,maxLon,maxLat")
+		}
+		var values [4]float64
+		for i, part := range parts {
+			v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return opts, fmt.Errorf("invalid bbox value %q", part)
+			}
+			values[i] = v
+		}
+		opts.BBox = &BoundingBox{MinLon: values[0], MinLat: values[1], MaxLon: values[2], MaxLat: values[3]}
+	}
+
+	return opts, nil
+}
+
+// StartSeedJobHandler starts a background seeding job for a layer
+func StartSeedJobHandler(c *fiber.Ctx) error {
+	layerDetails, err := maplayer.FetchLayerDetails(c.Params("layer"))
+	if err != nil {
+		log.Printf("Layer not found: %v", err)
+		return c.Status(fiber.StatusNotFound).SendString("Layer not found")
+	}
+
+	opts, err := parseSeedOptions(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
+
+	job, err := StartSeedJob(layerDetails, opts)
+	if err != nil {
+		return c.Status(seedJobStatus(err)).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(job.progress())
+}
+
+// SeedJobsHandler lists all seeding jobs
+func SeedJobsHandler(c *fiber.Ctx) error {
+	jobs := ListSeedJobs()
+	result := make([]fiber.Map, 0, len(jobs))
+	for _, job := range jobs {
+		result = append(result, job.progress())
+	}
+	return c.JSON(result)
+}
+
+// SeedJobHandler reports the progress of a single job
+func SeedJobHandler(c *fiber.Ctx) error {
+	job, ok := GetSeedJob(c.Params("id"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Job not found")
+	}
+	return c.JSON(job.progress())
+}
+
+// CancelSeedJobHandler stops a running job
+func CancelSeedJobHandler(c *fiber.Ctx) error {
+	job, ok := GetSeedJob(c.Params("id"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("Job not found")
+	}
+	job.Cancel()
+	return c.JSON(job.progress())
+}
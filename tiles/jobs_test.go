@@ -0,0 +1,155 @@
+package tiles
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/khankhulgun/khanmap/models"
+)
+
+func TestStartSeedJobOptions(t *testing.T) {
+	bbox := &BoundingBox{MinLon: 106.7, MinLat: 47.8, MaxLon: 107.1, MaxLat: 48.0}
+	tests := []struct {
+		name string
+		opts SeedOptions
+	}{
+		{"negative min zoom", SeedOptions{MinZoom: -1, MaxZoom: 5, BBox: bbox}},
+		{"max below min zoom", SeedOptions{MinZoom: 6, MaxZoom: 5, BBox: bbox}},
+		{"max zoom over 22", SeedOptions{MinZoom: 0, MaxZoom: 23, BBox: bbox}},
+		{"unsupported format", SeedOptions{Format: "geojson", MinZoom: 0, MaxZoom: 5, BBox: bbox}},
+	}
+	for _, tt := range tests {
+		job, err := StartSeedJob(models.MapLayersForTile{ID: "seed-options"}, tt.opts)
+		if !errors.Is(err, errInvalidSeedOptions) {
+			t.Errorf("%s: StartSeedJob = %v, %v, want %v", tt.name, job, err, errInvalidSeedOptions)
+			continue
+		}
+		if got := seedJobStatus(err); got != http.StatusBadRequest {
+			t.Errorf("%s: seedJobStatus = %d, want %d", tt.name, got, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestSeedWorkers(t *testing.T) {
+	workers, maxWorkers := Config.SeedWorkers, Config.SeedMaxWorkers
+	defer func() { Config.SeedWorkers, Config.SeedMaxWorkers = workers, maxWorkers }()
+	Config.SeedWorkers, Config.SeedMaxWorkers = 4, 16
+
+	tests := []struct {
+		requested, want int
+	}{
+		{0, 4},
+		{-3, 4},
+		{1, 1},
+		{8, 8},
+		{100, 16},
+	}
+	for _, tt := range tests {
+		if got := seedWorkers(tt.requested); got != tt.want {
+			t.Errorf("seedWorkers(%d) = %d, want %d", tt.requested, got, tt.want)
+		}
+	}
+
+	Config.SeedMaxWorkers = 0
+	if got := seedWorkers(8); got != 1 {
+		t.Errorf("seedWorkers(8) with a zero worker limit = %d, want 1", got)
+	}
+}
+
+func TestStartSeedJobDuplicate(t *testing.T) {
+	running := &SeedJob{ID: "seed-duplicate-running", LayerID: "seed-duplicate", Options: SeedOptions{Format: "mbtiles"}, Status: JobRunning}
+	finished := &SeedJob{ID: "seed-duplicate-finished", LayerID: "seed-duplicate", Options: SeedOptions{Format: "pmtiles"}, Status: JobCompleted}
+	for _, job := range []*SeedJob{running, finished} {
+		seedJobs.Store(job.ID, job)
+		defer seedJobs.Delete(job.ID)
+	}
+
+	opts := SeedOptions{Format: "mbtiles", MinZoom: 0, MaxZoom: 5, BBox: &BoundingBox{MaxLon: 1, MaxLat: 1}}
+	_, err := StartSeedJob(models.MapLayersForTile{ID: "seed-duplicate"}, opts)
+	if !errors.Is(err, errSeedJobRunning) {
+		t.Fatalf("StartSeedJob = %v, want %v", err, errSeedJobRunning)
+	}
+	if got := seedJobStatus(err); got != http.StatusConflict {
+		t.Errorf("seedJobStatus = %d, want %d", got, http.StatusConflict)
+	}
+
+	if got := runningSeedJob("seed-duplicate", "mbtiles"); got != running {
+		t.Errorf("runningSeedJob(mbtiles) = %v, want %s", got, running.ID)
+	}
+	for _, format := range []string{"files", "pmtiles"} {
+		if got := runningSeedJob("seed-duplicate", format); got != nil {
+			t.Errorf("runningSeedJob(%s) = %s, want none", format, got.ID)
+		}
+	}
+	if got := runningSeedJob("seed-other-layer", "mbtiles"); got != nil {
+		t.Errorf("runningSeedJob of another layer = %s, want none", got.ID)
+	}
+}
+
+func TestSeedJobResume(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	// Tiles from the checkpoint on are already stored, so the resumed job renders none.
+	// Zoom 0 is missing: it lies below the checkpoint and must not be seeded again.
+	bbox := &BoundingBox{MinLon: 106.7, MinLat: 47.8, MaxLon: 107.1, MaxLat: 48.0}
+	store := &fsTileStore{dir: Config.StoreDir}
+	for zoom := 1; zoom <= 3; zoom++ {
+		minX, maxX, minY, maxY := tileRange(bbox, zoom)
+		for x := minX; x <= maxX; x++ {
+			for y := minY; y <= maxY; y++ {
+				if err := store.Put("seed-resume", zoom, x, y, []byte("tile")); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	checkpoint := SeedJob{
+		ID:             "seed-resume-job",
+		LayerID:        "seed-resume",
+		Options:        SeedOptions{Format: "files", MinZoom: 0, MaxZoom: 3, BBox: bbox, Workers: 2},
+		Status:         JobRunning,
+		CheckpointZoom: 1,
+		TilesTotal:     countTiles(bbox, 0, 3),
+		TilesDone:      1,
+	}
+	data, err := json.Marshal(&checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &SeedJob{}
+	if err := json.Unmarshal(data, job); err != nil {
+		t.Fatal(err)
+	}
+	defer seedJobs.Delete(job.ID)
+
+	job.start(models.MapLayersForTile{ID: "seed-resume"})
+	if err := job.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if job.Status != JobCompleted || job.CheckpointZoom != 4 {
+		t.Errorf("resumed job is %s at checkpoint zoom %d, want %s at 4", job.Status, job.CheckpointZoom, JobCompleted)
+	}
+	if want := countTiles(bbox, 1, 3); job.TilesDone != 1 || job.TilesSkipped != want || job.TilesFailed != 0 {
+		t.Errorf("resumed job did %d, skipped %d and failed %d tiles, want 1, %d and 0",
+			job.TilesDone, job.TilesSkipped, job.TilesFailed, want)
+	}
+
+	data, err = os.ReadFile(filepath.Join(jobsDir, job.ID+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := &SeedJob{}
+	if err := json.Unmarshal(data, saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Status != JobCompleted || saved.CheckpointZoom != 4 || saved.FinishedAt == nil {
+		t.Errorf("saved checkpoint is %s at zoom %d, finished at %v, want a completed job at zoom 4",
+			saved.Status, saved.CheckpointZoom, saved.FinishedAt)
+	}
+}
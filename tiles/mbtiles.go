@@ -0,0 +1,304 @@
+package tiles
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// MBTiles is an SQLite tile container following the MBTiles 1.3 spec.
+// Tiles are stored gzip-compressed and addressed in TMS row order.
+type MBTiles struct {
+	db *sql.DB
+}
+
+// pooledHandle is a shared handle on an MBTiles export, opened read-only unless it was written to.
+// refs counts the callers using it; a handle dropped from the pool is closed once the last of
+// them releases it.
+type pooledHandle struct {
+	mb       *MBTiles
+	writable bool
+	refs     int
+	retired  bool
+}
+
+// release gives back a handle returned by pooledMBTiles
+func (h *pooledHandle) release() {
+	mbtilesPoolMu.Lock()
+	defer mbtilesPoolMu.Unlock()
+	h.refs--
+	if h.retired && h.refs == 0 {
+		h.mb.Close()
+	}
+}
+
+// retire drops the handle from use, closing it now or when its last caller releases it.
+// The caller holds mbtilesPoolMu.
+func (h *pooledHandle) retire() {
+	h.retired = true
+	if h.refs == 0 {
+		h.mb.Close()
+	}
+}
+
+var (
+	// mbtilesPool keeps handles open for the saved-tiles route and the mbtiles tile store
+	mbtilesPool = make(map[string]*pooledHandle)
+
+	// mbtilesPoolMu guards the pool, and replacing an export, so no handle on a replaced file is kept
+	mbtilesPoolMu sync.Mutex
+)
+
+// OpenMBTiles opens (or creates) an MBTiles file and ensures its schema exists
+func OpenMBTiles(path string) (*MBTiles, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mbtiles %s: %w", path, err)
+	}
+	// SQLite allows a single writer; serialize access through one connection
+	db.SetMaxOpenConns(1)
+
+	schema := `
+		CREATE TABLE IF NOT EXISTS metadata (name TEXT, value TEXT);
+		CREATE UNIQUE INDEX IF NOT EXISTS metadata_name ON metadata (name);
+		CREATE TABLE IF NOT EXISTS tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB);
+		CREATE UNIQUE INDEX IF NOT EXISTS tile_index ON tiles (zoom_level, tile_column, tile_row);
+	`
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create mbtiles schema %s: %w", path, err)
+	}
+
+	return &MBTiles{db: db}, nil
+}
+
+// OpenMBTilesReadOnly opens an existing MBTiles file for reading
+func OpenMBTilesReadOnly(path string) (*MBTiles, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mbtiles %s: %w", path, err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open mbtiles %s: %w", path, err)
+	}
+	return &MBTiles{db: db}, nil
+}
+
+// SetMetadata writes name/value pairs into the metadata table
+func (m *MBTiles) SetMetadata(meta map[string]string) error {
+	for name, value := range meta {
+		_, err := m.db.Exec(`INSERT OR REPLACE INTO metadata (name, value) VALUES (?, ?)`, name, value)
+		if err != nil {
+			return fmt.Errorf("failed to write mbtiles metadata %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// PutTile gzips an XYZ tile and stores it under its TMS row
+func (m *MBTiles) PutTile(z, x, y int, data []byte) error {
+	compressed, err := gzipBytes(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.db.Exec(`INSERT OR REPLACE INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)`,
+		z, x, flipY(z, y), compressed)
+	if err != nil {
+		return fmt.Errorf("failed to write tile %d/%d/%d: %w", z, x, y, err)
+	}
+	return nil
+}
+
+// GetTile returns the gzip-compressed tile for XYZ coordinates, or nil when it is missing
+func (m *MBTiles) GetTile(z, x, y int) ([]byte, error) {
+	var data []byte
+	err := m.db.QueryRow(`SELECT tile_data FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?`,
+		z, x, flipY(z, y)).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tile %d/%d/%d: %w", z, x, y, err)
+	}
+	return data, nil
+}
+
+// DeleteTile removes an XYZ tile
+func (m *MBTiles) DeleteTile(z, x, y int) error {
+	_, err := m.db.Exec(`DELETE FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?`, z, x, flipY(z, y))
+	if err != nil {
+		return fmt.Errorf("failed to delete tile %d/%d/%d: %w", z, x, y, err)
+	}
+	return nil
+}
+
+// Zooms returns the zoom levels that hold at least one tile
+func (m *MBTiles) Zooms() ([]int, error) {
+	rows, err := m.db.Query(`SELECT DISTINCT zoom_level FROM tiles ORDER BY zoom_level`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mbtiles zoom levels: %w", err)
+	}
+	defer rows.Close()
+
+	var zooms []int
+	for rows.Next() {
+		var z int
+		if err := rows.Scan(&z); err == nil {
+			zooms = append(zooms, z)
+		}
+	}
+	return zooms, rows.Err()
+}
+
+// Tiles returns the XYZ coordinates of the tiles at zoom z within bounds
+func (m *MBTiles) Tiles(z int, bounds TileBounds) ([]TileCoord, error) {
+	rows, err := m.db.Query(`SELECT tile_column, tile_row FROM tiles
+		WHERE zoom_level = ? AND tile_column BETWEEN ? AND ? AND tile_row BETWEEN ? AND ?`,
+		z, bounds.MinX, bounds.MaxX, flipY(z, bounds.MaxY), flipY(z, bounds.MinY))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mbtiles tiles at zoom %d: %w", z, err)
+	}
+	defer rows.Close()
+
+	var coords []TileCoord
+	for rows.Next() {
+		var x, row int
+		if err := rows.Scan(&x, &row); err == nil {
+			coords = append(coords, TileCoord{z, x, flipY(z, row)})
+		}
+	}
+	return coords, rows.Err()
+}
+
+func (m *MBTiles) Close() error {
+	return m.db.Close()
+}
+
+// flipY converts between XYZ and TMS row numbering
+func flipY(z, y int) int {
+	return (1 << z) - 1 - y
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to gzip tile: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("failed to gzip tile: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// mbtilesPath returns the export location for a layer's MBTiles file
+func mbtilesPath(layerID string) string {
+	return fmt.Sprintf("%s/%s.mbtiles", downloadDir, layerID)
+}
+
+// pooledMBTiles returns a shared handle on the layer's exported MBTiles file, which the caller
+// gives back with release once it is done. Without writable the file is opened read-only and
+// nil is returned when there is none; with writable it is created.
+func pooledMBTiles(layerID string, writable bool) (mb *MBTiles, release func(), err error) {
+	path := mbtilesPath(layerID)
+
+	mbtilesPoolMu.Lock()
+	defer mbtilesPoolMu.Unlock()
+
+	cached, ok := mbtilesPool[path]
+	if ok && (cached.writable || !writable) {
+		cached.refs++
+		return cached.mb, cached.release, nil
+	}
+
+	if writable {
+		if err := os.MkdirAll(downloadDir, os.ModePerm); err != nil {
+			return nil, nil, fmt.Errorf("failed to create directories: %w", err)
+		}
+		mb, err = OpenMBTiles(path)
+	} else {
+		if _, statErr := os.Stat(path); statErr != nil {
+			return nil, func() {}, nil
+		}
+		mb, err = OpenMBTilesReadOnly(path)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A read-only handle is replaced once the export is written to
+	if ok {
+		cached.retire()
+	}
+	handle := &pooledHandle{mb: mb, writable: writable, refs: 1}
+	mbtilesPool[path] = handle
+	return mb, handle.release, nil
+}
+
+// readMBTilesTile looks the tile up in the layer's exported MBTiles file, if one exists
+func readMBTilesTile(layerID string, z, x, y int) ([]byte, error) {
+	mb, release, err := pooledMBTiles(layerID, false)
+	if err != nil || mb == nil {
+		return nil, err
+	}
+	defer release()
+	return mb.GetTile(z, x, y)
+}
+
+// replaceMBTiles moves a finished export from its .part file into place and drops the pooled
+// handle on the old file, which is closed once its readers are done. The pool stays locked
+// throughout, so no read reopens the old file.
+func replaceMBTiles(path string) error {
+	mbtilesPoolMu.Lock()
+	defer mbtilesPoolMu.Unlock()
+
+	if err := os.Rename(path+".part", path); err != nil {
+		return fmt.Errorf("failed to move mbtiles into place: %w", err)
+	}
+	if cached, ok := mbtilesPool[path]; ok {
+		delete(mbtilesPool, path)
+		cached.retire()
+	}
+	return nil
+}
+
+// sendGzippedTile serves pre-compressed tile data, inflating it for clients without gzip support
+func sendGzippedTile(c *fiber.Ctx, data []byte) error {
+	c.Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	c.Vary(fiber.HeaderAcceptEncoding)
+
+	if strings.Contains(c.Get("Accept-Encoding"), "gzip") {
+		c.Set("Content-Encoding", "gzip")
+		return c.Send(data)
+	}
+
+	raw, err := gunzipBytes(data)
+	if err != nil {
+		return err
+	}
+	return c.Send(raw)
+}
+
+func gunzipBytes(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to gunzip tile: %w", err)
+	}
+	defer gz.Close()
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(gz); err != nil {
+		return nil, fmt.Errorf("failed to gunzip tile: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,176 @@
+package tiles
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestFlipY(t *testing.T) {
+	tests := []struct {
+		z, y, want int
+	}{
+		{0, 0, 0},
+		{1, 0, 1},
+		{1, 1, 0},
+		{3, 2, 5},
+		{10, 0, 1023},
+	}
+	for _, tt := range tests {
+		if got := flipY(tt.z, tt.y); got != tt.want {
+			t.Errorf("flipY(%d, %d) = %d, want %d", tt.z, tt.y, got, tt.want)
+		}
+		if got := flipY(tt.z, flipY(tt.z, tt.y)); got != tt.y {
+			t.Errorf("flipY(%d, flipY(%d, %d)) = %d, want %d", tt.z, tt.z, tt.y, got, tt.y)
+		}
+	}
+}
+
+func TestMBTilesRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "layer.mbtiles")
+	mb, err := OpenMBTiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mb.Close()
+
+	tiles := []struct {
+		z, x, y int
+		data    []byte
+	}{
+		{0, 0, 0, []byte("world")},
+		{2, 1, 3, []byte("south")},
+		{2, 1, 0, []byte("north")},
+	}
+	for _, tile := range tiles {
+		if err := mb.PutTile(tile.z, tile.x, tile.y, tile.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tile := range tiles {
+		compressed, err := mb.GetTile(tile.z, tile.x, tile.y)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := gunzipBytes(compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, tile.data) {
+			t.Errorf("tile %d/%d/%d = %q, want %q", tile.z, tile.x, tile.y, data, tile.data)
+		}
+	}
+
+	coords, err := mb.Tiles(2, TileBounds{MinX: 0, MaxX: 3, MinY: 0, MaxY: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(coords) != 2 {
+		t.Fatalf("Tiles(2) = %v, want 2 tiles", coords)
+	}
+	for _, coord := range coords {
+		if coord != (TileCoord{2, 1, 3}) && coord != (TileCoord{2, 1, 0}) {
+			t.Errorf("Tiles(2) returned unexpected tile %v", coord)
+		}
+	}
+	coords, err = mb.Tiles(2, TileBounds{MinX: 1, MaxX: 2, MinY: 2, MaxY: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(coords) != 1 || coords[0] != (TileCoord{2, 1, 3}) {
+		t.Errorf("Tiles(2) within rows 2-3 = %v, want [{2 1 3}]", coords)
+	}
+
+	if err := mb.DeleteTile(2, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := mb.GetTile(2, 1, 3); err != nil || data != nil {
+		t.Errorf("GetTile after DeleteTile = %q, %v, want nil", data, err)
+	}
+
+	zooms, err := mb.Zooms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zooms) != 2 || zooms[0] != 0 || zooms[1] != 2 {
+		t.Errorf("Zooms() = %v, want [0 2]", zooms)
+	}
+}
+
+func TestReplaceMBTiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "layer.mbtiles")
+	write := func(path string, data []byte) {
+		mb, err := OpenMBTiles(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mb.PutTile(0, 0, 0, data); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mb.db.Exec(`PRAGMA journal_mode=DELETE`); err != nil {
+			t.Fatal(err)
+		}
+		if err := mb.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(mb *MBTiles) string {
+		compressed, err := mb.GetTile(0, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := gunzipBytes(compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	write(path, []byte("old"))
+	old, err := OpenMBTilesReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := read(old); got != "old" {
+		t.Fatalf("read-only handle read %q, want %q", got, "old")
+	}
+	if err := old.PutTile(1, 0, 0, []byte("write")); err == nil {
+		t.Error("PutTile on a read-only handle succeeded")
+	}
+
+	// A reader got the handle from the pool before the export is replaced
+	handle := &pooledHandle{mb: old, refs: 1}
+	mbtilesPoolMu.Lock()
+	mbtilesPool[path] = handle
+	mbtilesPoolMu.Unlock()
+
+	write(path+".part", []byte("new"))
+	if err := replaceMBTiles(path); err != nil {
+		t.Fatal(err)
+	}
+
+	mbtilesPoolMu.Lock()
+	_, pooled := mbtilesPool[path]
+	mbtilesPoolMu.Unlock()
+	if pooled {
+		t.Error("replaceMBTiles kept the handle on the old file pooled")
+	}
+
+	if got := read(old); got != "old" {
+		t.Errorf("handle in use read %q after the replacement, want %q", got, "old")
+	}
+	handle.release()
+	if _, err := old.GetTile(0, 0, 0); err == nil {
+		t.Error("the replaced handle is still open after its last reader released it")
+	}
+
+	replaced, err := OpenMBTilesReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replaced.Close()
+	if got := read(replaced); got != "new" {
+		t.Errorf("replaced file read %q, want %q", got, "new")
+	}
+}
@@ -0,0 +1,418 @@
+package tiles
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/khankhulgun/khanmap/maplayer"
+	"github.com/khankhulgun/khanmap/models"
+	"github.com/lambda-platform/lambda/DB"
+	agentUtils "github.com/lambda-platform/lambda/agent/utils"
+)
+
+// OGC API - Features is served under ogcPath for the public and under ogcPermissionPath,
+// behind the login middleware, for the logged in user
+const (
+	ogcPath           = "/ogc"
+	ogcPermissionPath = "/ogc-with-permission"
+
+	defaultOGCLimit = 10
+	maxOGCLimit     = 10000
+
+	crs84 = "http://www.opengis.net/def/crs/OGC/1.3/CRS84"
+)
+
+var ogcConformance = []string{
+	"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/core",
+	"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/geojson",
+}
+
+// OGCLink is a link of an OGC API response
+type OGCLink struct {
+	Href  string `json:"href"`
+	Rel   string `json:"rel"`
+	Type  string `json:"type,omitempty"`
+	Title string `json:"title,omitempty"`
+}
+
+// OGCCollection describes a layer as a feature collection
+type OGCCollection struct {
+	ID          string     `json:"id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description,omitempty"`
+	ItemType    string     `json:"itemType"`
+	CRS         []string   `json:"crs"`
+	Extent      *OGCExtent `json:"extent,omitempty"`
+	Links       []OGCLink  `json:"links"`
+}
+
+// OGCExtent is the spatial and temporal extent of a collection
+type OGCExtent struct {
+	Spatial struct {
+		BBox [][]float64 `json:"bbox"`
+		CRS  string      `json:"crs"`
+	} `json:"spatial"`
+	Temporal *OGCTemporalExtent `json:"temporal,omitempty"`
+}
+
+// OGCTemporalExtent is the time range of a temporal layer, nil ends are open
+type OGCTemporalExtent struct {
+	Interval [][]*time.Time `json:"interval"`
+}
+
+// OGCFeatureCollection is one page of a collection's features
+type OGCFeatureCollection struct {
+	Type           string          `json:"type"`
+	Features       json.RawMessage `json:"features"`
+	NumberMatched  int64           `json:"numberMatched"`
+	NumberReturned int             `json:"numberReturned"`
+	TimeStamp      string          `json:"timeStamp"`
+	Links          []OGCLink       `json:"links"`
+}
+
+// ogcRequest returns the user of an OGC request and the root URL of the API it came through
+func ogcRequest(c *fiber.Ctx) (interface{}, string, error) {
+	if !strings.HasPrefix(c.Path(), ogcPermissionPath) {
+		return nil, publicBaseURL(c) + ogcPath, nil
+	}
+	user, err := agentUtils.AuthUserObject(c)
+	if err != nil {
+		return nil, "", err
+	}
+	return user, publicBaseURL(c) + ogcPermissionPath, nil
+}
+
+// ogcLayer fetches the layer of a collection request and checks the user may read it.
+// On failure it returns the status to respond with.
+func ogcLayer(c *fiber.Ctx) (layer models.MapLayersForTile, user interface{}, root string, status int, err error) {
+	user, root, err = ogcRequest(c)
+	if err != nil {
+		log.Printf("User not found: %v", err)
+		return layer, nil, "", fiber.StatusUnauthorized, errors.New("User not found")
+	}
+
+	layer, err = maplayer.FetchLayerDetails(c.Params("layer"))
+	if err != nil {
+		log.Printf("Layer not found: %v", err)
+		return layer, nil, "", fiber.StatusNotFound, errors.New("Collection not found")
+	}
+	if err := maplayer.CheckLayerAccess(layer, user); err != nil {
+		return layer, nil, "", maplayer.AccessStatus(err), err
+	}
+	return layer, user, root, fiber.StatusOK, nil
+}
+
+// OGCLandingHandler serves the landing page of the OGC API
+func OGCLandingHandler(c *fiber.Ctx) error {
+	_, root, err := ogcRequest(c)
+	if err != nil {
+		log.Printf("User not found: %v", err)
+		return c.Status(fiber.StatusUnauthorized).SendString("User not found")
+	}
+
+	return c.JSON(fiber.Map{
+		"title":       Config.Attribution,
+		"description": "OGC API - Features of the map server layers",
+		"links": []OGCLink{
+			{Href: root, Rel: "self", Type: fiber.MIMEApplicationJSON, Title: "This document"},
+			{Href: root + "/conformance", Rel: "conformance", Type: fiber.MIMEApplicationJSON, Title: "Conformance classes"},
+			{Href: root + "/collections", Rel: "data", Type: fiber.MIMEApplicationJSON, Title: "Feature collections"},
+		},
+	})
+}
+
+// OGCConformanceHandler lists the conformance classes the API implements
+func OGCConformanceHandler(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"conformsTo": ogcConformance})
+}
+
+// OGCCollectionsHandler lists the active layers the user may read as collections.
+// Extents are left out of the list, each collection reports its own.
+func OGCCollectionsHandler(c *fiber.Ctx) error {
+	user, root, err := ogcRequest(c)
+	if err != nil {
+		log.Printf("User not found: %v", err)
+		return c.Status(fiber.StatusUnauthorized).SendString("User not found")
+	}
+
+	var layers []models.MapLayersForTile
+	err = DB.DB.Where("is_active = ?", true).
+		Preload("RolePermissions").
+		Preload("UserPermissions").
+		Order("layer_title ASC").
+		Find(&layers).Error
+	if err != nil {
+		log.Printf("Error retrieving layers: %v", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Error retrieving layers")
+	}
+
+	collections := []OGCCollection{}
+	for _, layer := range layers {
+		if maplayer.CheckLayerAccess(layer, user) == nil {
+			collections = append(collections, ogcCollection(layer, root))
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"collections": collections,
+		"links": []OGCLink{
+			{Href: root + "/collections", Rel: "self", Type: fiber.MIMEApplicationJSON, Title: "This document"},
+		},
+	})
+}
+
+// OGCCollectionHandler describes one layer as a collection with its extent
+func OGCCollectionHandler(c *fiber.Ctx) error {
+	layer, _, root, status, err := ogcLayer(c)
+	if err != nil {
+		return c.Status(status).SendString(err.Error())
+	}
+
+	collection := ogcCollection(layer, root)
+
+	bounds, err := layerBounds(layer, nil, nil)
+	if err != nil {
+		log.Printf("Error calculating bounds: %v", err)
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
+	if bounds != nil {
+		collection.Extent = &OGCExtent{}
+		collection.Extent.Spatial.BBox = [][]float64{bounds}
+		collection.Extent.Spatial.CRS = crs84
+
+		if layer.TimeField != nil && *layer.TimeField != "" {
+			// Permission layers may not be readable without a user, they go without a time extent
+			if timeExtent, err := layerTimeExtent(layer, 1, nil, nil); err != nil {
+				log.Printf("Error calculating time extent: %v", err)
+			} else {
+				collection.Extent.Temporal = &OGCTemporalExtent{Interval: [][]*time.Time{{timeExtent.Min, timeExtent.Max}}}
+			}
+		}
+	}
+
+	return c.JSON(collection)
+}
+
+// ogcCollection describes a layer as a collection without its extent
+func ogcCollection(layer models.MapLayersForTile, root string) OGCCollection {
+	href := root + "/collections/" + layer.ID
+	return OGCCollection{
+		ID:          layer.ID,
+		Title:       layer.LayerTitle,
+		Description: ptrValue(layer.Description),
+		ItemType:    "feature",
+		CRS:         []string{crs84},
+		Links: []OGCLink{
+			{Href: href, Rel: "self", Type: fiber.MIMEApplicationJSON, Title: layer.LayerTitle},
+			{Href: href + "/items", Rel: "items", Type: "application/geo+json", Title: layer.LayerTitle + " features"},
+		},
+	}
+}
+
+// OGCItemsHandler returns one page of a collection's features as GeoJSON.
+// Query params: bbox (lon/lat), limit, offset, datetime; any other params filter the
+// collection's properties.
+func OGCItemsHandler(c *fiber.Ctx) error {
+	layer, user, root, status, err := ogcLayer(c)
+	if err != nil {
+		return c.Status(status).SendString(err.Error())
+	}
+
+	limit, offset := defaultOGCLimit, 0
+	if value := c.Query("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid limit")
+		}
+		limit = min(limit, maxOGCLimit)
+	}
+	if value := c.Query("offset"); value != "" {
+		if offset, err = strconv.Atoi(value); err != nil || offset < 0 {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid offset")
+		}
+	}
+
+	conditions, args, err := ogcConditions(c, layer, user)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	whereClause := "WHERE 1=1 " + strings.Join(conditions, " ")
+
+	var matched int64
+	countSQL := fmt.Sprintf(`SELECT count(*) FROM %s.%s %s`, layer.DbSchema, layer.DbTable, whereClause)
+	if err := DB.DB.Raw(countSQL, args...).Row().Scan(&matched); err != nil {
+		log.Printf("OGC items count error: %v", err)
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
+
+	features, returned, err := ogcFeatures(layer, whereClause+` ORDER BY "`+layer.IDFieldName+`" LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		log.Printf("OGC items error: %v", err)
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
+
+	// Paging links keep the request's params and move the offset
+	itemsURL := root + "/collections/" + layer.ID + "/items"
+	pageURL := func(offset int) string {
+		values := url.Values{}
+		for key, value := range c.Queries() {
+			values.Set(key, value)
+		}
+		values.Set("limit", strconv.Itoa(limit))
+		values.Set("offset", strconv.Itoa(offset))
+		return itemsURL + "?" + values.Encode()
+	}
+	links := []OGCLink{
+		{Href: pageURL(offset), Rel: "self", Type: "application/geo+json", Title: "This page"},
+		{Href: root + "/collections/" + layer.ID, Rel: "collection", Type: fiber.MIMEApplicationJSON, Title: layer.LayerTitle},
+	}
+	if int64(offset+returned) < matched {
+		links = append(links, OGCLink{Href: pageURL(offset + limit), Rel: "next", Type: "application/geo+json", Title: "Next page"})
+	}
+	if offset > 0 {
+		links = append(links, OGCLink{Href: pageURL(max(offset-limit, 0)), Rel: "prev", Type: "application/geo+json", Title: "Previous page"})
+	}
+
+	return c.JSON(OGCFeatureCollection{
+		Type:           "FeatureCollection",
+		Features:       features,
+		NumberMatched:  matched,
+		NumberReturned: returned,
+		TimeStamp:      time.Now().UTC().Format(time.RFC3339),
+		Links:          links,
+	}, "application/geo+json")
+}
+
+// OGCItemHandler returns one feature of a collection by its ID field as GeoJSON
+func OGCItemHandler(c *fiber.Ctx) error {
+	layer, user, root, status, err := ogcLayer(c)
+	if err != nil {
+		return c.Status(status).SendString(err.Error())
+	}
+
+	conditions, args, err := layerConditions(layer, user, nil, nil)
+	if err != nil {
+		return c.Status(maplayer.AccessStatus(err)).SendString(err.Error())
+	}
+	whereClause := fmt.Sprintf(`WHERE "%s" = ? %s`, layer.IDFieldName, strings.Join(conditions, " "))
+
+	features, returned, err := ogcFeatures(layer, whereClause+" LIMIT 1", append([]interface{}{c.Params("id")}, args...)...)
+	if err != nil {
+		log.Printf("OGC item error: %v", err)
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
+	if returned == 0 {
+		return c.Status(fiber.StatusNotFound).SendString("Feature not found")
+	}
+
+	var feature []map[string]interface{}
+	if err := json.Unmarshal(features, &feature); err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
+	href := root + "/collections/" + layer.ID
+	feature[0]["links"] = []OGCLink{
+		{Href: href + "/items/" + url.PathEscape(c.Params("id")), Rel: "self", Type: "application/geo+json", Title: "This feature"},
+		{Href: href, Rel: "collection", Type: fiber.MIMEApplicationJSON, Title: layer.LayerTitle},
+	}
+
+	return c.JSON(feature[0], "application/geo+json")
+}
+
+// ogcConditions returns the WHERE conditions of an items request: the layer's conditions for
+// the user, property filters on the collection's columns, datetime and bbox
+func ogcConditions(c *fiber.Ctx, layer models.MapLayersForTile, user interface{}) ([]string, []interface{}, error) {
+	filters, areaFilters := maplayer.SplitFilters(c.Queries(), "bbox", "bbox-crs", "limit", "offset", "datetime", "f")
+
+	// Only the properties the collection publishes can be filtered on
+	columns := maplayer.LayerColumns(layer, true)
+	for key := range filters {
+		if !slices.Contains(columns, strings.TrimSuffix(key, "__like")) {
+			delete(filters, key)
+		}
+	}
+
+	// datetime is an instant or period, or an interval of them with ".." for an open end
+	if datetime := c.Query("datetime"); datetime != "" {
+		from, to, isInterval := strings.Cut(datetime, "/")
+		if !isInterval {
+			areaFilters["time"] = datetime
+		} else {
+			if from != "" && from != ".." {
+				areaFilters["time_from"] = from
+			}
+			if to != "" && to != ".." {
+				areaFilters["time_to"] = to
+			}
+		}
+	}
+
+	conditions, args, err := layerConditions(layer, user, filters, areaFilters)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if value := c.Query("bbox"); value != "" {
+		parts := strings.Split(value, ",")
+		if len(parts) == 6 {
+			// Drop the heights of a 3D bbox
+			parts = []string{parts[0], parts[1], parts[3], parts[4]}
+		}
+		if len(parts) != 4 {
+			return nil, nil, fmt.Errorf("invalid bbox %q", value)
+		}
+		bbox := make([]interface{}, 4)
+		for i, part := range parts {
+			v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid bbox %q", value)
+			}
+			bbox[i] = v
+		}
+
+		srid := maplayer.LayerSRID(layer.DbSchema, layer.DbTable, layer.GeometryFieldName)
+		envelope := maplayer.TransformSQL("ST_MakeEnvelope(?, ?, ?, ?, 4326)", 4326, srid)
+		conditions = append(conditions, fmt.Sprintf("AND %s && %s AND ST_Intersects(%s, %s)", layer.GeometryFieldName, envelope, layer.GeometryFieldName, envelope))
+		args = append(args, bbox...)
+		args = append(args, bbox...)
+	}
+	return conditions, args, nil
+}
+
+// ogcFeatures selects the layer's rows matching the query tail (WHERE clause, order and limit)
+// as a JSON array of GeoJSON features in lon/lat and returns it with the number of features
+func ogcFeatures(layer models.MapLayersForTile, queryTail string, args ...interface{}) (json.RawMessage, int, error) {
+	srid := maplayer.LayerSRID(layer.DbSchema, layer.DbTable, layer.GeometryFieldName)
+
+	query := `
+		SELECT
+			COALESCE(json_agg(json_build_object(
+				'type', 'Feature',
+				'id', f.ogc_id,
+				'geometry', f.ogc_geometry,
+				'properties', to_jsonb(f) - 'ogc_id' - 'ogc_geometry'
+			) ORDER BY f.ogc_id), '[]')::text,
+			count(*)::int
+		FROM (
+			SELECT
+				"` + layer.IDFieldName + `" AS ogc_id,
+				` + maplayer.ConstructSQLColumns(layer, true) + `,
+				ST_AsGeoJSON(` + maplayer.TransformSQL(layer.GeometryFieldName, srid, 4326) + `)::json AS ogc_geometry
+			FROM ` + layer.DbSchema + `.` + layer.DbTable + `
+			` + queryTail + `
+		) f
+	`
+
+	var features string
+	var count int
+	if err := DB.DB.Raw(query, args...).Row().Scan(&features, &count); err != nil {
+		return nil, 0, err
+	}
+	return json.RawMessage(features), count, nil
+}
@@ -0,0 +1,449 @@
+package tiles
+
+import (
+	"errors"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var errMalformedTile = errors.New("malformed vector tile")
+
+// MVT geometry types and commands
+const (
+	mvtPoint      = 1
+	mvtLineString = 2
+	mvtPolygon    = 3
+
+	mvtMoveTo    = 1
+	mvtLineTo    = 2
+	mvtClosePath = 7
+)
+
+type tilePoint struct {
+	x, y int64
+}
+
+// overzoomTile cuts tile z/x/y out of tile layers that were rendered at a lower zoom.
+// fromZoom maps the name of each such layer to the zoom it was rendered at; its features are
+// scaled up and clipped to the tile and its buffer. Other layers are copied unchanged.
+func overzoomTile(data []byte, z, x, y int, fromZoom map[string]int) ([]byte, error) {
+	var out []byte
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, errMalformedTile
+		}
+		field := data[:n]
+		data = data[n:]
+
+		if num == 3 && typ == protowire.BytesType {
+			layer, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return nil, errMalformedTile
+			}
+			data = data[n:]
+
+			name, extent, err := tileLayerHeader(layer)
+			if err != nil {
+				return nil, err
+			}
+			if parentZoom, ok := fromZoom[name]; ok && parentZoom < z {
+				dz := z - parentZoom
+				mask := 1<<dz - 1
+				if layer, err = overzoomLayer(layer, dz, int64(x&mask), int64(y&mask), extent); err != nil {
+					return nil, err
+				}
+			}
+			out = protowire.AppendTag(out, 3, protowire.BytesType)
+			out = protowire.AppendBytes(out, layer)
+			continue
+		}
+
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return nil, errMalformedTile
+		}
+		out = append(out, field...)
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return out, nil
+}
+
+// tileLayerHeader returns the name and extent of an encoded tile layer
+func tileLayerHeader(data []byte) (string, int64, error) {
+	name, extent := "", int64(4096)
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return "", 0, errMalformedTile
+		}
+		data = data[n:]
+
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			value, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return "", 0, errMalformedTile
+			}
+			name = value
+			data = data[n:]
+		case num == 5 && typ == protowire.VarintType:
+			value, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return "", 0, errMalformedTile
+			}
+			extent = int64(value)
+			data = data[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return "", 0, errMalformedTile
+			}
+			data = data[n:]
+		}
+	}
+	return name, extent, nil
+}
+
+// overzoomLayer scales the features of a layer up by 2^dz around the child tile cx/cy of the
+// 2^dz by 2^dz children of the layer's tile, dropping features that end up outside of it
+func overzoomLayer(data []byte, dz int, cx, cy, extent int64) ([]byte, error) {
+	buffer := extent * tileExtent / tileSize
+	box := clipBox{minX: -buffer, minY: -buffer, maxX: extent + buffer, maxY: extent + buffer}
+	scale := func(p tilePoint) tilePoint {
+		return tilePoint{p.x<<dz - cx*extent, p.y<<dz - cy*extent}
+	}
+
+	var out []byte
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, errMalformedTile
+		}
+		field := data[:n]
+		data = data[n:]
+
+		if num == 2 && typ == protowire.BytesType {
+			feature, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return nil, errMalformedTile
+			}
+			data = data[n:]
+
+			feature, err := overzoomFeature(feature, scale, box)
+			if err != nil {
+				return nil, err
+			}
+			if feature != nil {
+				out = protowire.AppendTag(out, 2, protowire.BytesType)
+				out = protowire.AppendBytes(out, feature)
+			}
+			continue
+		}
+
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return nil, errMalformedTile
+		}
+		out = append(out, field...)
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return out, nil
+}
+
+// overzoomFeature rewrites the geometry of an encoded feature, or returns nil when nothing
+// of it is left inside the clip box
+func overzoomFeature(data []byte, scale func(tilePoint) tilePoint, box clipBox) ([]byte, error) {
+	var geomType uint64
+	var commands []uint64
+	var fields []byte
+
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, errMalformedTile
+		}
+		field := data[:n]
+		data = data[n:]
+
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return nil, errMalformedTile
+		}
+		value := data[:n]
+		data = data[n:]
+
+		switch {
+		case num == 3 && typ == protowire.VarintType:
+			geomType, _ = protowire.ConsumeVarint(value)
+		case num == 4 && typ == protowire.BytesType:
+			packed, _ := protowire.ConsumeBytes(value)
+			for len(packed) > 0 {
+				v, n := protowire.ConsumeVarint(packed)
+				if n < 0 {
+					return nil, errMalformedTile
+				}
+				commands = append(commands, v)
+				packed = packed[n:]
+			}
+			continue
+		}
+		fields = append(fields, field...)
+		fields = append(fields, value...)
+	}
+
+	var parts [][]tilePoint
+	for _, part := range decodeTileGeometry(commands) {
+		for i := range part {
+			part[i] = scale(part[i])
+		}
+		switch geomType {
+		case mvtPoint:
+			var inside []tilePoint
+			for _, p := range part {
+				if box.contains(p) {
+					inside = append(inside, p)
+				}
+			}
+			if len(inside) > 0 {
+				parts = append(parts, inside)
+			}
+		case mvtLineString:
+			parts = append(parts, box.clipLine(part)...)
+		case mvtPolygon:
+			if ring := box.clipRing(part); ring != nil {
+				parts = append(parts, ring)
+			}
+		}
+	}
+	if len(parts) == 0 {
+		return nil, nil
+	}
+
+	var packed []byte
+	for _, v := range encodeTileGeometry(geomType, parts) {
+		packed = protowire.AppendVarint(packed, v)
+	}
+	fields = protowire.AppendTag(fields, 4, protowire.BytesType)
+	fields = protowire.AppendBytes(fields, packed)
+	return fields, nil
+}
+
+// decodeTileGeometry runs a command stream into its parts: the points of a multipoint,
+// the lines of a multilinestring or the rings of a (multi)polygon without closing points
+func decodeTileGeometry(commands []uint64) [][]tilePoint {
+	var parts [][]tilePoint
+	var current []tilePoint
+	var x, y int64
+
+	for i := 0; i < len(commands); {
+		command, count := commands[i]&0x7, int(commands[i]>>3)
+		i++
+
+		switch command {
+		case mvtMoveTo, mvtLineTo:
+			for j := 0; j < count && i+1 < len(commands); j++ {
+				x += protowire.DecodeZigZag(commands[i])
+				y += protowire.DecodeZigZag(commands[i+1])
+				i += 2
+				if command == mvtMoveTo && len(current) > 0 && count == 1 {
+					parts = append(parts, current)
+					current = nil
+				}
+				current = append(current, tilePoint{x, y})
+			}
+		case mvtClosePath:
+		default:
+			return parts
+		}
+	}
+	if len(current) > 0 {
+		parts = append(parts, current)
+	}
+	return parts
+}
+
+// encodeTileGeometry writes the parts of a geometry as a command stream
+func encodeTileGeometry(geomType uint64, parts [][]tilePoint) []uint64 {
+	var commands []uint64
+	var cursor tilePoint
+	moveTo := func(points []tilePoint, command uint64) {
+		commands = append(commands, command|uint64(len(points))<<3)
+		for _, p := range points {
+			commands = append(commands, protowire.EncodeZigZag(p.x-cursor.x), protowire.EncodeZigZag(p.y-cursor.y))
+			cursor = p
+		}
+	}
+
+	for _, part := range parts {
+		if geomType == mvtPoint {
+			moveTo(part, mvtMoveTo)
+			continue
+		}
+		moveTo(part[:1], mvtMoveTo)
+		moveTo(part[1:], mvtLineTo)
+		if geomType == mvtPolygon {
+			commands = append(commands, mvtClosePath|1<<3)
+		}
+	}
+	return commands
+}
+
+// clipBox is the tile with its buffer in tile coordinates
+type clipBox struct {
+	minX, minY, maxX, maxY int64
+}
+
+func (b clipBox) contains(p tilePoint) bool {
+	return p.x >= b.minX && p.x <= b.maxX && p.y >= b.minY && p.y <= b.maxY
+}
+
+// clipLine cuts a line into the parts that run inside the box
+func (b clipBox) clipLine(line []tilePoint) [][]tilePoint {
+	var parts [][]tilePoint
+	var current []tilePoint
+	flush := func() {
+		if current = dedupPoints(current); len(current) >= 2 {
+			parts = append(parts, current)
+		}
+		current = nil
+	}
+
+	for i := 0; i+1 < len(line); i++ {
+		start, end, ok := b.clipSegment(line[i], line[i+1])
+		if !ok {
+			flush()
+			continue
+		}
+		if len(current) == 0 || current[len(current)-1] != start {
+			flush()
+			current = []tilePoint{start}
+		}
+		current = append(current, end)
+		if end != line[i+1] {
+			flush()
+		}
+	}
+	flush()
+	return parts
+}
+
+// clipSegment clips segment a-b to the box with the Liang-Barsky algorithm
+func (b clipBox) clipSegment(a, c tilePoint) (tilePoint, tilePoint, bool) {
+	dx, dy := float64(c.x-a.x), float64(c.y-a.y)
+	t0, t1 := 0.0, 1.0
+	for _, edge := range [4][2]float64{
+		{-dx, float64(a.x - b.minX)},
+		{dx, float64(b.maxX - a.x)},
+		{-dy, float64(a.y - b.minY)},
+		{dy, float64(b.maxY - a.y)},
+	} {
+		p, q := edge[0], edge[1]
+		if p == 0 {
+			if q < 0 {
+				return a, c, false
+			}
+			continue
+		}
+		t := q / p
+		if p < 0 {
+			t0 = math.Max(t0, t)
+		} else {
+			t1 = math.Min(t1, t)
+		}
+		if t0 > t1 {
+			return a, c, false
+		}
+	}
+
+	at := func(t float64) tilePoint {
+		return tilePoint{a.x + int64(math.Round(t*dx)), a.y + int64(math.Round(t*dy))}
+	}
+	start, end := a, c
+	if t0 > 0 {
+		start = at(t0)
+	}
+	if t1 < 1 {
+		end = at(t1)
+	}
+	return start, end, true
+}
+
+// clipRing clips a polygon ring to the box with the Sutherland-Hodgman algorithm.
+// It returns nil when no area is left.
+func (b clipBox) clipRing(ring []tilePoint) []tilePoint {
+	edges := []struct {
+		inside    func(p tilePoint) bool
+		intersect func(p, q tilePoint) tilePoint
+	}{
+		{func(p tilePoint) bool { return p.x >= b.minX }, func(p, q tilePoint) tilePoint { return atX(p, q, b.minX) }},
+		{func(p tilePoint) bool { return p.x <= b.maxX }, func(p, q tilePoint) tilePoint { return atX(p, q, b.maxX) }},
+		{func(p tilePoint) bool { return p.y >= b.minY }, func(p, q tilePoint) tilePoint { return atY(p, q, b.minY) }},
+		{func(p tilePoint) bool { return p.y <= b.maxY }, func(p, q tilePoint) tilePoint { return atY(p, q, b.maxY) }},
+	}
+
+	for _, edge := range edges {
+		if len(ring) == 0 {
+			return nil
+		}
+		var clipped []tilePoint
+		prev := ring[len(ring)-1]
+		for _, p := range ring {
+			switch {
+			case edge.inside(p):
+				if !edge.inside(prev) {
+					clipped = append(clipped, edge.intersect(prev, p))
+				}
+				clipped = append(clipped, p)
+			case edge.inside(prev):
+				clipped = append(clipped, edge.intersect(prev, p))
+			}
+			prev = p
+		}
+		ring = clipped
+	}
+
+	if ring = dedupPoints(ring); len(ring) > 1 && ring[0] == ring[len(ring)-1] {
+		ring = ring[:len(ring)-1]
+	}
+	if len(ring) < 3 || ringArea(ring) == 0 {
+		return nil
+	}
+	return ring
+}
+
+// atX returns the point of segment p-q at x
+func atX(p, q tilePoint, x int64) tilePoint {
+	t := float64(x-p.x) / float64(q.x-p.x)
+	return tilePoint{x, p.y + int64(math.Round(t*float64(q.y-p.y)))}
+}
+
+// atY returns the point of segment p-q at y
+func atY(p, q tilePoint, y int64) tilePoint {
+	t := float64(y-p.y) / float64(q.y-p.y)
+	return tilePoint{p.x + int64(math.Round(t*float64(q.x-p.x))), y}
+}
+
+// dedupPoints drops consecutive repeated points
+func dedupPoints(points []tilePoint) []tilePoint {
+	var out []tilePoint
+	for _, p := range points {
+		if len(out) == 0 || out[len(out)-1] != p {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// ringArea returns twice the signed area of a ring
+func ringArea(ring []tilePoint) int64 {
+	var area int64
+	for i, p := range ring {
+		q := ring[(i+1)%len(ring)]
+		area += p.x*q.y - q.x*p.y
+	}
+	return area
+}
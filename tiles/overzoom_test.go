@@ -0,0 +1,267 @@
+package tiles
+
+import (
+	"bytes"
+	"reflect"
+	"slices"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// testFeature is a decoded tile feature
+type testFeature struct {
+	id       uint64
+	geomType uint64
+	parts    [][]tilePoint
+}
+
+func encodeTestLayer(name string, extent uint64, features []testFeature) []byte {
+	var layer []byte
+	layer = protowire.AppendTag(layer, 15, protowire.VarintType)
+	layer = protowire.AppendVarint(layer, 2)
+	layer = protowire.AppendTag(layer, 1, protowire.BytesType)
+	layer = protowire.AppendString(layer, name)
+	for _, f := range features {
+		var feature []byte
+		feature = protowire.AppendTag(feature, 1, protowire.VarintType)
+		feature = protowire.AppendVarint(feature, f.id)
+		feature = protowire.AppendTag(feature, 3, protowire.VarintType)
+		feature = protowire.AppendVarint(feature, f.geomType)
+		var packed []byte
+		for _, v := range encodeTileGeometry(f.geomType, f.parts) {
+			packed = protowire.AppendVarint(packed, v)
+		}
+		feature = protowire.AppendTag(feature, 4, protowire.BytesType)
+		feature = protowire.AppendBytes(feature, packed)
+
+		layer = protowire.AppendTag(layer, 2, protowire.BytesType)
+		layer = protowire.AppendBytes(layer, feature)
+	}
+	layer = protowire.AppendTag(layer, 5, protowire.VarintType)
+	layer = protowire.AppendVarint(layer, extent)
+
+	var tile []byte
+	tile = protowire.AppendTag(tile, 3, protowire.BytesType)
+	return protowire.AppendBytes(tile, layer)
+}
+
+// decodeTestTile returns the features of each layer of a tile
+func decodeTestTile(t *testing.T, data []byte) map[string][]testFeature {
+	t.Helper()
+	each := func(data []byte, fn func(num protowire.Number, value []byte)) {
+		for len(data) > 0 {
+			num, typ, n := protowire.ConsumeTag(data)
+			if n < 0 {
+				t.Fatal("malformed tag")
+			}
+			data = data[n:]
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				t.Fatal("malformed field")
+			}
+			fn(num, data[:n])
+			data = data[n:]
+		}
+	}
+
+	layers := make(map[string][]testFeature)
+	each(data, func(num protowire.Number, value []byte) {
+		layer, _ := protowire.ConsumeBytes(value)
+		name, _, err := tileLayerHeader(layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		features := []testFeature{}
+		each(layer, func(num protowire.Number, value []byte) {
+			if num != 2 {
+				return
+			}
+			feature, _ := protowire.ConsumeBytes(value)
+			var f testFeature
+			each(feature, func(num protowire.Number, value []byte) {
+				switch num {
+				case 1:
+					f.id, _ = protowire.ConsumeVarint(value)
+				case 3:
+					f.geomType, _ = protowire.ConsumeVarint(value)
+				case 4:
+					packed, _ := protowire.ConsumeBytes(value)
+					var commands []uint64
+					for len(packed) > 0 {
+						v, n := protowire.ConsumeVarint(packed)
+						commands = append(commands, v)
+						packed = packed[n:]
+					}
+					f.parts = decodeTileGeometry(commands)
+				}
+			})
+			features = append(features, f)
+		})
+		layers[name] = features
+	})
+	return layers
+}
+
+func TestOverzoomTile(t *testing.T) {
+	// The layer was rendered at z10 on tile 0/0; z11 tile 1/0 is its top right quarter, which
+	// maps parent coordinates p to 2p - (4096, 0) and keeps a 256 unit buffer around it
+	features := []testFeature{
+		{1, mvtPoint, [][]tilePoint{{{3000, 1000}}}},
+		{2, mvtPoint, [][]tilePoint{{{500, 500}}}},
+		{3, mvtPoint, [][]tilePoint{{{3000, 1000}}, {{100, 100}}}},
+		{4, mvtLineString, [][]tilePoint{{{1024, 1024}, {3072, 1024}}}},
+		{5, mvtLineString, [][]tilePoint{{{100, 3000}, {1000, 3000}}}},
+		{6, mvtPolygon, [][]tilePoint{{{1024, 1024}, {3072, 1024}, {3072, 3072}, {1024, 3072}}}},
+		{7, mvtPolygon, [][]tilePoint{{{100, 100}, {200, 100}, {200, 200}, {100, 200}}}},
+	}
+	other := []testFeature{{9, mvtPoint, [][]tilePoint{{{500, 500}}}}}
+
+	parent := append(encodeTestLayer("public.roads", 4096, features), encodeTestLayer("public.other", 4096, other)...)
+	out, err := overzoomTile(parent, 11, 1, 0, map[string]int{"public.roads": 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers := decodeTestTile(t, out)
+
+	want := []testFeature{
+		{1, mvtPoint, [][]tilePoint{{{1904, 2000}}}},
+		{3, mvtPoint, [][]tilePoint{{{1904, 2000}}}},
+		{4, mvtLineString, [][]tilePoint{{{-256, 2048}, {2048, 2048}}}},
+	}
+	got := layers["public.roads"]
+	if len(got) != 4 || !reflect.DeepEqual(got[:3], want) {
+		t.Fatalf("overzoomed features = %v, want %v and a polygon", got, want)
+	}
+
+	polygon := got[3]
+	if polygon.id != 6 || polygon.geomType != mvtPolygon || len(polygon.parts) != 1 {
+		t.Fatalf("overzoomed polygon = %v", polygon)
+	}
+	ring := polygon.parts[0]
+	for _, corner := range []tilePoint{{-256, 2048}, {2048, 2048}, {2048, 4352}, {-256, 4352}} {
+		if !slices.Contains(ring, corner) {
+			t.Errorf("clipped polygon %v is missing corner %v", ring, corner)
+		}
+	}
+	if area := ringArea(ring); area != 2*2304*2304 && area != -2*2304*2304 {
+		t.Errorf("clipped polygon %v has twice the area %d, want %d", ring, area, 2*2304*2304)
+	}
+
+	if !reflect.DeepEqual(layers["public.other"], other) {
+		t.Errorf("layer without a parent zoom = %v, want it unchanged", layers["public.other"])
+	}
+}
+
+func TestOverzoomTileUnchanged(t *testing.T) {
+	data := encodeTestLayer("public.roads", 4096, []testFeature{
+		{1, mvtPoint, [][]tilePoint{{{500, 500}}}},
+	})
+	for _, fromZoom := range []map[string]int{nil, {"public.roads": 11}, {"public.roads": 12}} {
+		out, err := overzoomTile(data, 11, 1, 0, fromZoom)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("overzoomTile with %v changed a layer rendered at the tile's zoom", fromZoom)
+		}
+	}
+}
+
+func TestOverzoomTileMalformed(t *testing.T) {
+	for _, data := range [][]byte{{0xff}, {0x1a, 0x05, 0x0a}} {
+		if _, err := overzoomTile(data, 11, 1, 0, map[string]int{"public.roads": 10}); err == nil {
+			t.Errorf("overzoomTile(%x) accepted a malformed tile", data)
+		}
+	}
+}
+
+func TestClipLine(t *testing.T) {
+	box := clipBox{minX: 0, minY: 0, maxX: 10, maxY: 10}
+	tests := []struct {
+		name string
+		line []tilePoint
+		want [][]tilePoint
+	}{
+		{"inside", []tilePoint{{1, 1}, {5, 5}, {9, 1}}, [][]tilePoint{{{1, 1}, {5, 5}, {9, 1}}}},
+		{"outside", []tilePoint{{-5, -5}, {-1, 20}}, nil},
+		{"crossing", []tilePoint{{-10, 5}, {20, 5}}, [][]tilePoint{{{0, 5}, {10, 5}}}},
+		{"leaving and returning", []tilePoint{{-5, 5}, {5, 5}, {5, 15}, {8, 15}, {8, 5}},
+			[][]tilePoint{{{0, 5}, {5, 5}, {5, 10}}, {{8, 10}, {8, 5}}}},
+		{"along an edge", []tilePoint{{0, -5}, {0, 15}}, [][]tilePoint{{{0, 0}, {0, 10}}}},
+		{"touching a corner", []tilePoint{{-5, 5}, {5, -5}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := box.clipLine(tt.line); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("clipLine(%v) = %v, want %v", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClipRing(t *testing.T) {
+	box := clipBox{minX: 0, minY: 0, maxX: 10, maxY: 10}
+	tests := []struct {
+		name string
+		ring []tilePoint
+		want []tilePoint
+	}{
+		{"inside", []tilePoint{{1, 1}, {9, 1}, {5, 9}}, []tilePoint{{1, 1}, {9, 1}, {5, 9}}},
+		{"outside", []tilePoint{{20, 20}, {30, 20}, {25, 30}}, nil},
+		{"covering", []tilePoint{{-5, -5}, {15, -5}, {15, 15}, {-5, 15}}, []tilePoint{{0, 0}, {10, 0}, {10, 10}, {0, 10}}},
+		{"half", []tilePoint{{5, -5}, {15, -5}, {15, 15}, {5, 15}}, []tilePoint{{5, 0}, {10, 0}, {10, 10}, {5, 10}}},
+		{"touching an edge", []tilePoint{{10, 2}, {15, 2}, {15, 8}, {10, 8}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := box.clipRing(tt.ring)
+			if tt.want == nil {
+				if got != nil {
+					t.Errorf("clipRing(%v) = %v, want nil", tt.ring, got)
+				}
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("clipRing(%v) = %v, want %v", tt.ring, got, tt.want)
+			}
+			for _, p := range tt.want {
+				if !slices.Contains(got, p) {
+					t.Errorf("clipRing(%v) = %v, missing %v", tt.ring, got, p)
+				}
+			}
+			if ringArea(got) != ringArea(tt.want) {
+				t.Errorf("clipRing(%v) = %v, which changed the ring's orientation or area", tt.ring, got)
+			}
+		})
+	}
+}
+
+func TestTileGeometryRoundTrip(t *testing.T) {
+	tests := []struct {
+		geomType uint64
+		parts    [][]tilePoint
+	}{
+		{mvtPoint, [][]tilePoint{{{25, 17}}}},
+		{mvtPoint, [][]tilePoint{{{5, 7}, {3, 2}}}},
+		{mvtLineString, [][]tilePoint{{{2, 2}, {2, 10}, {10, 10}}}},
+		{mvtLineString, [][]tilePoint{{{2, 2}, {2, 10}}, {{1, 1}, {3, 5}}}},
+		{mvtPolygon, [][]tilePoint{{{3, 6}, {8, 12}, {20, 34}}}},
+		{mvtPolygon, [][]tilePoint{{{0, 0}, {10, 0}, {10, 10}, {0, 10}}, {{11, 11}, {20, 11}, {20, 20}, {11, 20}}}},
+		{mvtLineString, [][]tilePoint{{{-300, -300}, {4400, 4400}}}},
+	}
+	for _, tt := range tests {
+		got := decodeTileGeometry(encodeTileGeometry(tt.geomType, tt.parts))
+		if !reflect.DeepEqual(got, tt.parts) {
+			t.Errorf("decodeTileGeometry(encodeTileGeometry(%d, %v)) = %v", tt.geomType, tt.parts, got)
+		}
+	}
+
+	// The example geometries of the vector tile spec
+	if got := encodeTileGeometry(mvtPoint, [][]tilePoint{{{25, 17}}}); !reflect.DeepEqual(got, []uint64{9, 50, 34}) {
+		t.Errorf("encoded point = %v, want [9 50 34]", got)
+	}
+	if got := encodeTileGeometry(mvtPolygon, [][]tilePoint{{{3, 6}, {8, 12}, {20, 34}}}); !reflect.DeepEqual(got, []uint64{9, 6, 12, 18, 10, 12, 24, 44, 15}) {
+		t.Errorf("encoded polygon = %v, want [9 6 12 18 10 12 24 44 15]", got)
+	}
+}
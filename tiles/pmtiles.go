@@ -0,0 +1,663 @@
+package tiles
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/khankhulgun/khanmap/models"
+)
+
+// PMTiles v3 constants, see https://github.com/protomaps/PMTiles/blob/main/spec/v3/spec.md
+const (
+	pmtilesHeaderLen   = 127
+	pmtilesRootMaxLen  = 16384 - pmtilesHeaderLen
+	pmtilesCompNone    = 1
+	pmtilesCompGzip    = 2
+	pmtilesTileTypeMVT = 1
+	pmtilesMaxDepth    = 4
+)
+
+type pmtilesEntry struct {
+	TileID    uint64
+	Offset    uint64
+	Length    uint32
+	RunLength uint32
+}
+
+type pmtilesHeader struct {
+	RootOffset          uint64
+	RootLength          uint64
+	MetadataOffset      uint64
+	MetadataLength      uint64
+	LeafOffset          uint64
+	LeafLength          uint64
+	TileDataOffset      uint64
+	TileDataLength      uint64
+	AddressedTilesCount uint64
+	TileEntriesCount    uint64
+	TileContentsCount   uint64
+	Clustered           bool
+	InternalCompression uint8
+	TileCompression     uint8
+	TileType            uint8
+	MinZoom             uint8
+	MaxZoom             uint8
+	MinLonE7            int32
+	MinLatE7            int32
+	MaxLonE7            int32
+	MaxLatE7            int32
+	CenterZoom          uint8
+	CenterLonE7         int32
+	CenterLatE7         int32
+}
+
+// zxyToTileID maps tile coordinates onto the PMTiles Hilbert curve ordering
+func zxyToTileID(z uint8, x, y uint32) uint64 {
+	var acc uint64
+	for t := uint8(0); t < z; t++ {
+		acc += (1 << t) * (1 << t)
+	}
+
+	n := uint64(1) << z
+	tx, ty := uint64(x), uint64(y)
+	var d uint64
+	for s := n / 2; s > 0; s /= 2 {
+		var rx, ry uint64
+		if tx&s > 0 {
+			rx = 1
+		}
+		if ty&s > 0 {
+			ry = 1
+		}
+		d += s * s * ((3 * rx) ^ ry)
+		// Rotate the quadrant
+		if ry == 0 {
+			if rx == 1 {
+				tx = s - 1 - tx
+				ty = s - 1 - ty
+			}
+			tx, ty = ty, tx
+		}
+	}
+	return acc + d
+}
+
+// tileIDToZxy maps a PMTiles tile ID back onto its tile coordinates
+func tileIDToZxy(id uint64) (uint8, uint32, uint32) {
+	var acc uint64
+	z := uint8(0)
+	for ; z < 32; z++ {
+		count := (uint64(1) << z) * (uint64(1) << z)
+		if id < acc+count {
+			break
+		}
+		acc += count
+	}
+
+	n := uint64(1) << z
+	t := id - acc
+	var tx, ty uint64
+	for s := uint64(1); s < n; s *= 2 {
+		rx := 1 & (t / 2)
+		ry := 1 & (t ^ rx)
+		// Rotate the quadrant
+		if ry == 0 {
+			if rx == 1 {
+				tx = s - 1 - tx
+				ty = s - 1 - ty
+			}
+			tx, ty = ty, tx
+		}
+		tx += s * rx
+		ty += s * ry
+		t /= 4
+	}
+	return z, uint32(tx), uint32(ty)
+}
+
+func serializeDirectory(entries []pmtilesEntry) ([]byte, error) {
+	var b []byte
+	b = binary.AppendUvarint(b, uint64(len(entries)))
+
+	var lastID uint64
+	for _, e := range entries {
+		b = binary.AppendUvarint(b, e.TileID-lastID)
+		lastID = e.TileID
+	}
+	for _, e := range entries {
+		b = binary.AppendUvarint(b, uint64(e.RunLength))
+	}
+	for _, e := range entries {
+		b = binary.AppendUvarint(b, uint64(e.Length))
+	}
+	for i, e := range entries {
+		// Offsets contiguous with the previous entry are stored as 0
+		if i > 0 && e.Offset == entries[i-1].Offset+uint64(entries[i-1].Length) {
+			b = binary.AppendUvarint(b, 0)
+		} else {
+			b = binary.AppendUvarint(b, e.Offset+1)
+		}
+	}
+
+	return gzipBytes(b)
+}
+
+func deserializeDirectory(data []byte) ([]pmtilesEntry, error) {
+	raw, err := gunzipBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(raw)
+
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pmtiles directory: %w", err)
+	}
+	entries := make([]pmtilesEntry, count)
+
+	var lastID uint64
+	for i := range entries {
+		delta, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pmtiles directory: %w", err)
+		}
+		lastID += delta
+		entries[i].TileID = lastID
+	}
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pmtiles directory: %w", err)
+		}
+		entries[i].RunLength = uint32(v)
+	}
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pmtiles directory: %w", err)
+		}
+		entries[i].Length = uint32(v)
+	}
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pmtiles directory: %w", err)
+		}
+		if v == 0 && i > 0 {
+			entries[i].Offset = entries[i-1].Offset + uint64(entries[i-1].Length)
+		} else {
+			entries[i].Offset = v - 1
+		}
+	}
+
+	return entries, nil
+}
+
+// buildDirectories returns a root directory that fits the first 16K of the archive,
+// spilling entries into leaf directories when needed
+func buildDirectories(entries []pmtilesEntry) (root []byte, leaves []byte, err error) {
+	root, err = serializeDirectory(entries)
+	if err != nil || len(root) <= pmtilesRootMaxLen {
+		return root, nil, err
+	}
+
+	leafSize := float64(len(entries)) / 3500
+	if leafSize < 4096 {
+		leafSize = 4096
+	}
+
+	for {
+		var rootEntries []pmtilesEntry
+		leaves = nil
+		for i := 0; i < len(entries); i += int(leafSize) {
+			end := i + int(leafSize)
+			if end > len(entries) {
+				end = len(entries)
+			}
+			leaf, err := serializeDirectory(entries[i:end])
+			if err != nil {
+				return nil, nil, err
+			}
+			rootEntries = append(rootEntries, pmtilesEntry{
+				TileID: entries[i].TileID,
+				Offset: uint64(len(leaves)),
+				Length: uint32(len(leaf)),
+			})
+			leaves = append(leaves, leaf...)
+		}
+
+		root, err = serializeDirectory(rootEntries)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(root) <= pmtilesRootMaxLen {
+			return root, leaves, nil
+		}
+		leafSize *= 1.2
+	}
+}
+
+func (h pmtilesHeader) bytes() []byte {
+	b := make([]byte, pmtilesHeaderLen)
+	copy(b[0:7], "PMTiles")
+	b[7] = 3
+	binary.LittleEndian.PutUint64(b[8:], h.RootOffset)
+	binary.LittleEndian.PutUint64(b[16:], h.RootLength)
+	binary.LittleEndian.PutUint64(b[24:], h.MetadataOffset)
+	binary.LittleEndian.PutUint64(b[32:], h.MetadataLength)
+	binary.LittleEndian.PutUint64(b[40:], h.LeafOffset)
+	binary.LittleEndian.PutUint64(b[48:], h.LeafLength)
+	binary.LittleEndian.PutUint64(b[56:], h.TileDataOffset)
+	binary.LittleEndian.PutUint64(b[64:], h.TileDataLength)
+	binary.LittleEndian.PutUint64(b[72:], h.AddressedTilesCount)
+	binary.LittleEndian.PutUint64(b[80:], h.TileEntriesCount)
+	binary.LittleEndian.PutUint64(b[88:], h.TileContentsCount)
+	if h.Clustered {
+		b[96] = 1
+	}
+	b[97] = h.InternalCompression
+	b[98] = h.TileCompression
+	b[99] = h.TileType
+	b[100] = h.MinZoom
+	b[101] = h.MaxZoom
+	binary.LittleEndian.PutUint32(b[102:], uint32(h.MinLonE7))
+	binary.LittleEndian.PutUint32(b[106:], uint32(h.MinLatE7))
+	binary.LittleEndian.PutUint32(b[110:], uint32(h.MaxLonE7))
+	binary.LittleEndian.PutUint32(b[114:], uint32(h.MaxLatE7))
+	b[118] = h.CenterZoom
+	binary.LittleEndian.PutUint32(b[119:], uint32(h.CenterLonE7))
+	binary.LittleEndian.PutUint32(b[123:], uint32(h.CenterLatE7))
+	return b
+}
+
+func parsePMTilesHeader(b []byte) (pmtilesHeader, error) {
+	var h pmtilesHeader
+	if len(b) < pmtilesHeaderLen || string(b[0:7]) != "PMTiles" {
+		return h, errors.New("not a pmtiles archive")
+	}
+	if b[7] != 3 {
+		return h, fmt.Errorf("unsupported pmtiles version %d", b[7])
+	}
+	h.RootOffset = binary.LittleEndian.Uint64(b[8:])
+	h.RootLength = binary.LittleEndian.Uint64(b[16:])
+	h.MetadataOffset = binary.LittleEndian.Uint64(b[24:])
+	h.MetadataLength = binary.LittleEndian.Uint64(b[32:])
+	h.LeafOffset = binary.LittleEndian.Uint64(b[40:])
+	h.LeafLength = binary.LittleEndian.Uint64(b[48:])
+	h.TileDataOffset = binary.LittleEndian.Uint64(b[56:])
+	h.TileDataLength = binary.LittleEndian.Uint64(b[64:])
+	h.AddressedTilesCount = binary.LittleEndian.Uint64(b[72:])
+	h.TileEntriesCount = binary.LittleEndian.Uint64(b[80:])
+	h.TileContentsCount = binary.LittleEndian.Uint64(b[88:])
+	h.Clustered = b[96] == 1
+	h.InternalCompression = b[97]
+	h.TileCompression = b[98]
+	h.TileType = b[99]
+	h.MinZoom = b[100]
+	h.MaxZoom = b[101]
+	h.MinLonE7 = int32(binary.LittleEndian.Uint32(b[102:]))
+	h.MinLatE7 = int32(binary.LittleEndian.Uint32(b[106:]))
+	h.MaxLonE7 = int32(binary.LittleEndian.Uint32(b[110:]))
+	h.MaxLatE7 = int32(binary.LittleEndian.Uint32(b[114:]))
+	h.CenterZoom = b[118]
+	h.CenterLonE7 = int32(binary.LittleEndian.Uint32(b[119:]))
+	h.CenterLatE7 = int32(binary.LittleEndian.Uint32(b[123:]))
+	return h, nil
+}
+
+// PMTilesWriter collects tiles into a temporary data file and assembles a
+// clustered PMTiles v3 archive on Finalize. Identical tiles are stored once.
+type PMTilesWriter struct {
+	data      *os.File
+	offset    uint64
+	entries   []pmtilesEntry
+	contents  map[[sha256.Size]byte]pmtilesEntry
+	addressed uint64
+	minZoom   int
+	maxZoom   int
+}
+
+func NewPMTilesWriter(tmpDir string) (*PMTilesWriter, error) {
+	data, err := os.CreateTemp(tmpDir, "pmtiles-data-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pmtiles temp file: %w", err)
+	}
+	return &PMTilesWriter{
+		data:     data,
+		contents: make(map[[sha256.Size]byte]pmtilesEntry),
+		minZoom:  -1,
+	}, nil
+}
+
+// PutTile gzips and appends a tile, reusing the stored bytes of an identical tile
+func (w *PMTilesWriter) PutTile(z, x, y int, tile []byte) error {
+	if len(tile) == 0 {
+		// Empty tiles are simply not addressed
+		return nil
+	}
+
+	tileID := zxyToTileID(uint8(z), uint32(x), uint32(y))
+	hash := sha256.Sum256(tile)
+	w.addressed++
+	if w.minZoom < 0 || z < w.minZoom {
+		w.minZoom = z
+	}
+	if z > w.maxZoom {
+		w.maxZoom = z
+	}
+
+	if existing, ok := w.contents[hash]; ok {
+		w.entries = append(w.entries, pmtilesEntry{TileID: tileID, Offset: existing.Offset, Length: existing.Length, RunLength: 1})
+		return nil
+	}
+
+	compressed, err := gzipBytes(tile)
+	if err != nil {
+		return err
+	}
+	if _, err := w.data.Write(compressed); err != nil {
+		return fmt.Errorf("failed to buffer pmtiles tile: %w", err)
+	}
+
+	entry := pmtilesEntry{TileID: tileID, Offset: w.offset, Length: uint32(len(compressed)), RunLength: 1}
+	w.contents[hash] = entry
+	w.entries = append(w.entries, entry)
+	w.offset += uint64(len(compressed))
+	return nil
+}
+
+// Abort discards the buffered tile data
+func (w *PMTilesWriter) Abort() {
+	w.data.Close()
+	os.Remove(w.data.Name())
+}
+
+// Finalize writes the archive to path and removes the temporary data file
+func (w *PMTilesWriter) Finalize(path string, bbox *BoundingBox, metadata map[string]interface{}) error {
+	defer w.Abort()
+
+	sort.Slice(w.entries, func(i, j int) bool { return w.entries[i].TileID < w.entries[j].TileID })
+
+	// Re-lay tile contents in tile ID order so the archive is clustered
+	out, err := os.CreateTemp(os.TempDir(), "pmtiles-clustered-*")
+	if err != nil {
+		return fmt.Errorf("failed to create pmtiles temp file: %w", err)
+	}
+	defer func() {
+		out.Close()
+		os.Remove(out.Name())
+	}()
+
+	remapped := make(map[uint64]uint64)
+	var dataLen uint64
+	var entries []pmtilesEntry
+	for _, e := range w.entries {
+		newOffset, ok := remapped[e.Offset]
+		if !ok {
+			buf := make([]byte, e.Length)
+			if _, err := w.data.ReadAt(buf, int64(e.Offset)); err != nil {
+				return fmt.Errorf("failed to read buffered tile: %w", err)
+			}
+			if _, err := out.Write(buf); err != nil {
+				return fmt.Errorf("failed to write pmtiles tile data: %w", err)
+			}
+			newOffset = dataLen
+			remapped[e.Offset] = newOffset
+			dataLen += uint64(e.Length)
+		}
+
+		// Merge consecutive tile IDs pointing at the same contents into a run
+		if n := len(entries); n > 0 && entries[n-1].Offset == newOffset && entries[n-1].TileID+uint64(entries[n-1].RunLength) == e.TileID {
+			entries[n-1].RunLength++
+			continue
+		}
+		entries = append(entries, pmtilesEntry{TileID: e.TileID, Offset: newOffset, Length: e.Length, RunLength: 1})
+	}
+
+	root, leaves, err := buildDirectories(entries)
+	if err != nil {
+		return err
+	}
+
+	metaJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to encode pmtiles metadata: %w", err)
+	}
+	meta, err := gzipBytes(metaJSON)
+	if err != nil {
+		return err
+	}
+
+	minZoom, maxZoom := w.minZoom, w.maxZoom
+	if minZoom < 0 {
+		minZoom = 0
+	}
+
+	h := pmtilesHeader{
+		RootOffset:          pmtilesHeaderLen,
+		RootLength:          uint64(len(root)),
+		MetadataOffset:      pmtilesHeaderLen + uint64(len(root)),
+		MetadataLength:      uint64(len(meta)),
+		AddressedTilesCount: w.addressed,
+		TileEntriesCount:    uint64(len(entries)),
+		TileContentsCount:   uint64(len(remapped)),
+		Clustered:           true,
+		InternalCompression: pmtilesCompGzip,
+		TileCompression:     pmtilesCompGzip,
+		TileType:            pmtilesTileTypeMVT,
+		MinZoom:             uint8(minZoom),
+		MaxZoom:             uint8(maxZoom),
+		MinLonE7:            int32(bbox.MinLon * 1e7),
+		MinLatE7:            int32(bbox.MinLat * 1e7),
+		MaxLonE7:            int32(bbox.MaxLon * 1e7),
+		MaxLatE7:            int32(bbox.MaxLat * 1e7),
+		CenterZoom:          uint8(minZoom),
+		CenterLonE7:         int32((bbox.MinLon + bbox.MaxLon) / 2 * 1e7),
+		CenterLatE7:         int32((bbox.MinLat + bbox.MaxLat) / 2 * 1e7),
+	}
+	h.LeafOffset = h.MetadataOffset + h.MetadataLength
+	h.LeafLength = uint64(len(leaves))
+	h.TileDataOffset = h.LeafOffset + h.LeafLength
+	h.TileDataLength = dataLen
+
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create pmtiles file: %w", err)
+	}
+	for _, part := range [][]byte{h.bytes(), root, meta, leaves} {
+		if _, err := f.Write(part); err != nil {
+			f.Close()
+			os.Remove(tmpPath)
+			return fmt.Errorf("failed to write pmtiles file: %w", err)
+		}
+	}
+	if _, err := out.Seek(0, io.SeekStart); err == nil {
+		_, err = io.Copy(f, out)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write pmtiles tile data: %w", err)
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// pmtilesArchive is an open archive with its header and root directory parsed.
+// refs counts the readers using it; an archive dropped from the pool is closed once the last
+// of them releases it.
+type pmtilesArchive struct {
+	file    *os.File
+	header  pmtilesHeader
+	root    []pmtilesEntry
+	modTime time.Time
+	refs    int
+	retired bool
+}
+
+var (
+	// pmtilesPool caches open archives by path; entries are reopened when the file changes
+	pmtilesPool = make(map[string]*pmtilesArchive)
+
+	// pmtilesPoolMu guards the pool and the reader counts of its archives
+	pmtilesPoolMu sync.Mutex
+)
+
+// release gives back an archive returned by openPMTiles
+func (a *pmtilesArchive) release() {
+	pmtilesPoolMu.Lock()
+	defer pmtilesPoolMu.Unlock()
+	a.refs--
+	if a.retired && a.refs == 0 {
+		a.file.Close()
+	}
+}
+
+// openPMTiles returns the pooled archive at path, which the caller gives back with release
+// once it is done. An archive whose file was replaced is reopened, and the handle on the old
+// file is closed once its readers are done.
+func openPMTiles(path string) (archive *pmtilesArchive, release func(), err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pmtilesPoolMu.Lock()
+	defer pmtilesPoolMu.Unlock()
+
+	cached, ok := pmtilesPool[path]
+	if ok && cached.modTime.Equal(info.ModTime()) {
+		cached.refs++
+		return cached, cached.release, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	headerBytes := make([]byte, pmtilesHeaderLen)
+	if _, err := f.ReadAt(headerBytes, 0); err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("failed to read pmtiles header: %w", err)
+	}
+	header, err := parsePMTilesHeader(headerBytes)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	archive = &pmtilesArchive{file: f, header: header, modTime: info.ModTime(), refs: 1}
+	archive.root, err = archive.readDirectory(header.RootOffset, header.RootLength)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	// Readers holding the previous archive finish on the old file before it is closed
+	if ok {
+		cached.retired = true
+		if cached.refs == 0 {
+			cached.file.Close()
+		}
+	}
+	pmtilesPool[path] = archive
+	return archive, archive.release, nil
+}
+
+func (a *pmtilesArchive) readDirectory(offset, length uint64) ([]pmtilesEntry, error) {
+	buf := make([]byte, length)
+	if _, err := a.file.ReadAt(buf, int64(offset)); err != nil {
+		return nil, fmt.Errorf("failed to read pmtiles directory: %w", err)
+	}
+	return deserializeDirectory(buf)
+}
+
+// findEntry binary-searches a directory for the tile or for the leaf that may contain it
+func findEntry(entries []pmtilesEntry, tileID uint64) (pmtilesEntry, bool) {
+	lo, hi := 0, len(entries)-1
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		switch {
+		case tileID > entries[mid].TileID:
+			lo = mid + 1
+		case tileID < entries[mid].TileID:
+			hi = mid - 1
+		default:
+			return entries[mid], true
+		}
+	}
+
+	if hi >= 0 {
+		e := entries[hi]
+		if e.RunLength == 0 || tileID-e.TileID < uint64(e.RunLength) {
+			return e, true
+		}
+	}
+	return pmtilesEntry{}, false
+}
+
+// GetTile returns the stored (compressed) tile bytes, or nil when the archive does not address it
+func (a *pmtilesArchive) GetTile(z, x, y int) ([]byte, error) {
+	tileID := zxyToTileID(uint8(z), uint32(x), uint32(y))
+	dir := a.root
+
+	for depth := 0; depth < pmtilesMaxDepth; depth++ {
+		entry, ok := findEntry(dir, tileID)
+		if !ok {
+			return nil, nil
+		}
+
+		if entry.RunLength > 0 {
+			buf := make([]byte, entry.Length)
+			if _, err := a.file.ReadAt(buf, int64(a.header.TileDataOffset+entry.Offset)); err != nil {
+				return nil, fmt.Errorf("failed to read pmtiles tile: %w", err)
+			}
+			return buf, nil
+		}
+
+		leaf, err := a.readDirectory(a.header.LeafOffset+entry.Offset, uint64(entry.Length))
+		if err != nil {
+			return nil, err
+		}
+		dir = leaf
+	}
+
+	return nil, errors.New("pmtiles directory nesting too deep")
+}
+
+// pmtilesPath returns the export location for a layer's PMTiles archive
+func pmtilesPath(layerID string) string {
+	return fmt.Sprintf("%s/%s.pmtiles", downloadDir, layerID)
+}
+
+// readPMTilesTile looks the tile up in the layer's exported PMTiles archive, if one exists
+func readPMTilesTile(layerID string, z, x, y int) ([]byte, uint8, error) {
+	archive, release, err := openPMTiles(pmtilesPath(layerID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	defer release()
+
+	data, err := archive.GetTile(z, x, y)
+	return data, archive.header.TileCompression, err
+}
+
+// CreatePMTiles seeds every tile of the layer into a single PMTiles v3 archive under downloadDir
+func CreatePMTiles(layer models.MapLayersForTile) error {
+	return createTilesAs(layer, "pmtiles")
+}
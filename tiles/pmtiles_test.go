@@ -0,0 +1,338 @@
+package tiles
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestZxyToTileID(t *testing.T) {
+	tests := []struct {
+		z    uint8
+		x, y uint32
+		want uint64
+	}{
+		{0, 0, 0, 0},
+		{1, 0, 0, 1},
+		{1, 0, 1, 2},
+		{1, 1, 1, 3},
+		{1, 1, 0, 4},
+		{2, 0, 0, 5},
+		{2, 3, 0, 20},
+		{3, 0, 0, 21},
+		{20, 0, 0, 366503875925},
+	}
+	for _, tt := range tests {
+		if got := zxyToTileID(tt.z, tt.x, tt.y); got != tt.want {
+			t.Errorf("zxyToTileID(%d, %d, %d) = %d, want %d", tt.z, tt.x, tt.y, got, tt.want)
+		}
+		z, x, y := tileIDToZxy(tt.want)
+		if z != tt.z || x != tt.x || y != tt.y {
+			t.Errorf("tileIDToZxy(%d) = %d/%d/%d, want %d/%d/%d", tt.want, z, x, y, tt.z, tt.x, tt.y)
+		}
+	}
+}
+
+func TestTileIDRoundTrip(t *testing.T) {
+	for z := uint8(0); z <= 6; z++ {
+		seen := make(map[uint64]bool)
+		n := uint32(1) << z
+		for x := uint32(0); x < n; x++ {
+			for y := uint32(0); y < n; y++ {
+				id := zxyToTileID(z, x, y)
+				if seen[id] {
+					t.Fatalf("zxyToTileID(%d, %d, %d) = %d, which is taken", z, x, y, id)
+				}
+				seen[id] = true
+
+				gotZ, gotX, gotY := tileIDToZxy(id)
+				if gotZ != z || gotX != x || gotY != y {
+					t.Fatalf("tileIDToZxy(%d) = %d/%d/%d, want %d/%d/%d", id, gotZ, gotX, gotY, z, x, y)
+				}
+			}
+		}
+	}
+}
+
+func TestDirectoryRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []pmtilesEntry
+	}{
+		{"empty", []pmtilesEntry{}},
+		{"single", []pmtilesEntry{{TileID: 0, Offset: 0, Length: 100, RunLength: 1}}},
+		{"contiguous", []pmtilesEntry{
+			{TileID: 1, Offset: 0, Length: 10, RunLength: 1},
+			{TileID: 2, Offset: 10, Length: 20, RunLength: 1},
+			{TileID: 3, Offset: 30, Length: 5, RunLength: 1},
+		}},
+		{"runs and shared contents", []pmtilesEntry{
+			{TileID: 5, Offset: 0, Length: 10, RunLength: 3},
+			{TileID: 8, Offset: 10, Length: 7, RunLength: 1},
+			{TileID: 9, Offset: 0, Length: 10, RunLength: 12},
+			{TileID: 1000, Offset: 17, Length: 1, RunLength: 1},
+		}},
+		{"leaf pointers", []pmtilesEntry{
+			{TileID: 0, Offset: 0, Length: 4000, RunLength: 0},
+			{TileID: 70000, Offset: 4000, Length: 3500, RunLength: 0},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := serializeDirectory(tt.entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := deserializeDirectory(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.entries) {
+				t.Errorf("deserializeDirectory(serializeDirectory(%v)) = %v", tt.entries, got)
+			}
+		})
+	}
+}
+
+func TestDeserializeDirectoryTruncated(t *testing.T) {
+	data, err := gzipBytes([]byte{3, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deserializeDirectory(data); err == nil {
+		t.Error("deserializeDirectory accepted a truncated directory")
+	}
+}
+
+func TestBuildDirectoriesLeaves(t *testing.T) {
+	// Scattered offsets keep the root from compressing below its limit
+	var entries []pmtilesEntry
+	for i := uint64(0); i < 60000; i++ {
+		entries = append(entries, pmtilesEntry{TileID: i * 3, Offset: i * 7919 % 1000003, Length: uint32(i%500 + 1), RunLength: 1})
+	}
+
+	root, leaves, err := buildDirectories(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(root) > pmtilesRootMaxLen {
+		t.Fatalf("root directory is %d bytes, over %d", len(root), pmtilesRootMaxLen)
+	}
+	if len(leaves) == 0 {
+		t.Fatal("expected the entries to spill into leaf directories")
+	}
+
+	rootEntries, err := deserializeDirectory(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []pmtilesEntry{entries[0], entries[12345], entries[len(entries)-1]} {
+		leafEntry, ok := findEntry(rootEntries, want.TileID)
+		if !ok || leafEntry.RunLength != 0 {
+			t.Fatalf("findEntry(root, %d) = %v, %v, want a leaf", want.TileID, leafEntry, ok)
+		}
+		leaf, err := deserializeDirectory(leaves[leafEntry.Offset : leafEntry.Offset+uint64(leafEntry.Length)])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := findEntry(leaf, want.TileID); !ok || got != want {
+			t.Errorf("findEntry(leaf, %d) = %v, %v, want %v", want.TileID, got, ok, want)
+		}
+	}
+}
+
+func TestFindEntry(t *testing.T) {
+	entries := []pmtilesEntry{
+		{TileID: 5, Offset: 0, Length: 10, RunLength: 3},
+		{TileID: 10, Offset: 10, Length: 10, RunLength: 1},
+		{TileID: 20, Offset: 20, Length: 10, RunLength: 0},
+	}
+	tests := []struct {
+		tileID uint64
+		want   int
+	}{
+		{4, -1},
+		{5, 0},
+		{7, 0},
+		{8, -1},
+		{10, 1},
+		{11, -1},
+		{20, 2},
+		{1 << 40, 2},
+	}
+	for _, tt := range tests {
+		got, ok := findEntry(entries, tt.tileID)
+		switch {
+		case tt.want < 0 && ok:
+			t.Errorf("findEntry(%d) = %v, want none", tt.tileID, got)
+		case tt.want >= 0 && (!ok || got != entries[tt.want]):
+			t.Errorf("findEntry(%d) = %v, %v, want %v", tt.tileID, got, ok, entries[tt.want])
+		}
+	}
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	h := pmtilesHeader{
+		RootOffset:          pmtilesHeaderLen,
+		RootLength:          300,
+		MetadataOffset:      427,
+		MetadataLength:      50,
+		LeafOffset:          477,
+		LeafLength:          0,
+		TileDataOffset:      477,
+		TileDataLength:      123456,
+		AddressedTilesCount: 40,
+		TileEntriesCount:    30,
+		TileContentsCount:   20,
+		Clustered:           true,
+		InternalCompression: pmtilesCompGzip,
+		TileCompression:     pmtilesCompGzip,
+		TileType:            pmtilesTileTypeMVT,
+		MinZoom:             2,
+		MaxZoom:             14,
+		MinLonE7:            875000000,
+		MinLatE7:            415000000,
+		MaxLonE7:            1201000000,
+		MaxLatE7:            521000000,
+		CenterZoom:          2,
+		CenterLonE7:         1038000000,
+		CenterLatE7:         -468000000,
+	}
+	got, err := parsePMTilesHeader(h.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != h {
+		t.Errorf("parsePMTilesHeader(h.bytes()) = %+v, want %+v", got, h)
+	}
+
+	if _, err := parsePMTilesHeader([]byte("not an archive")); err == nil {
+		t.Error("parsePMTilesHeader accepted a short buffer")
+	}
+	b := h.bytes()
+	b[7] = 2
+	if _, err := parsePMTilesHeader(b); err == nil {
+		t.Error("parsePMTilesHeader accepted version 2")
+	}
+}
+
+func TestPMTilesWriterRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewPMTilesWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tiles := map[TileCoord][]byte{
+		{0, 0, 0}: []byte("world"),
+		{1, 0, 0}: []byte("sea"),
+		{1, 0, 1}: []byte("sea"),
+		{1, 1, 1}: []byte("sea"),
+		{1, 1, 0}: []byte("land"),
+		{3, 5, 2}: []byte("island"),
+	}
+	for coord, data := range tiles {
+		if err := w.PutTile(coord.Z, coord.X, coord.Y, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.PutTile(2, 0, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "layer.pmtiles")
+	if err := w.Finalize(path, &BoundingBox{MinLon: 87, MinLat: 41, MaxLon: 120, MaxLat: 52}, map[string]interface{}{"name": "layer"}); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, release, err := openPMTiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if archive.header.AddressedTilesCount != 6 || archive.header.TileContentsCount != 4 {
+		t.Errorf("archive addresses %d tiles with %d contents, want 6 and 4",
+			archive.header.AddressedTilesCount, archive.header.TileContentsCount)
+	}
+	if archive.header.MinZoom != 0 || archive.header.MaxZoom != 3 {
+		t.Errorf("archive zooms %d-%d, want 0-3", archive.header.MinZoom, archive.header.MaxZoom)
+	}
+
+	for coord, want := range tiles {
+		compressed, err := archive.GetTile(coord.Z, coord.X, coord.Y)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := gunzipBytes(compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("tile %v = %q, want %q", coord, data, want)
+		}
+	}
+
+	for _, coord := range []TileCoord{{2, 0, 0}, {3, 5, 3}, {4, 0, 0}} {
+		if data, err := archive.GetTile(coord.Z, coord.X, coord.Y); err != nil || data != nil {
+			t.Errorf("missing tile %v = %q, %v, want nil", coord, data, err)
+		}
+	}
+}
+
+func TestOpenPMTilesReplaced(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "layer.pmtiles")
+	write := func(data []byte, modTime time.Time) {
+		w, err := NewPMTilesWriter(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.PutTile(0, 0, 0, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Finalize(path, &BoundingBox{MinLon: 87, MinLat: 41, MaxLon: 120, MaxLat: 52}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(archive *pmtilesArchive) string {
+		compressed, err := archive.GetTile(0, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := gunzipBytes(compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	write([]byte("old"), time.Now().Add(-time.Hour))
+	old, releaseOld, err := openPMTiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write([]byte("new"), time.Now())
+	replaced, releaseReplaced, err := openPMTiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseReplaced()
+	if got := read(replaced); got != "new" {
+		t.Errorf("replaced archive read %q, want %q", got, "new")
+	}
+
+	if got := read(old); got != "old" {
+		t.Errorf("archive in use read %q after the replacement, want %q", got, "old")
+	}
+	releaseOld()
+	if _, err := old.GetTile(0, 0, 0); err == nil {
+		t.Error("the replaced archive is still open after its last reader released it")
+	}
+}
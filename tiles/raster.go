@@ -0,0 +1,119 @@
+package tiles
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/khankhulgun/khanmap/maplayer"
+	"github.com/khankhulgun/khanmap/metrics"
+	"github.com/khankhulgun/khanmap/models"
+	"github.com/khankhulgun/khanmap/render"
+	agentUtils "github.com/lambda-platform/lambda/agent/utils"
+)
+
+// renderRasterTile draws the layer's vector tile into a PNG using the layer's legends.
+// Label anchors are not drawn, raster tiles carry no text.
+func renderRasterTile(mvtData []byte, layer models.MapLayersForTile, pixelRatio int) ([]byte, error) {
+	layers, err := render.DecodeMVT(mvtData)
+	if err != nil {
+		return nil, err
+	}
+
+	legends, err := maplayer.FetchLayerLegends(layer.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	style := render.Style{LayerID: layer.ID, Legends: legends, ClusterSteps: clusterSettings(layer).Steps}
+	if layer.UniqueValueField != nil {
+		style.UniqueValueField = *layer.UniqueValueField
+	}
+	if aggregation := layer.Aggregation.Settings(); aggregation.Enabled(layer.GeometryType) {
+		style.AggregationSteps = aggregation.Steps
+	}
+
+	size := 256 * pixelRatio
+	canvas := render.NewCanvas(size, size, float64(pixelRatio))
+	labelLayer := models.LabelLayerName(layer.DbSchema + "." + layer.DbTable)
+	for _, tileLayer := range layers {
+		if tileLayer.Name == labelLayer {
+			continue
+		}
+		canvas.DrawLayer(tileLayer, style, render.Transform{TileSize: float64(size)})
+	}
+	return canvas.EncodePNG()
+}
+
+func rasterHandler(layer models.MapLayersForTile, user interface{}, filters map[string]string, areaFilters map[string]string, pixelRatio int) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if err := maplayer.CheckLayerAccess(layer, user); err != nil {
+			c.Set("Cache-Control", "no-store")
+			return c.SendStatus(maplayer.AccessStatus(err))
+		}
+
+		z, x, y, err := parseTileParams(c)
+		if err != nil {
+			log.Printf("Invalid tile parameters: %v", err)
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid tile parameters")
+		}
+
+		key := tileCacheKey([]string{layer.ID}, layerTileVersion(layer), z, x, y, filters, areaFilters, tileScope(layer, user))
+		pngData, err := cachedTile(c.UserContext(), fmt.Sprintf("png@%d|%s", pixelRatio, key), func(ctx context.Context) ([]byte, error) {
+			mvtData, err := cachedTile(ctx, key, func(ctx context.Context) ([]byte, error) {
+				return getVectorTile(ctx, z, x, y, layer, user, filters, areaFilters)
+			})
+			if err != nil {
+				return nil, err
+			}
+			return renderRasterTile(mvtData, layer, pixelRatio)
+		})
+		if err != nil {
+			// An empty tile is no image, timed out raster tiles always get a 503
+			return sendTileError(c, "layer "+layer.ID, metrics.TileTimeouts.WithLabelValues(layer.ID), err, false)
+		}
+
+		return sendCached(c, pngData, "image/png", cacheMaxAge(layer), tileScope(layer, user) == "public", false)
+	}
+}
+
+// rasterRequest splits the query into tile filters and the requested pixel ratio (scale=2 for retina)
+func rasterRequest(c *fiber.Ctx) (filters map[string]string, areaFilters map[string]string, pixelRatio int) {
+	filters, areaFilters = maplayer.SplitFilters(c.Queries(), "scale")
+	pixelRatio = 1
+	if c.Query("scale") == "2" {
+		pixelRatio = 2
+	}
+	return
+}
+
+// RasterTileHandler renders a public layer's tile as PNG
+func RasterTileHandler(c *fiber.Ctx) error {
+	layerDetails, err := maplayer.FetchLayerDetails(c.Params("layer"))
+	if err != nil {
+		log.Printf("Layer not found: %v", err)
+		return c.Status(fiber.StatusNotFound).SendString("Layer not found")
+	}
+
+	filters, areaFilters, pixelRatio := rasterRequest(c)
+	return rasterHandler(layerDetails, nil, filters, areaFilters, pixelRatio)(c)
+}
+
+// RasterTileHandlerWithPermission renders a layer's tile as PNG for the logged in user
+func RasterTileHandlerWithPermission(c *fiber.Ctx) error {
+	user, err := agentUtils.AuthUserObject(c)
+	if err != nil {
+		log.Printf("User not found: %v", err)
+		return c.Status(fiber.StatusUnauthorized).SendString("User not found")
+	}
+
+	layerDetails, err := maplayer.FetchLayerDetails(c.Params("layer"))
+	if err != nil {
+		log.Printf("Layer not found: %v", err)
+		return c.Status(fiber.StatusNotFound).SendString("Layer not found")
+	}
+
+	filters, areaFilters, pixelRatio := rasterRequest(c)
+	return rasterHandler(layerDetails, user, filters, areaFilters, pixelRatio)(c)
+}
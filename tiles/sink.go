@@ -0,0 +1,169 @@
+package tiles
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/khankhulgun/khanmap/models"
+)
+
+// tileSink is the destination a seeding job writes tiles into
+type tileSink interface {
+	Has(z, x, y int) bool
+	Put(z, x, y int, data []byte) error
+	// Close finishes the output; complete is false when the job stopped early
+	Close(complete bool) error
+}
+
+func newTileSink(format string, layer models.MapLayersForTile, bbox *BoundingBox, fromZoom, toZoom int) (tileSink, error) {
+	if err := os.MkdirAll(downloadDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create directories: %w", err)
+	}
+
+	switch format {
+	case "files", "":
+		store, err := getTileStore()
+		if err != nil {
+			return nil, err
+		}
+		return &storeSink{store: store, layerID: layer.ID}, nil
+	case "mbtiles":
+		return newMBTilesSink(layer, bbox, fromZoom, toZoom)
+	case "pmtiles":
+		return newPMTilesSink(layer, bbox, fromZoom, toZoom)
+	}
+	return nil, fmt.Errorf("unsupported tile format %q", format)
+}
+
+// storeSink writes the layer's tiles into the configured TileStore
+type storeSink struct {
+	store   TileStore
+	layerID string
+}
+
+func (s *storeSink) Has(z, x, y int) bool {
+	data, err := s.store.Get(s.layerID, z, x, y)
+	return err == nil && data != nil
+}
+
+func (s *storeSink) Put(z, x, y int, data []byte) error {
+	return s.store.Put(s.layerID, z, x, y, data)
+}
+
+func (s *storeSink) Close(complete bool) error {
+	return nil
+}
+
+// mbtilesSink fills a .part file that replaces the layer's MBTiles export once the job completes
+type mbtilesSink struct {
+	mb   *MBTiles
+	path string
+}
+
+func newMBTilesSink(layer models.MapLayersForTile, bbox *BoundingBox, fromZoom, toZoom int) (*mbtilesSink, error) {
+	path := mbtilesPath(layer.ID)
+	mb, err := OpenMBTiles(path + ".part")
+	if err != nil {
+		return nil, err
+	}
+
+	err = mb.SetMetadata(map[string]string{
+		"name":        layer.LayerTitle,
+		"description": ptrValue(layer.Description),
+		"format":      "pbf",
+		"type":        "overlay",
+		"version":     "1",
+		"bounds":      fmt.Sprintf("%f,%f,%f,%f", bbox.MinLon, bbox.MinLat, bbox.MaxLon, bbox.MaxLat),
+		"center":      fmt.Sprintf("%f,%f,%d", (bbox.MinLon+bbox.MaxLon)/2, (bbox.MinLat+bbox.MaxLat)/2, fromZoom),
+		"minzoom":     fmt.Sprint(fromZoom),
+		"maxzoom":     fmt.Sprint(toZoom),
+		"json":        vectorLayersJSON(layer, fromZoom, toZoom),
+	})
+	if err != nil {
+		mb.Close()
+		return nil, err
+	}
+
+	return &mbtilesSink{mb: mb, path: path}, nil
+}
+
+func (s *mbtilesSink) Has(z, x, y int) bool {
+	data, err := s.mb.GetTile(z, x, y)
+	return err == nil && data != nil
+}
+
+func (s *mbtilesSink) Put(z, x, y int, data []byte) error {
+	return s.mb.PutTile(z, x, y, data)
+}
+
+func (s *mbtilesSink) Close(complete bool) error {
+	if complete {
+		// The finished export is a single file, which read-only handles open without a WAL
+		if _, err := s.mb.db.Exec(`PRAGMA journal_mode=DELETE`); err != nil {
+			s.mb.Close()
+			return fmt.Errorf("failed to finish mbtiles: %w", err)
+		}
+	}
+	if err := s.mb.Close(); err != nil {
+		return err
+	}
+	if !complete {
+		// Keep the partial file so a resumed job continues where it stopped
+		return nil
+	}
+	return replaceMBTiles(s.path)
+}
+
+// pmtilesSink buffers tiles for a PMTiles archive. Archives cannot be appended to,
+// so an interrupted job starts over.
+type pmtilesSink struct {
+	mu       sync.Mutex
+	writer   *PMTilesWriter
+	layer    models.MapLayersForTile
+	bbox     *BoundingBox
+	fromZoom int
+	toZoom   int
+}
+
+func newPMTilesSink(layer models.MapLayersForTile, bbox *BoundingBox, fromZoom, toZoom int) (*pmtilesSink, error) {
+	writer, err := NewPMTilesWriter(downloadDir)
+	if err != nil {
+		return nil, err
+	}
+	return &pmtilesSink{writer: writer, layer: layer, bbox: bbox, fromZoom: fromZoom, toZoom: toZoom}, nil
+}
+
+func (s *pmtilesSink) Has(z, x, y int) bool {
+	return false
+}
+
+func (s *pmtilesSink) Put(z, x, y int, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writer.PutTile(z, x, y, data)
+}
+
+func (s *pmtilesSink) Close(complete bool) error {
+	if !complete {
+		s.writer.Abort()
+		return nil
+	}
+
+	metadata := map[string]interface{}{
+		"name":          s.layer.LayerTitle,
+		"description":   ptrValue(s.layer.Description),
+		"type":          "overlay",
+		"vector_layers": layerVectorLayers(s.layer, s.layer.DbSchema+"."+s.layer.DbTable, s.fromZoom, s.toZoom),
+	}
+	return s.writer.Finalize(pmtilesPath(s.layer.ID), s.bbox, metadata)
+}
+
+// vectorLayersJSON returns the MBTiles "json" metadata value describing the layer's attributes
+func vectorLayersJSON(layer models.MapLayersForTile, fromZoom, toZoom int) string {
+	data, _ := json.Marshal(map[string]interface{}{
+		"vector_layers": layerVectorLayers(layer, layer.DbSchema+"."+layer.DbTable, fromZoom, toZoom),
+	})
+	return string(data)
+}
@@ -0,0 +1,331 @@
+package tiles
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// TileCoord addresses one tile in the XYZ scheme
+type TileCoord struct {
+	Z, X, Y int
+}
+
+// TileBounds is a range of tile columns and rows of one zoom, inclusive
+type TileBounds struct {
+	MinX, MaxX, MinY, MaxY int
+}
+
+// Contains reports whether tile column x and row y lie in the bounds
+func (b TileBounds) Contains(x, y int) bool {
+	return x >= b.MinX && x <= b.MaxX && y >= b.MinY && y <= b.MaxY
+}
+
+// TileStore keeps the saved tiles of layers. Tiles go in and come out as plain MVT bytes.
+type TileStore interface {
+	// Get returns the tile, or nil when it is not saved
+	Get(layerID string, z, x, y int) ([]byte, error)
+	Put(layerID string, z, x, y int, data []byte) error
+	// Delete removes the tile; deleting a missing tile is not an error
+	Delete(layerID string, z, x, y int) error
+	// Zooms returns the zoom levels the layer has saved tiles at
+	Zooms(layerID string) ([]int, error)
+	// List returns the saved tiles of the layer at zoom z within bounds
+	List(layerID string, z int, bounds TileBounds) ([]TileCoord, error)
+}
+
+// s3ColumnListLimit is the widest range of columns an S3 store lists column by column.
+// Wider ranges are found by listing the whole zoom level.
+const s3ColumnListLimit = 64
+
+var (
+	tileStore     TileStore
+	tileStoreErr  error
+	tileStoreOnce sync.Once
+)
+
+// getTileStore builds the backend selected by TILE_STORE on first use
+func getTileStore() (TileStore, error) {
+	tileStoreOnce.Do(func() {
+		switch Config.Store {
+		case "fs", "":
+			tileStore = &fsTileStore{dir: Config.StoreDir}
+		case "mbtiles":
+			tileStore = &mbtilesTileStore{}
+		case "s3":
+			tileStore, tileStoreErr = newS3TileStore()
+		default:
+			tileStoreErr = fmt.Errorf("unknown TILE_STORE backend %q", Config.Store)
+		}
+		if tileStoreErr != nil {
+			log.Printf("Tile store unavailable: %v", tileStoreErr)
+		}
+	})
+	return tileStore, tileStoreErr
+}
+
+// fsTileStore keeps loose <layer>/z/x/y.pbf files under dir
+type fsTileStore struct {
+	dir string
+}
+
+func (s *fsTileStore) path(layerID string, z, x, y int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s/%d/%d/%d.pbf", layerID, z, x, y))
+}
+
+func (s *fsTileStore) Get(layerID string, z, x, y int) ([]byte, error) {
+	data, err := os.ReadFile(s.path(layerID, z, x, y))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *fsTileStore) Put(layerID string, z, x, y int, data []byte) error {
+	filePath := s.path(layerID, z, x, y)
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directories: %w", err)
+	}
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		return fmt.Errorf("failed to save tile: %w", err)
+	}
+	return nil
+}
+
+func (s *fsTileStore) Delete(layerID string, z, x, y int) error {
+	err := os.Remove(s.path(layerID, z, x, y))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *fsTileStore) Zooms(layerID string) ([]int, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, layerID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var zooms []int
+	for _, entry := range entries {
+		if z, err := strconv.Atoi(entry.Name()); err == nil && entry.IsDir() {
+			zooms = append(zooms, z)
+		}
+	}
+	return zooms, nil
+}
+
+func (s *fsTileStore) List(layerID string, z int, bounds TileBounds) ([]TileCoord, error) {
+	zoomDir := filepath.Join(s.dir, layerID, strconv.Itoa(z))
+	columns, err := os.ReadDir(zoomDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the columns within bounds are read
+	var coords []TileCoord
+	for _, column := range columns {
+		x, err := strconv.Atoi(column.Name())
+		if err != nil || !column.IsDir() || x < bounds.MinX || x > bounds.MaxX {
+			continue
+		}
+		rows, err := os.ReadDir(filepath.Join(zoomDir, column.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			if y, err := strconv.Atoi(strings.TrimSuffix(row.Name(), ".pbf")); err == nil && bounds.Contains(x, y) {
+				coords = append(coords, TileCoord{z, x, y})
+			}
+		}
+	}
+	return coords, nil
+}
+
+// mbtilesTileStore keeps each layer's tiles in its MBTiles export, created on first Put
+type mbtilesTileStore struct{}
+
+// open returns the layer's pooled MBTiles file and its release, or nil when the file does not
+// exist and writable is false
+func (s *mbtilesTileStore) open(layerID string, writable bool) (*MBTiles, func(), error) {
+	return pooledMBTiles(layerID, writable)
+}
+
+func (s *mbtilesTileStore) Get(layerID string, z, x, y int) ([]byte, error) {
+	mb, release, err := s.open(layerID, false)
+	if err != nil || mb == nil {
+		return nil, err
+	}
+	defer release()
+	data, err := mb.GetTile(z, x, y)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return gunzipBytes(data)
+}
+
+func (s *mbtilesTileStore) Put(layerID string, z, x, y int, data []byte) error {
+	mb, release, err := s.open(layerID, true)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return mb.PutTile(z, x, y, data)
+}
+
+func (s *mbtilesTileStore) Delete(layerID string, z, x, y int) error {
+	if _, err := os.Stat(mbtilesPath(layerID)); err != nil {
+		return nil
+	}
+	mb, release, err := s.open(layerID, true)
+	if err != nil || mb == nil {
+		return err
+	}
+	defer release()
+	return mb.DeleteTile(z, x, y)
+}
+
+func (s *mbtilesTileStore) Zooms(layerID string) ([]int, error) {
+	mb, release, err := s.open(layerID, false)
+	if err != nil || mb == nil {
+		return nil, err
+	}
+	defer release()
+	return mb.Zooms()
+}
+
+func (s *mbtilesTileStore) List(layerID string, z int, bounds TileBounds) ([]TileCoord, error) {
+	mb, release, err := s.open(layerID, false)
+	if err != nil || mb == nil {
+		return nil, err
+	}
+	defer release()
+	return mb.Tiles(z, bounds)
+}
+
+// s3TileStore keeps <prefix>/<layer>/z/x/y.pbf objects in an S3-compatible bucket such as MinIO
+type s3TileStore struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newS3TileStore() (*s3TileStore, error) {
+	if Config.S3Endpoint == "" || Config.S3Bucket == "" {
+		return nil, errors.New("TILE_S3_ENDPOINT and TILE_S3_BUCKET are required")
+	}
+
+	client, err := minio.New(Config.S3Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(Config.S3AccessKey, Config.S3SecretKey, ""),
+		Secure: Config.S3UseSSL,
+		Region: Config.S3Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client: %w", err)
+	}
+
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, Config.S3Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check s3 bucket %s: %w", Config.S3Bucket, err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, Config.S3Bucket, minio.MakeBucketOptions{Region: Config.S3Region}); err != nil {
+			return nil, fmt.Errorf("failed to create s3 bucket %s: %w", Config.S3Bucket, err)
+		}
+	}
+
+	return &s3TileStore{client: client, bucket: Config.S3Bucket, prefix: strings.Trim(Config.S3Prefix, "/")}, nil
+}
+
+func (s *s3TileStore) key(layerID string, z, x, y int) string {
+	return path.Join(s.prefix, fmt.Sprintf("%s/%d/%d/%d.pbf", layerID, z, x, y))
+}
+
+func (s *s3TileStore) Get(layerID string, z, x, y int) ([]byte, error) {
+	object, err := s.client.GetObject(context.Background(), s.bucket, s.key(layerID, z, x, y), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	data, err := io.ReadAll(object)
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *s3TileStore) Put(layerID string, z, x, y int, data []byte) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.key(layerID, z, x, y), bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: "application/vnd.mapbox-vector-tile"})
+	if err != nil {
+		return fmt.Errorf("failed to save tile: %w", err)
+	}
+	return nil
+}
+
+func (s *s3TileStore) Delete(layerID string, z, x, y int) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, s.key(layerID, z, x, y), minio.RemoveObjectOptions{})
+}
+
+func (s *s3TileStore) Zooms(layerID string) ([]int, error) {
+	layerPrefix := path.Join(s.prefix, layerID) + "/"
+
+	// Without Recursive the zoom levels come back as common prefixes
+	var zooms []int
+	for object := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: layerPrefix}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		if z, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(object.Key, layerPrefix), "/")); err == nil {
+			zooms = append(zooms, z)
+		}
+	}
+	return zooms, nil
+}
+
+func (s *s3TileStore) List(layerID string, z int, bounds TileBounds) ([]TileCoord, error) {
+	zoomPrefix := path.Join(s.prefix, layerID, strconv.Itoa(z)) + "/"
+
+	// Narrow ranges list their columns, wide ones the whole zoom level
+	prefixes := []string{zoomPrefix}
+	if bounds.MaxX-bounds.MinX < s3ColumnListLimit {
+		prefixes = nil
+		for x := max(bounds.MinX, 0); x <= bounds.MaxX; x++ {
+			prefixes = append(prefixes, zoomPrefix+strconv.Itoa(x)+"/")
+		}
+	}
+
+	var coords []TileCoord
+	for _, prefix := range prefixes {
+		for object := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+			if object.Err != nil {
+				return nil, object.Err
+			}
+			var x, y int
+			if _, err := fmt.Sscanf(strings.TrimPrefix(object.Key, zoomPrefix), "%d/%d.pbf", &x, &y); err == nil && bounds.Contains(x, y) {
+				coords = append(coords, TileCoord{z, x, y})
+			}
+		}
+	}
+	return coords, nil
+}
@@ -1,20 +1,26 @@
 package tiles
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"math"
 	"os"
-	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/khankhulgun/khanmap/maplayer"
+	"github.com/khankhulgun/khanmap/metrics"
 	"github.com/khankhulgun/khanmap/models"
 	"github.com/lambda-platform/lambda/DB"
 	agentUtils "github.com/lambda-platform/lambda/agent/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
 )
 
 type Feature struct {
@@ -26,21 +32,14 @@ type Feature struct {
 const (
 	tileSize   = 4096
 	tileExtent = 256
+
+	// featureIDName is the column copied into the MVT feature id
+	featureIDName = "mvt_feature_id"
 )
 
-// DoCluster is set globally from khanmap.Set() to enable/disable clustering for all Point layers
+// DoCluster is set globally from khanmap.Set() and enables clustering for Point layers that set no cluster column
 var DoCluster bool
 
-func tileToBBox(z, x, y int) (minX, minY, maxX, maxY float64) {
-	n := 1 << z
-	nf := float64(n)
-	minX = float64(x)/nf*360.0 - 180.0
-	minY = math.Atan(math.Sinh(math.Pi*(1-2*float64(y)/nf))) * 180.0 / math.Pi
-	maxX = float64(x+1)/nf*360.0 - 180.0
-	maxY = math.Atan(math.Sinh(math.Pi*(1-2*float64(y+1)/nf))) * 180.0 / math.Pi
-	return
-}
-
 func parseTileParams(c *fiber.Ctx) (int, int, int, error) {
 	z, err := strconv.Atoi(c.Params("z"))
 	if err != nil {
@@ -57,76 +56,335 @@ func parseTileParams(c *fiber.Ctx) (int, int, int, error) {
 	return z, x, y, nil
 }
 
-func fetchTileData(query string, args ...interface{}) ([]byte, error) {
+// errTileTimeout reports a tile query cancelled by its statement timeout
+var errTileTimeout = errors.New("tile query timed out")
+
+// fetchTileData runs a tile query bound to ctx, limited to timeout milliseconds when timeout > 0
+func fetchTileData(ctx context.Context, timeout int, query string, args ...interface{}) ([]byte, error) {
 	var mvtData []byte
-	err := DB.DB.Raw(query, args...).Row().Scan(&mvtData)
+	err := DB.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// SET LOCAL ends with the transaction, pooled connections keep their own timeout
+		if timeout > 0 {
+			if err := tx.Exec(fmt.Sprintf("SET LOCAL statement_timeout = %d", timeout)).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Raw(query, args...).Row().Scan(&mvtData)
+	})
 	if err != nil {
+		// A cancelled request also cancels its query, which is not a database error
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var pgErr *pgconn.PgError
+		// 57014 query_canceled is raised when statement_timeout expires
+		if errors.As(err, &pgErr) && pgErr.Code == "57014" {
+			return nil, errTileTimeout
+		}
+		metrics.DBErrors.WithLabelValues("tile").Inc()
 		return nil, err
 	}
 	return mvtData, nil
 }
 
-// getClusterRadius calculates the cluster radius in degrees based on zoom level and latitude
-// standardRadiusPixels: default radius in pixels (e.g., 40-60)
-func getClusterRadius(zoom int, lat float64) float64 {
-	// Earth circumference ~40,075,017 meters
-	// Resolution (meters/pixel) = 156543.03 * cos(lat) / 2^zoom
+// statementTimeout returns the tile query timeout of the layer in milliseconds
+func statementTimeout(layer models.MapLayersForTile) int {
+	if layer.StatementTimeout != nil && *layer.StatementTimeout >= 0 {
+		return *layer.StatementTimeout
+	}
+	return Config.StatementTimeout
+}
+
+// sendDeniedTile answers a tile request refused by the layer access policy with an empty tile,
+// so map clients draw nothing instead of failing on the source
+func sendDeniedTile(c *fiber.Ctx, err error) error {
+	c.Set("Cache-Control", "no-store")
+	c.Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	return c.Status(maplayer.AccessStatus(err)).Send([]byte{})
+}
+
+// sendTileError answers a tile request that failed. Malformed time params get a 400. Timed out
+// tiles get a 503 asking the client to retry, or an empty tile that is never cached when
+// TILE_TIMEOUT_RESPONSE is "empty". Timeouts are counted on timeouts and logged under name.
+func sendTileError(c *fiber.Ctx, name string, timeouts prometheus.Counter, err error, emptyTile bool) error {
+	if errors.Is(err, maplayer.ErrInvalidTime) {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	if errors.Is(err, errTileTimeout) {
+		timeouts.Inc()
+		log.Printf("Tile query of %s timed out", name)
+		if emptyTile && Config.TimeoutResponse == "empty" {
+			c.Set("Cache-Control", "no-store")
+			c.Set("Content-Type", "application/vnd.mapbox-vector-tile")
+			return c.Send([]byte{})
+		}
+		c.Set("Retry-After", "1")
+		return c.Status(fiber.StatusServiceUnavailable).SendString("Tile query timed out")
+	}
+
+	log.Printf("Database error: %v", err)
+	return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+}
+
+// observeTile records the latency and size of a served tile
+func observeTile(layer string, z int, start time.Time, data []byte) {
+	zoom := strconv.Itoa(z)
+	metrics.TileDuration.WithLabelValues(layer, zoom).Observe(time.Since(start).Seconds())
+	metrics.TileBytes.WithLabelValues(layer, zoom).Observe(float64(len(data)))
+}
 
-	const standardRadiusPixels = 12.0
-	// Convert latitude to radians
-	latRad := lat * math.Pi / 180.0
-	resolution := 156543.03 * math.Cos(latRad) / math.Pow(2, float64(zoom))
+// observeMapTile records the latency and size of a served composite map tile
+func observeMapTile(mapID string, z int, start time.Time, data []byte) {
+	zoom := strconv.Itoa(z)
+	metrics.MapTileDuration.WithLabelValues(mapID, zoom).Observe(time.Since(start).Seconds())
+	metrics.MapTileBytes.WithLabelValues(mapID, zoom).Observe(float64(len(data)))
+}
 
-	// Radius in meters
-	radiusMeters := standardRadiusPixels * resolution
+// clusterSettings resolves the layer's clustering, falling back to the global DoCluster switch
+// for layers without cluster configuration
+func clusterSettings(layer models.MapLayersForTile) models.ClusterSettings {
+	settings := layer.Cluster.Settings(DoCluster)
+	// Heatmaps are drawn from the individual points
+	if layer.Heatmap.Settings().Enabled {
+		settings.Enabled = false
+	}
+	return settings
+}
+
+// mercatorUnits converts a distance in screen pixels to EPSG:3857 units for the zoom level.
+// Mercator units per pixel do not depend on latitude, so the distance is the same on screen everywhere.
+func mercatorUnits(zoom int, pixels float64) float64 {
+	// Resolution (units/pixel) = 156543.03 / 2^zoom
+	resolution := 156543.03 / math.Pow(2, float64(zoom))
 
-	// Convert to degrees (1 degree ~ 111,320m)
-	return radiusMeters / 111320.0
+	return pixels * resolution
 }
 
 func tileHandler(layer models.MapLayersForTile, user interface{}, filters map[string]string, areaFilters map[string]string) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		if err := maplayer.CheckLayerAccess(layer, user); err != nil {
+			return sendDeniedTile(c, err)
+		}
+
 		z, x, y, err := parseTileParams(c)
 		if err != nil {
 			log.Printf("Invalid tile parameters: %v", err)
 			return c.Status(fiber.StatusBadRequest).SendString("Invalid tile parameters")
 		}
 
-		mvtData, err := getVectorTile(z, x, y, layer, user, filters, areaFilters)
+		start := time.Now()
+		version := layerTileVersion(layer)
+		key := tileCacheKey([]string{layer.ID}, version, z, x, y, filters, areaFilters, tileScope(layer, user))
+		mvtData, err := cachedTile(c.UserContext(), key, func(ctx context.Context) ([]byte, error) {
+			return getVectorTile(ctx, z, x, y, layer, user, filters, areaFilters)
+		})
 		if err != nil {
-			log.Printf("Database error: %v", err)
-			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+			return sendTileError(c, "layer "+layer.ID, metrics.TileTimeouts.WithLabelValues(layer.ID), err, true)
 		}
+		observeTile(layer.ID, z, start, mvtData)
+
+		return sendTile(c, mvtData, cacheMaxAge(layer), tileScope(layer, user) == "public", version)
+	}
+}
 
-		c.Set("Content-Type", "application/vnd.mapbox-vector-tile")
-		return c.Send(mvtData)
+// getVectorTile renders the layer's tile. Tiles below the layer's min zoom are empty and tiles
+// above its max zoom are cut out of the cached tile at the max zoom.
+func getVectorTile(ctx context.Context, z, x, y int, layer models.MapLayersForTile, user interface{}, adminFilters map[string]string, areaFilters map[string]string) ([]byte, error) {
+	zoom := layer.Zoom.Settings()
+	if z < zoom.MinZoom {
+		return []byte{}, nil
+	}
+	if zoom.Overzoomed(z) {
+		dz := z - zoom.MaxZoom
+		px, py := x>>dz, y>>dz
+		key := tileCacheKey([]string{layer.ID}, layerTileVersion(layer), zoom.MaxZoom, px, py, adminFilters, areaFilters, tileScope(layer, user))
+		parent, err := cachedTile(ctx, key, func(ctx context.Context) ([]byte, error) {
+			return getVectorTile(ctx, zoom.MaxZoom, px, py, layer, user, adminFilters, areaFilters)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return overzoomTile(parent, z, x, y, tileLayerZooms(layer.DbSchema+"."+layer.DbTable, zoom.MaxZoom))
 	}
+
+	return budgetedTile(ctx, z, x, y, layer, user, adminFilters, areaFilters, layer.DbSchema+"."+layer.DbTable)
 }
 
-func getVectorTile(z, x, y int, layer models.MapLayersForTile, user interface{}, adminFilters map[string]string, areaFilters map[string]string) ([]byte, error) {
-	minX, minY, maxX, maxY := tileToBBox(z, x, y)
+// budgetedTile renders the layer's features into a tile layer named layerName, rebuilding it with
+// stronger reductions until it fits the layer's size budget. Clustered and aggregated tiles
+// are not reduced, they are served as they are.
+func budgetedTile(ctx context.Context, z, x, y int, layer models.MapLayersForTile, user interface{}, adminFilters map[string]string, areaFilters map[string]string, layerName string) ([]byte, error) {
+	mvtData, err := getReducedVectorTile(ctx, z, x, y, layer, user, adminFilters, areaFilters, layerName, tileReduction{})
+	if err != nil {
+		return nil, err
+	}
+
+	budget := layer.Budget.Settings()
+	if budget.MaxBytes == 0 || len(mvtData) <= budget.MaxBytes || !reducible(layer, z) {
+		return mvtData, nil
+	}
+
+	// Rebuild an oversized tile with stronger reductions until it fits the budget
+	steps := []struct {
+		strategy  string
+		reduction tileReduction
+	}{
+		{"geometry simplification", tileReduction{simplify: true}},
+		{"reduced attributes", tileReduction{simplify: true, columns: budget.Columns}},
+		{"small feature dropping", tileReduction{simplify: true, columns: budget.Columns, minArea: budget.MinFeatureArea}},
+	}
+	if budget.Columns == nil {
+		// Without budget columns only the ID and style fields are kept
+		steps[1].reduction.columns = []string{}
+		steps[2].reduction.columns = []string{}
+	}
+
+	originalSize := len(mvtData)
+	for _, step := range steps {
+		mvtData, err = getReducedVectorTile(ctx, z, x, y, layer, user, adminFilters, areaFilters, layerName, step.reduction)
+		if err != nil {
+			return nil, err
+		}
+		if len(mvtData) <= budget.MaxBytes {
+			log.Printf("Tile %d/%d/%d of layer %s was %d bytes, fitted into %d bytes with %s", z, x, y, layer.ID, originalSize, len(mvtData), step.strategy)
+			return mvtData, nil
+		}
+	}
 
-	// Calculate buffer in degrees to prevent edge artifacts
-	// Default buffer is often 256 units in a 4096 unit tile (approx 6.25%)
-	const bufferRatio = 256.0 / 4096.0
-	xSpan := maxX - minX
-	ySpan := maxY - minY
-	bufferX := xSpan * bufferRatio
-	bufferY := ySpan * bufferRatio
+	log.Printf("Tile %d/%d/%d of layer %s is still %d bytes after %s, over its %d byte budget", z, x, y, layer.ID, len(mvtData), steps[len(steps)-1].strategy, budget.MaxBytes)
+	return mvtData, nil
+}
 
-	// Buffered BBox for SQL selection
-	bMinX, bMinY, bMaxX, bMaxY := minX-bufferX, minY-bufferY, maxX+bufferX, maxY+bufferY
+func getReducedVectorTile(ctx context.Context, z, x, y int, layer models.MapLayersForTile, user interface{}, adminFilters map[string]string, areaFilters map[string]string, layerName string, reduction tileReduction) ([]byte, error) {
+	query, args, err := buildReducedTileQuery(z, x, y, layer, user, adminFilters, areaFilters, layerName, reduction)
+	if err != nil {
+		return nil, err
+	}
+	return fetchTileData(ctx, statementTimeout(layer), query, args...)
+}
+
+// tileLayerZooms maps the tile layers of a layer named layerName to the zoom they are rendered at
+func tileLayerZooms(layerName string, zoom int) map[string]int {
+	return map[string]int{layerName: zoom, models.LabelLayerName(layerName): zoom}
+}
+
+// GetLayerTile returns a layer's tile for the user through the tile cache. Filters on
+// columns the layer's table does not have are ignored.
+func GetLayerTile(ctx context.Context, layer models.MapLayersForTile, z, x, y int, user interface{}, filters map[string]string, areaFilters map[string]string) ([]byte, error) {
+	if err := maplayer.CheckLayerAccess(layer, user); err != nil {
+		return nil, err
+	}
+	filters = maplayer.FiltersForTable(filters, layer.DbSchema, layer.DbTable)
+	key := tileCacheKey([]string{layer.ID}, layerTileVersion(layer), z, x, y, filters, areaFilters, tileScope(layer, user))
+	return cachedTile(ctx, key, func(ctx context.Context) ([]byte, error) {
+		return getVectorTile(ctx, z, x, y, layer, user, filters, areaFilters)
+	})
+}
+
+// buildTileQuery returns the ST_AsMVT query of one layer and its arguments. layerName is the
+// name of the layer inside the tile. Permission checks fail here, before anything is queried.
+func buildTileQuery(z, x, y int, layer models.MapLayersForTile, user interface{}, adminFilters map[string]string, areaFilters map[string]string, layerName string) (string, []interface{}, error) {
+	return buildReducedTileQuery(z, x, y, layer, user, adminFilters, areaFilters, layerName, tileReduction{})
+}
+
+// tileReduction shrinks the features of a tile that is over its layer's size budget.
+// It applies to unclustered, unaggregated tiles.
+type tileReduction struct {
+	simplify bool     // simplify geometries to one screen pixel
+	columns  []string // attributes to keep besides the ID and style fields, nil keeps the layer's columns
+	minArea  float64  // drop polygons smaller than this many square screen pixels
+}
+
+// reducible reports whether the layer's tile at zoom z is built from its features one by one,
+// which is when tile reductions apply. Clustered and aggregated tiles are not.
+func reducible(layer models.MapLayersForTile, z int) bool {
+	if layer.Aggregation.Settings().Aggregates(layer.GeometryType, z) {
+		return false
+	}
+	return !clusterSettings(layer).Clusters(layer.GeometryType, z)
+}
+
+// buildReducedTileQuery is buildTileQuery with the tile's features reduced
+func buildReducedTileQuery(z, x, y int, layer models.MapLayersForTile, user interface{}, adminFilters map[string]string, areaFilters map[string]string, layerName string, reduction tileReduction) (string, []interface{}, error) {
+	// Tiles are clipped and quantised in EPSG:3857. Rows are selected with the buffered
+	// envelope transformed into the table's own SRID so its spatial index is used.
+	srid := maplayer.LayerSRID(layer.DbSchema, layer.DbTable, layer.GeometryFieldName)
+	mercatorGeom := maplayer.TransformSQL(layer.GeometryFieldName, srid, 3857)
+	selectEnvelope := maplayer.TransformSQL("ST_TileEnvelope(?, ?, ?, margin => ?)", 3857, srid)
+
+	// Default buffer is 256 units in a 4096 unit tile (6.25%) to prevent edge artifacts
+	const bufferRatio = float64(tileExtent) / float64(tileSize)
 
 	sqlColumns := maplayer.ConstructSQLColumns(layer, true)
 
 	var rawSQL string
 
-	// Check if this is a Point layer that should use clustering
-	if DoCluster && layer.GeometryType == "Point" && z < 14 {
-		// Clustering SQL for Point layers
+	// Dense Point layers are binned into grid cells at low zoom, otherwise they may be clustered
+	aggregation := layer.Aggregation.Settings()
+	aggregated := aggregation.Aggregates(layer.GeometryType, z)
+	cluster := clusterSettings(layer)
+	clustered := !aggregated && cluster.Clusters(layer.GeometryType, z)
+
+	// Integer IDs are copied into the MVT feature id so clients can use feature-state.
+	// The copy keeps the ID field itself among the feature properties.
+	featureID := !aggregated && maplayer.IsIntegerColumn(layer.DbSchema, layer.DbTable, layer.IDFieldName)
+	mvtParams, featureIDColumn := "?, ?, ?", ""
+	if featureID {
+		mvtParams = "?, ?, ?, ?"
+		if clustered {
+			featureIDColumn = `CASE WHEN cluster_id IS NULL THEN min("` + layer.IDFieldName + `") END AS ` + featureIDName + `,`
+		} else {
+			featureIDColumn = `"` + layer.IDFieldName + `" AS ` + featureIDName + `,`
+		}
+	}
+	if aggregated {
+		gridFunc := "ST_SquareGrid"
+		if aggregation.Mode == models.AggregationHexagon {
+			gridFunc = "ST_HexagonGrid"
+		}
+
+		// Sum and average of the configured numeric column, when it exists
+		valueSelect, valueColumns := "1 AS value", ""
+		if aggregation.Field != "" {
+			if maplayer.IsNumericColumn(layer.DbSchema, layer.DbTable, aggregation.Field) {
+				valueSelect = `"` + aggregation.Field + `" AS value`
+				valueColumns = "sum(points.value)::float8 AS sum, avg(points.value)::float8 AS avg,"
+			} else {
+				log.Printf("Aggregation field %s of layer %s is not a numeric column", aggregation.Field, layer.ID)
+			}
+		}
+
+		// Cells are generated over the tile in EPSG:3857 so they line up across tiles,
+		// and each cell selects its rows with the table's spatial index
 		rawSQL = `
 		SELECT ST_AsMVT(tile, ?, ?, ?) FROM (
 			SELECT
+				count(*)::int AS count,
+				` + valueColumns + `
+				ST_AsMVTGeom(
+					cells.geom,
+					ST_TileEnvelope(?, ?, ?),
+					?,
+					?,
+					true
+				) AS ` + layer.GeometryFieldName + `
+			FROM ` + gridFunc + `(?, ST_TileEnvelope(?, ?, ?)) AS cells
+			CROSS JOIN LATERAL (
+				SELECT ` + valueSelect + `
+				FROM ` + layer.DbSchema + `.` + layer.DbTable + `
+				WHERE ` + layer.GeometryFieldName + ` && ` + maplayer.TransformSQL("cells.geom", 3857, srid) + `
+				AND ST_Intersects(` + mercatorGeom + `, cells.geom) %s
+			) AS points
+			GROUP BY cells.i, cells.j, cells.geom
+		) AS tile
+		WHERE ` + layer.GeometryFieldName + ` IS NOT NULL
+		`
+	} else if clustered {
+		// Clustering SQL for Point layers
+		rawSQL = `
+		SELECT ST_AsMVT(tile, ` + mvtParams + `) FROM (
+			SELECT
+				` + featureIDColumn + `
 				CASE
 					WHEN cluster_id IS NOT NULL THEN
 						jsonb_build_object(
@@ -144,8 +402,8 @@ func getVectorTile(z, x, y int, layer models.MapLayersForTile, user interface{},
 						to_jsonb((array_agg(points))[1]) - '` + layer.GeometryFieldName + `' - 'cluster_id'
 				END as properties,
 				ST_AsMVTGeom(
-						ST_Centroid(ST_Collect(` + layer.GeometryFieldName + `)),
-					ST_MakeEnvelope(?, ?, ?, ?, 4326),
+					ST_Centroid(ST_Collect(` + mercatorGeom + `)),
+					ST_TileEnvelope(?, ?, ?),
 					?,
 					?,
 					true
@@ -154,12 +412,12 @@ func getVectorTile(z, x, y int, layer models.MapLayersForTile, user interface{},
 				SELECT
 					*,
 					ST_ClusterDBSCAN(
-						` + layer.GeometryFieldName + `,
+						` + mercatorGeom + `,
 						eps := ?,
-						minpoints := 2
+						minpoints := ?
 					) OVER () as cluster_id
 				FROM ` + layer.DbSchema + `.` + layer.DbTable + `
-				WHERE ` + layer.GeometryFieldName + ` && ST_MakeEnvelope(?, ?, ?, ?, 4326) %s
+				WHERE ` + layer.GeometryFieldName + ` && ` + selectEnvelope + ` %s
 			) points
 			GROUP BY
 				cluster_id,
@@ -168,84 +426,158 @@ func getVectorTile(z, x, y int, layer models.MapLayersForTile, user interface{},
 		WHERE ` + layer.GeometryFieldName + ` IS NOT NULL
 		`
 	} else {
+		tileGeom, areaCondition := mercatorGeom, ""
+		if reduction.simplify {
+			tileGeom = "ST_SimplifyPreserveTopology(" + mercatorGeom + ", ?)"
+		}
+		if reduction.columns != nil {
+			// Fields the generated style depends on are always kept
+			keep := []string{layer.IDFieldName}
+			if layer.UniqueValueField != nil && *layer.UniqueValueField != "" {
+				keep = append(keep, *layer.UniqueValueField)
+			}
+			if weight := maplayer.HeatmapWeightColumn(layer.DbSchema, layer.DbTable, layer.Heatmap.Settings()); weight != "" {
+				keep = append(keep, weight)
+			}
+			var quoted []string
+			for _, col := range append(keep, reduction.columns...) {
+				if !slices.Contains(quoted, `"`+col+`"`) {
+					quoted = append(quoted, `"`+col+`"`)
+				}
+			}
+			sqlColumns = strings.Join(quoted, ", ")
+		}
+		if reduction.minArea > 0 {
+			areaCondition = "AND (ST_Dimension(" + layer.GeometryFieldName + ") < 2 OR ST_Area(" + mercatorGeom + ") >= ?)"
+		}
+
 		// Standard SQL for non-Point layers or high zoom levels
 		rawSQL = `
-		SELECT ST_AsMVT(q, ?, ?, ?) FROM (
-			SELECT ` + sqlColumns + `, ST_AsMVTGeom(
-				` + layer.GeometryFieldName + `,
-				ST_MakeEnvelope(?, ?, ?, ?, 4326),
+		SELECT ST_AsMVT(q, ` + mvtParams + `) FROM (
+			SELECT ` + featureIDColumn + sqlColumns + `, ST_AsMVTGeom(
+				` + tileGeom + `,
+				ST_TileEnvelope(?, ?, ?),
 				?,
 				?,
 				true
 			) AS ` + layer.GeometryFieldName + `
 			FROM ` + layer.DbSchema + `.` + layer.DbTable + `
-			WHERE ` + layer.GeometryFieldName + ` && ST_MakeEnvelope(?, ?, ?, ?, 4326) %s
+			WHERE ` + layer.GeometryFieldName + ` && ` + selectEnvelope + ` ` + areaCondition + ` %s
 		) AS q
 		`
 	}
 
-	userMap, _ := user.(map[string]interface{})
-
-	query := rawSQL
-	var filterConditions []string
-	var filterValues []interface{}
-
-	if layer.IsPermission {
-		if len(layer.RolePermissions) > 0 {
-			roleVal, ok := userMap["role"]
-			roleFloat, isFloat := roleVal.(float64)
-			roleInt := int(roleFloat)
-			if !ok || !isFloat {
-				return nil, errors.New("user role is missing or not a float")
-			}
+	filterConditions, filterValues, err := layerConditions(layer, user, adminFilters, areaFilters)
+	if err != nil {
+		return "", nil, err
+	}
+	query := fmt.Sprintf(rawSQL, strings.Join(filterConditions, " "))
 
-			hasPermission := false
-			roleFound := false
+	args := []interface{}{layerName, tileSize, layer.GeometryFieldName}
+	if featureID {
+		args = append(args, featureIDName)
+	}
 
-			for _, perm := range layer.RolePermissions {
-				if roleInt == perm.RoleID {
-					roleFound = true
-					break
-				}
-			}
+	// Build args based on whether aggregation or clustering is enabled
+	if aggregated {
+		args = append(args,
+			z, x, y,
+			tileSize,
+			tileExtent,
+			mercatorUnits(z, aggregation.CellSize), // grid cell size
+			z, x, y,
+		)
+	} else if clustered {
+		args = append(args,
+			z, x, y, // ST_TileEnvelope (Clip) uses the unbuffered tile
+			tileSize,
+			tileExtent,
+			mercatorUnits(z, cluster.Radius), // eps parameter for ST_ClusterDBSCAN
+			cluster.MinPoints,
+			// Use BUFFERED envelope for selection to include edge points
+			z, x, y, bufferRatio,
+		)
+	} else {
+		pixel := mercatorUnits(z, 1)
+		if reduction.simplify {
+			args = append(args, pixel) // simplification tolerance
+		}
+		args = append(args,
+			z, x, y,
+			tileSize,
+			tileExtent,
+			z, x, y, bufferRatio,
+		)
+		if reduction.minArea > 0 {
+			args = append(args, reduction.minArea*pixel*pixel)
+		}
+	}
 
-			if layer.IsRoleException != nil && *layer.IsRoleException != 0 {
-				hasPermission = !roleFound
-			} else {
-				hasPermission = roleFound
-			}
+	args = append(args, filterValues...)
 
-			if !hasPermission {
-				return nil, errors.New("user role does not have permission for this layer")
-			}
+	// Labelled Polygon layers carry a companion layer of label anchors
+	if labels := layer.Label.Settings(); labels.Labels(layer.GeometryType, z) {
+		if maplayer.HasColumn(layer.DbSchema, layer.DbTable, labels.Field) {
+			labelQuery, labelArgs := buildLabelQuery(z, x, y, layer, labels, models.LabelLayerName(layerName), filterConditions, filterValues)
+			query = "SELECT COALESCE((" + query + "), ''::bytea) || COALESCE((" + labelQuery + "), ''::bytea)"
+			args = append(args, labelArgs...)
+		} else {
+			log.Printf("Label field %s of layer %s is not a column", labels.Field, layer.ID)
 		}
+	}
 
-		if len(layer.UserPermissions) > 0 {
-			idVal, ok := userMap["id"]
-			idInt64, isInt64 := idVal.(int64)
-			if !ok || !isInt64 {
-				return nil, fmt.Errorf("user id is missing or not an int64")
-			}
+	return query, args, nil
+}
 
-			hasPermission := false
-			userFound := false
+// buildLabelQuery returns the ST_AsMVT query of a Polygon layer's label anchors. Each polygon
+// is labelled once, at a point inside it, so labels of large polygons stay on the polygon.
+func buildLabelQuery(z, x, y int, layer models.MapLayersForTile, labels models.LabelSettings, layerName string, filterConditions []string, filterValues []interface{}) (string, []interface{}) {
+	srid := maplayer.LayerSRID(layer.DbSchema, layer.DbTable, layer.GeometryFieldName)
+	anchorGeom := maplayer.TransformSQL("ST_PointOnSurface("+layer.GeometryFieldName+")", srid, 3857)
+	selectEnvelope := maplayer.TransformSQL("ST_TileEnvelope(?, ?, ?, margin => ?)", 3857, srid)
+	const bufferRatio = float64(tileExtent) / float64(tileSize)
+
+	query := fmt.Sprintf(`
+		SELECT ST_AsMVT(labels, ?, ?, ?) FROM (
+			SELECT "`+labels.Field+`", ST_AsMVTGeom(
+				`+anchorGeom+`,
+				ST_TileEnvelope(?, ?, ?),
+				?,
+				?,
+				true
+			) AS `+layer.GeometryFieldName+`
+			FROM `+layer.DbSchema+`.`+layer.DbTable+`
+			WHERE `+layer.GeometryFieldName+` && `+selectEnvelope+` AND "`+labels.Field+`" IS NOT NULL %s
+		) AS labels
+		WHERE `+layer.GeometryFieldName+` IS NOT NULL
+		`, strings.Join(filterConditions, " "))
+
+	args := []interface{}{
+		layerName, tileSize, layer.GeometryFieldName,
+		z, x, y,
+		tileSize,
+		tileExtent,
+		z, x, y, bufferRatio,
+	}
+	args = append(args, filterValues...)
+	return query, args
+}
 
-			for _, perm := range layer.UserPermissions {
-				if idInt64 == int64(perm.UserID) {
-					userFound = true
-					break
-				}
-			}
+// layerConditions returns the WHERE conditions and their values that limit a layer's rows
+// for the user: permission filters, attribute filters and district/region filters.
+// It fails when the user has no permission for the layer.
+func layerConditions(layer models.MapLayersForTile, user interface{}, adminFilters map[string]string, areaFilters map[string]string) ([]string, []interface{}, error) {
+	userMap, _ := user.(map[string]interface{})
 
-			if layer.IsRoleException != nil && *layer.IsRoleException != 0 {
-				hasPermission = !userFound
-			} else {
-				hasPermission = userFound
-			}
+	var filterConditions []string
+	var filterValues []interface{}
 
-			if !hasPermission {
-				return nil, errors.New("user does not have permission for this layer")
-			}
+	// Handlers apply maplayer.CheckLayerAccess first; the permissions are checked again here
+	// so no query of a permission layer is ever built for a user without access
+	if layer.IsPermission {
+		if err := maplayer.CheckLayerPermissions(layer.RolePermissions, layer.UserPermissions, layer.IsRoleException, userMap); err != nil {
+			metrics.PermissionDenials.WithLabelValues(layer.ID).Inc()
+			return nil, nil, err
 		}
 
 		for _, filter := range layer.Filters {
@@ -273,55 +605,18 @@ func getVectorTile(z, x, y int, layer models.MapLayersForTile, user interface{},
 		}
 	}
 
-	query = fmt.Sprintf(query, strings.Join(filterConditions, " "))
-
-	var args []interface{}
-
-	// Build args based on whether clustering is enabled
-	if DoCluster && layer.GeometryType == "Point" && z < 14 {
-		// Clustering query args
-		// Use center latitude for radius calculation to reduce distortion
-		centerLat := (minY + maxY) / 2.0
-		clusterRadius := getClusterRadius(z, centerLat)
-
-		args = []interface{}{
-			layer.DbSchema + "." + layer.DbTable,
-			tileSize,
-			layer.GeometryFieldName,
-			minX, minY, maxX, maxY, // ST_MakeEnvelope (Clip) uses standard bbox
-			tileSize,
-			tileExtent,
-			clusterRadius, // eps parameter for ST_ClusterDBSCAN
-			// Use BUFFERED bbox for selection to include edge points
-			bMinX, bMinY, bMaxX, bMaxY,
-		}
-	} else {
-		// Standard query args
-		args = []interface{}{
-			layer.DbSchema + "." + layer.DbTable,
-			tileSize,
-			layer.GeometryFieldName,
-			minX, minY, maxX, maxY,
-			tileSize,
-			tileExtent,
-			// Use BUFFERED bbox for standard queries too to be safe (optional but recommended)
-			// But for now, let's stick to standard behavior unless requested
-			// Wait, MVT usually benefits from buffering too.
-			// Let's keep using buffered bbox for selection.
-			bMinX, bMinY, bMaxX, bMaxY,
-		}
+	timeConditions, timeValues, err := maplayer.TimeConditions(layer, areaFilters)
+	if err != nil {
+		return nil, nil, err
 	}
+	filterConditions = append(filterConditions, timeConditions...)
+	filterValues = append(filterValues, timeValues...)
 
-	args = append(args, filterValues...)
-
-	return fetchTileData(query, args...)
+	return filterConditions, filterValues, nil
 }
 
 func SaveVectorTileHandler(c *fiber.Ctx) error {
 	layer := c.Params("layer")
-	z := c.Params("z")
-	x := c.Params("x")
-	y := c.Params("y")
 
 	// Fetch the layer details
 	layerDetails, err := maplayer.FetchLayerDetails(layer)
@@ -329,19 +624,92 @@ func SaveVectorTileHandler(c *fiber.Ctx) error {
 		log.Printf("Layer not found: %v", err)
 		return c.Status(fiber.StatusNotFound).SendString("Layer not found")
 	}
+	if err := maplayer.CheckLayerAccess(layerDetails, nil); err != nil {
+		return sendDeniedTile(c, err)
+	}
 
-	// Construct the tile file path based on the layer, zoom, x, y parameters
-	tilePath := filepath.Join(downloadDir, fmt.Sprintf("%s/%s/%s/%s.pbf", layerDetails.ID, z, x, y))
+	// Serve the seeded tile from the tile store, then the layer's MBTiles or PMTiles export when there is one
+	if zi, xi, yi, err := parseTileParams(c); err == nil {
+		if store, err := getTileStore(); err == nil {
+			data, err := store.Get(layerDetails.ID, zi, xi, yi)
+			if err != nil {
+				log.Printf("Tile store read error: %v", err)
+			} else if data != nil {
+				c.Set("Content-Type", "application/vnd.mapbox-vector-tile")
+				return c.Send(data)
+			}
+		}
 
-	// Check if the tile already exists
-	if _, err := os.Stat(tilePath); err == nil {
-		// Tile exists, serve the existing tile
-		return c.SendFile(tilePath)
+		data, err := readMBTilesTile(layerDetails.ID, zi, xi, yi)
+		if err != nil {
+			log.Printf("MBTiles read error: %v", err)
+		} else if data != nil {
+			return sendGzippedTile(c, data)
+		}
+
+		data, compression, err := readPMTilesTile(layerDetails.ID, zi, xi, yi)
+		if err != nil {
+			log.Printf("PMTiles read error: %v", err)
+		} else if data != nil {
+			if compression == pmtilesCompGzip {
+				return sendGzippedTile(c, data)
+			}
+			c.Set("Content-Type", "application/vnd.mapbox-vector-tile")
+			return c.Send(data)
+		}
 	}
 
 	return tileHandler(layerDetails, nil, nil, nil)(c)
 }
 
+// ArchiveHandler serves a public layer's MBTiles or PMTiles export. PMTiles clients read
+// the archive with range requests.
+func ArchiveHandler(c *fiber.Ctx) error {
+	return archiveHandler(c, nil)
+}
+
+// ArchiveHandlerWithPermission serves a layer's MBTiles or PMTiles export to the logged in user
+func ArchiveHandlerWithPermission(c *fiber.Ctx) error {
+	user, err := agentUtils.AuthUserObject(c)
+	if err != nil {
+		log.Printf("User not found: %v", err)
+		return c.Status(fiber.StatusUnauthorized).SendString("User not found")
+	}
+	return archiveHandler(c, user)
+}
+
+func archiveHandler(c *fiber.Ctx, user interface{}) error {
+	layerDetails, err := maplayer.FetchLayerDetails(c.Params("layer"))
+	if err != nil {
+		log.Printf("Layer not found: %v", err)
+		return c.Status(fiber.StatusNotFound).SendString("Layer not found")
+	}
+	if err := maplayer.CheckLayerAccess(layerDetails, user); err != nil {
+		c.Set("Cache-Control", "no-store")
+		return c.Status(maplayer.AccessStatus(err)).SendString(err.Error())
+	}
+
+	var path string
+	switch c.Params("format") {
+	case "mbtiles":
+		path = mbtilesPath(layerDetails.ID)
+	case "pmtiles":
+		path = pmtilesPath(layerDetails.ID)
+	default:
+		return c.Status(fiber.StatusNotFound).SendString("Archive not found")
+	}
+	if _, err := os.Stat(path); err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Archive not found")
+	}
+
+	if tileScope(layerDetails, user) != "public" {
+		c.Set("Cache-Control", "private, no-cache")
+	}
+	return c.SendFile(path)
+}
+
+// SaveHandler starts a background seeding job for the layer and returns it immediately.
+// Progress is reported by the /seed-jobs endpoints.
 func SaveHandler(c *fiber.Ctx) error {
 	layer := c.Params("layer")
 
@@ -350,28 +718,26 @@ func SaveHandler(c *fiber.Ctx) error {
 		log.Printf("Layer not found: %v", err)
 		return c.Status(fiber.StatusNotFound).SendString("Layer not found")
 	}
-	createErr := CreateTiles(layerDetails)
-	if createErr != nil {
+
+	opts, err := parseSeedOptions(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	job, err := StartSeedJob(layerDetails, opts)
+	if status := seedJobStatus(err); err != nil && status != fiber.StatusInternalServerError {
+		return c.Status(status).SendString(err.Error())
+	} else if err != nil {
 		log.Printf("Error creating tiles: %v", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Error creating tiles")
 	}
 
-	return nil
+	return c.Status(fiber.StatusAccepted).JSON(job.progress())
 }
 
 func VectorTileHandler(c *fiber.Ctx) error {
 	layer := c.Params("layer")
-	query := c.Queries()
-	filters := make(map[string]string)
-	areaFilters := make(map[string]string)
-
-	for key, value := range query {
-		if key == "districtID" || key == "regionID" {
-			areaFilters[key] = value
-		} else {
-			filters[key] = value
-		}
-	}
+	filters, areaFilters := maplayer.SplitFilters(c.Queries())
 
 	layerDetails, err := maplayer.FetchLayerDetails(layer)
 	if err != nil {
@@ -390,17 +756,7 @@ func VectorTileHandlerWithPermission(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusUnauthorized).SendString("User not found")
 	}
 
-	query := c.Queries()
-	filters := make(map[string]string)
-	areaFilters := make(map[string]string)
-
-	for key, value := range query {
-		if key == "districtID" || key == "regionID" {
-			areaFilters[key] = value
-		} else {
-			filters[key] = value
-		}
-	}
+	filters, areaFilters := maplayer.SplitFilters(c.Queries())
 
 	layerDetails, err := maplayer.FetchLayerDetails(layer)
 	if err != nil {
@@ -413,43 +769,61 @@ func VectorTileHandlerWithPermission(c *fiber.Ctx) error {
 
 func LayerBoundsHandler(c *fiber.Ctx) error {
 	layer := c.Params("layer")
-	query := c.Queries()
-	filters := make(map[string]string)
-
-	for key, value := range query {
-		if key != "districtID" && key != "regionID" {
-			filters[key] = value
-		}
-	}
+	filters, areaFilters := maplayer.SplitFilters(c.Queries())
 
 	layerDetails, err := maplayer.FetchLayerDetails(layer)
 	if err != nil {
 		log.Printf("Layer not found: %v", err)
 		return c.Status(fiber.StatusNotFound).SendString("Layer not found")
 	}
+	if err := maplayer.CheckLayerAccess(layerDetails, nil); err != nil {
+		return c.Status(maplayer.AccessStatus(err)).SendString(err.Error())
+	}
 
-	sqlConditions, sqlArgs := maplayer.BuildFilterConditions(filters, layerDetails.DbSchema, layerDetails.DbTable)
+	bounds, err := layerBounds(layerDetails, filters, areaFilters)
+	if errors.Is(err, maplayer.ErrInvalidTime) {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	if err != nil {
+		log.Printf("Error calculating bounds: %v", err)
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
 
-	// Add area filters if needed (similar to tileHandler) or just use what we have.
-	// tileHandler logic for area filters:
-	// if key == "districtID" && layer.SoumIDField ...
-	// Let's replicate basic filter logic or just reuse BuildFilterConditions which handles generic filters.
-	// For bounds, we might want to respect area filters too if passed?
-	// The user query didn't specify, but consistency is good.
-	// Let's add area filter support if relevant keys are present in query params.
+	if bounds == nil {
+		// No data found or empty extent
+		return c.JSON(fiber.Map{
+			"bounds": nil,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"bounds": bounds,
+	})
+}
+
+// layerBounds returns the lon/lat extent of the layer's filtered features, or nil when there are none
+func layerBounds(layer models.MapLayersForTile, filters map[string]string, areaFilters map[string]string) ([]float64, error) {
+	sqlConditions, sqlArgs := maplayer.BuildFilterConditions(filters, layer.DbSchema, layer.DbTable)
 
 	var areaConditions []string
 	var areaArgs []interface{}
 
-	if val := c.Query("districtID"); val != "" && layerDetails.SoumIDField != nil && *layerDetails.SoumIDField != "" {
-		areaConditions = append(areaConditions, fmt.Sprintf("AND %s = ?", *layerDetails.SoumIDField))
+	if val := areaFilters["districtID"]; val != "" && layer.SoumIDField != nil && *layer.SoumIDField != "" {
+		areaConditions = append(areaConditions, fmt.Sprintf("AND %s = ?", *layer.SoumIDField))
 		areaArgs = append(areaArgs, val)
 	}
-	if val := c.Query("regionID"); val != "" && layerDetails.BaghIDField != nil && *layerDetails.BaghIDField != "" {
-		areaConditions = append(areaConditions, fmt.Sprintf("AND %s = ?", *layerDetails.BaghIDField))
+	if val := areaFilters["regionID"]; val != "" && layer.BaghIDField != nil && *layer.BaghIDField != "" {
+		areaConditions = append(areaConditions, fmt.Sprintf("AND %s = ?", *layer.BaghIDField))
 		areaArgs = append(areaArgs, val)
 	}
 
+	timeConditions, timeArgs, err := maplayer.TimeConditions(layer, areaFilters)
+	if err != nil {
+		return nil, err
+	}
+	areaConditions = append(areaConditions, timeConditions...)
+	areaArgs = append(areaArgs, timeArgs...)
+
 	finalConditions := append(sqlConditions, areaConditions...)
 	finalArgs := append(sqlArgs, areaArgs...)
 
@@ -461,27 +835,29 @@ func LayerBoundsHandler(c *fiber.Ctx) error {
 	rawSQL := fmt.Sprintf(`
 		SELECT ST_XMin(ext), ST_YMin(ext), ST_XMax(ext), ST_YMax(ext)
 		FROM (
-			SELECT ST_SetSRID(ST_Extent(%s), 4326) as ext
+			SELECT %s as ext
 			FROM %s.%s
 			%s
 		) as t
-	`, layerDetails.GeometryFieldName, layerDetails.DbSchema, layerDetails.DbTable, whereClause)
+	`, lonLatExtentSQL(layer), layer.DbSchema, layer.DbTable, whereClause)
 
 	var minX, minY, maxX, maxY *float64
 	err = DB.DB.Raw(rawSQL, finalArgs...).Row().Scan(&minX, &minY, &maxX, &maxY)
 	if err != nil {
-		log.Printf("Error calculating bounds: %v", err)
-		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+		return nil, err
 	}
 
 	if minX == nil || minY == nil {
-		// No data found or empty extent
-		return c.JSON(fiber.Map{
-			"bounds": nil,
-		})
+		return nil, nil
 	}
+	return []float64{*minX, *minY, *maxX, *maxY}, nil
+}
 
-	return c.JSON(fiber.Map{
-		"bounds": []float64{*minX, *minY, *maxX, *maxY},
-	})
+// lonLatExtentSQL returns the aggregate extent of the layer's geometries in EPSG:4326
+func lonLatExtentSQL(layer models.MapLayersForTile) string {
+	srid := maplayer.LayerSRID(layer.DbSchema, layer.DbTable, layer.GeometryFieldName)
+	if srid == 4326 {
+		return fmt.Sprintf("ST_SetSRID(ST_Extent(%s), 4326)", layer.GeometryFieldName)
+	}
+	return fmt.Sprintf("ST_Transform(ST_SetSRID(ST_Extent(%s)::geometry, %d), 4326)", layer.GeometryFieldName, srid)
 }
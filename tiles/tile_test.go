@@ -0,0 +1,68 @@
+package tiles
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/khankhulgun/khanmap/maplayer"
+	"github.com/khankhulgun/khanmap/models"
+)
+
+func TestTileHandlerDenied(t *testing.T) {
+	roles := []models.SubMapLayerRolePermissions{{RoleID: 3}}
+	tests := []struct {
+		name  string
+		layer models.MapLayersForTile
+		user  interface{}
+		want  int
+	}{
+		{"inactive", models.MapLayersForTile{ID: "1", IsPublic: true}, nil, http.StatusNotFound},
+		{"private without a user", models.MapLayersForTile{ID: "1", IsActive: true}, nil, http.StatusForbidden},
+		{"role not granted", models.MapLayersForTile{ID: "1", IsActive: true, IsPermission: true, RolePermissions: roles},
+			map[string]interface{}{"role": 4.0}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Get("/:z/:x/:y", tileHandler(tt.layer, tt.user, nil, nil))
+
+			resp, err := app.Test(httptest.NewRequest("GET", "/0/0/0", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.want || len(body) != 0 {
+				t.Errorf("denied tile = %d with %d bytes, want %d with an empty tile", resp.StatusCode, len(body), tt.want)
+			}
+			if got := resp.Header.Get("Cache-Control"); got != "no-store" {
+				t.Errorf("denied tile Cache-Control = %q, want no-store", got)
+			}
+			if got := resp.Header.Get("Content-Type"); got != "application/vnd.mapbox-vector-tile" {
+				t.Errorf("denied tile Content-Type = %q, want application/vnd.mapbox-vector-tile", got)
+			}
+		})
+	}
+}
+
+func TestLayerConditionsDenied(t *testing.T) {
+	layer := models.MapLayersForTile{
+		ID:              "1",
+		IsActive:        true,
+		IsPermission:    true,
+		RolePermissions: []models.SubMapLayerRolePermissions{{RoleID: 3}},
+	}
+	// The permissions are checked before any filter, so no query is built for the user
+	for _, user := range []interface{}{nil, map[string]interface{}{"role": 4.0}} {
+		conditions, values, err := layerConditions(layer, user, nil, nil)
+		if !errors.Is(err, maplayer.ErrLayerForbidden) || conditions != nil || values != nil {
+			t.Errorf("layerConditions for user %v = %v, %v, %v, want %v", user, conditions, values, err, maplayer.ErrLayerForbidden)
+		}
+	}
+}
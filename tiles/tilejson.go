@@ -0,0 +1,274 @@
+package tiles
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/khankhulgun/khanmap/maplayer"
+	"github.com/khankhulgun/khanmap/models"
+	"github.com/lambda-platform/lambda/DB"
+	"github.com/lambda-platform/lambda/config"
+)
+
+// TileJSON describes a tileset following the TileJSON 3.0 specification
+type TileJSON struct {
+	TileJSON     string        `json:"tilejson"`
+	Name         string        `json:"name"`
+	Description  string        `json:"description,omitempty"`
+	Attribution  string        `json:"attribution,omitempty"`
+	Scheme       string        `json:"scheme"`
+	Tiles        []string      `json:"tiles"`
+	MinZoom      int           `json:"minzoom"`
+	MaxZoom      int           `json:"maxzoom"`
+	Bounds       []float64     `json:"bounds,omitempty"`
+	Center       []float64     `json:"center,omitempty"`
+	VectorLayers []VectorLayer `json:"vector_layers"`
+}
+
+// VectorLayer lists one layer inside the tiles and its attributes
+type VectorLayer struct {
+	ID          string            `json:"id"`
+	Description string            `json:"description,omitempty"`
+	MinZoom     int               `json:"minzoom"`
+	MaxZoom     int               `json:"maxzoom"`
+	Fields      map[string]string `json:"fields"`
+}
+
+// layerVectorLayers describes a layer named id inside the tiles, and its label layer if any
+func layerVectorLayers(layer models.MapLayersForTile, id string, fromZoom, toZoom int) []VectorLayer {
+	fields := maplayer.LayerFields(layer)
+	if cluster := clusterSettings(layer); cluster.Enabled && layer.GeometryType == "Point" && fromZoom <= cluster.MaxZoom {
+		// Clustered tiles carry these on cluster features instead of the row attributes
+		fields["cluster"] = "Boolean"
+		fields["point_count"] = "Number"
+		fields["point_count_abbreviated"] = "String"
+		fields["item_ids"] = "String"
+	}
+
+	if aggregation := layer.Aggregation.Settings(); aggregation.Enabled(layer.GeometryType) && fromZoom <= aggregation.MaxZoom {
+		// Aggregated tiles hold grid cells with their feature count
+		fields["count"] = "Number"
+		if aggregation.Field != "" {
+			fields["sum"] = "Number"
+			fields["avg"] = "Number"
+		}
+	}
+
+	vectorLayers := []VectorLayer{{
+		ID:          id,
+		Description: layer.LayerTitle,
+		MinZoom:     fromZoom,
+		MaxZoom:     toZoom,
+		Fields:      fields,
+	}}
+
+	// Labelled layers come with their label anchors
+	if labels := layer.Label.Settings(); labels.Enabled(layer.GeometryType) && labels.MinZoom <= toZoom && labels.MaxZoom >= fromZoom {
+		labelType := "String"
+		if maplayer.IsNumericColumn(layer.DbSchema, layer.DbTable, labels.Field) {
+			labelType = "Number"
+		}
+		vectorLayers = append(vectorLayers, VectorLayer{
+			ID:          models.LabelLayerName(id),
+			Description: layer.LayerTitle + " labels",
+			MinZoom:     max(fromZoom, labels.MinZoom),
+			MaxZoom:     min(toZoom, labels.MaxZoom),
+			Fields:      map[string]string{labels.Field: labelType},
+		})
+	}
+	return vectorLayers
+}
+
+// publicBaseURL returns the server's public URL with a protocol. Without a configured domain
+// it is the URL the request came in on, as forwarded by a proxy in front of the server, when its
+// host is one of Config.TrustedHosts. Other hosts are client input and never end up in a
+// response that may be cached.
+func publicBaseURL(c *fiber.Ctx) string {
+	baseUrl := config.LambdaConfig.Domain
+	if baseUrl == "" {
+		if slices.Contains(Config.TrustedHosts, c.Hostname()) {
+			return c.BaseURL()
+		}
+		log.Printf("Host %q is not trusted, set the domain or TILE_TRUSTED_HOSTS", c.Hostname())
+		return "http://localhost:9995"
+	}
+	if !strings.HasPrefix(baseUrl, "http://") && !strings.HasPrefix(baseUrl, "https://") {
+		baseUrl = "https://" + baseUrl
+	}
+	return baseUrl
+}
+
+// tileJSONRequest reads the options shared by the TileJSON endpoints. Filters are passed
+// through to the tile URL so the tiles match the reported bounds.
+func tileJSONRequest(c *fiber.Ctx) (tilePath string, rawQuery string, filters map[string]string, areaFilters map[string]string) {
+	tilePath = "/tiles/"
+	if c.Query("secure") == "true" {
+		tilePath = "/tiles-with-permission/"
+	}
+
+	filters, areaFilters = maplayer.SplitFilters(c.Queries(), "secure")
+
+	values := url.Values{}
+	for key, value := range c.Queries() {
+		if key != "secure" && key != maplayer.VersionParam {
+			values.Set(key, value)
+		}
+	}
+
+	if len(values) > 0 {
+		rawQuery = "?" + values.Encode()
+	}
+	return
+}
+
+// withVersion adds the data version to the query of a tile URL
+func withVersion(rawQuery string, version string) string {
+	if rawQuery == "" {
+		return "?" + maplayer.VersionParam + "=" + version
+	}
+	return rawQuery + "&" + maplayer.VersionParam + "=" + version
+}
+
+// boundsCenter returns the center of the bounds at the given zoom
+func boundsCenter(bounds []float64, zoom int) []float64 {
+	if bounds == nil {
+		return nil
+	}
+	return []float64{(bounds[0] + bounds[2]) / 2, (bounds[1] + bounds[3]) / 2, float64(zoom)}
+}
+
+// layerZoomRange returns the zoom range TileJSON advertises for a layer: the default range
+// narrowed to the layer's own. Clients overzoom the tiles above it.
+func layerZoomRange(layer models.MapLayersForTile) (int, int) {
+	zoom := layer.Zoom.Settings()
+	fromZoom := max(minZoom, zoom.MinZoom)
+	return fromZoom, max(min(maxZoom, zoom.MaxZoom), fromZoom)
+}
+
+// LayerTileJSONHandler describes a layer's live tiles as TileJSON
+func LayerTileJSONHandler(c *fiber.Ctx) error {
+	layer, err := maplayer.FetchLayerDetails(c.Params("layer"))
+	if err != nil {
+		log.Printf("Layer not found: %v", err)
+		return c.Status(fiber.StatusNotFound).SendString("Layer not found")
+	}
+
+	tilePath, rawQuery, filters, areaFilters := tileJSONRequest(c)
+
+	// Secure TileJSON points at tiles that check the user themselves. There is no user here,
+	// so layers closed to the public are described without their data bounds.
+	access := maplayer.CheckLayerAccess(layer, nil)
+	if errors.Is(access, maplayer.ErrLayerNotFound) || access != nil && tilePath == "/tiles/" {
+		return c.Status(maplayer.AccessStatus(access)).SendString(access.Error())
+	}
+
+	var bounds []float64
+	if access == nil {
+		bounds, err = layerBounds(layer, filters, areaFilters)
+		if err != nil {
+			log.Printf("Error calculating bounds: %v", err)
+			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+		}
+	}
+
+	fromZoom, toZoom := layerZoomRange(layer)
+	return c.JSON(TileJSON{
+		TileJSON:     "3.0.0",
+		Name:         layer.LayerTitle,
+		Description:  ptrValue(layer.Description),
+		Attribution:  Config.Attribution,
+		Scheme:       "xyz",
+		Tiles:        []string{publicBaseURL(c) + tilePath + layer.ID + "/{z}/{x}/{y}.pbf" + withVersion(rawQuery, maplayer.DataVersion(layer))},
+		MinZoom:      fromZoom,
+		MaxZoom:      toZoom,
+		Bounds:       bounds,
+		Center:       boundsCenter(bounds, fromZoom),
+		VectorLayers: layerVectorLayers(layer, layer.DbSchema+"."+layer.DbTable, fromZoom, toZoom),
+	})
+}
+
+// MapTileJSONHandler describes the composite tiles of a map as TileJSON
+func MapTileJSONHandler(c *fiber.Ctx) error {
+	mapID := c.Params("mapId")
+
+	var currentMap models.Map
+	if err := DB.DB.Where("id = ?", mapID).First(&currentMap).Error; err != nil {
+		log.Printf("Map not found: %v", err)
+		return c.Status(fiber.StatusNotFound).SendString("Map not found")
+	}
+
+	layerIDs, err := maplayer.FetchMapLayerIDs(mapID)
+	if err != nil {
+		log.Printf("Map layers not found: %v", err)
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
+
+	tilePath, rawQuery, filters, areaFilters := tileJSONRequest(c)
+	secure := tilePath != "/tiles/"
+
+	tileJSON := TileJSON{
+		TileJSON:     "3.0.0",
+		Name:         currentMap.Map,
+		Description:  ptrValue(currentMap.Description),
+		Attribution:  Config.Attribution,
+		Scheme:       "xyz",
+		Tiles:        []string{publicBaseURL(c) + tilePath + "map/" + mapID + "/{z}/{x}/{y}.pbf"},
+		MinZoom:      minZoom,
+		MaxZoom:      maxZoom,
+		VectorLayers: []VectorLayer{},
+	}
+
+	var layers []models.MapLayersForTile
+	for _, layerID := range layerIDs {
+		layer, err := maplayer.FetchLayerDetails(layerID)
+		if err != nil {
+			continue
+		}
+		layers = append(layers, layer)
+
+		// The public composite tiles leave out layers closed to the public, the secure ones may carry
+		// them but without a user here their data bounds are left out
+		access := maplayer.CheckLayerAccess(layer, nil)
+		if errors.Is(access, maplayer.ErrLayerNotFound) || access != nil && !secure {
+			continue
+		}
+
+		// The composite tiles span the zoom ranges of their layers
+		fromZoom, toZoom := layerZoomRange(layer)
+		if len(tileJSON.VectorLayers) == 0 {
+			tileJSON.MinZoom, tileJSON.MaxZoom = fromZoom, toZoom
+		} else {
+			tileJSON.MinZoom, tileJSON.MaxZoom = min(tileJSON.MinZoom, fromZoom), max(tileJSON.MaxZoom, toZoom)
+		}
+		tileJSON.VectorLayers = append(tileJSON.VectorLayers, layerVectorLayers(layer, layer.ID, fromZoom, toZoom)...)
+		if access != nil {
+			continue
+		}
+
+		bounds, err := layerBounds(layer, maplayer.FiltersForTable(filters, layer.DbSchema, layer.DbTable), areaFilters)
+		if err != nil {
+			log.Printf("Error calculating bounds of layer %s: %v", layer.ID, err)
+			continue
+		}
+		tileJSON.Bounds = unionBounds(tileJSON.Bounds, bounds)
+	}
+	tileJSON.Center = boundsCenter(tileJSON.Bounds, tileJSON.MinZoom)
+	tileJSON.Tiles[0] += withVersion(rawQuery, maplayer.MapDataVersion(layers))
+
+	return c.JSON(tileJSON)
+}
+
+// unionBounds returns bounds covering both a and b, either of which may be nil
+func unionBounds(a, b []float64) []float64 {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	return []float64{min(a[0], b[0]), min(a[1], b[1]), max(a[2], b[2]), max(a[3], b[3])}
+}
@@ -0,0 +1,53 @@
+package tiles
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lambda-platform/lambda/config"
+)
+
+func TestPublicBaseURL(t *testing.T) {
+	domain, trustedHosts := config.LambdaConfig.Domain, Config.TrustedHosts
+	defer func() { config.LambdaConfig.Domain, Config.TrustedHosts = domain, trustedHosts }()
+
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		return c.SendString(publicBaseURL(c))
+	})
+
+	tests := []struct {
+		name         string
+		domain       string
+		trustedHosts []string
+		host         string
+		want         string
+	}{
+		{"configured domain", "maps.example.mn", nil, "evil.example", "https://maps.example.mn"},
+		{"configured domain with protocol", "http://maps.example.mn", nil, "evil.example", "http://maps.example.mn"},
+		{"trusted host", "", []string{"maps.example.mn"}, "maps.example.mn", "http://maps.example.mn"},
+		{"untrusted host", "", []string{"maps.example.mn"}, "evil.example", "http://localhost:9995"},
+		{"no trusted hosts", "", nil, "evil.example", "http://localhost:9995"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.LambdaConfig.Domain, Config.TrustedHosts = tt.domain, tt.trustedHosts
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Host = tt.host
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(body); got != tt.want {
+				t.Errorf("publicBaseURL for host %q = %q, want %q", tt.host, got, tt.want)
+			}
+		})
+	}
+}
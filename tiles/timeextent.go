@@ -0,0 +1,139 @@
+package tiles
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/khankhulgun/khanmap/maplayer"
+	"github.com/khankhulgun/khanmap/models"
+	"github.com/lambda-platform/lambda/DB"
+)
+
+const (
+	defaultTimeBuckets = 20
+	maxTimeBuckets     = 500
+)
+
+// TimeBucket counts the features starting within [Start, End)
+type TimeBucket struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Count int64     `json:"count"`
+}
+
+// TimeExtent is the time range of a temporal layer with a histogram for time sliders
+type TimeExtent struct {
+	Min     *time.Time   `json:"min"`
+	Max     *time.Time   `json:"max"`
+	Buckets []TimeBucket `json:"buckets"`
+}
+
+// LayerTimeExtentHandler returns the min and max time of the layer's filtered features and
+// the number of features starting in each of ?buckets equal periods between them
+func LayerTimeExtentHandler(c *fiber.Ctx) error {
+	layerDetails, err := maplayer.FetchLayerDetails(c.Params("layer"))
+	if err != nil {
+		log.Printf("Layer not found: %v", err)
+		return c.Status(fiber.StatusNotFound).SendString("Layer not found")
+	}
+	if err := maplayer.CheckLayerAccess(layerDetails, nil); err != nil {
+		return c.Status(maplayer.AccessStatus(err)).SendString(err.Error())
+	}
+	if layerDetails.TimeField == nil || *layerDetails.TimeField == "" {
+		return c.Status(fiber.StatusBadRequest).SendString("Layer has no time field")
+	}
+
+	buckets := min(max(c.QueryInt("buckets", defaultTimeBuckets), 1), maxTimeBuckets)
+	filters, areaFilters := maplayer.SplitFilters(c.Queries(), "buckets")
+
+	extent, err := layerTimeExtent(layerDetails, buckets, filters, areaFilters)
+	if errors.Is(err, maplayer.ErrInvalidTime) {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	if err != nil {
+		log.Printf("Error calculating time extent: %v", err)
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
+
+	return c.JSON(extent)
+}
+
+// layerTimeExtent reads the time range of the layer's filtered features and buckets their start times
+func layerTimeExtent(layer models.MapLayersForTile, buckets int, filters map[string]string, areaFilters map[string]string) (*TimeExtent, error) {
+	conditions, args, err := layerConditions(layer, nil, filters, areaFilters)
+	if err != nil {
+		return nil, err
+	}
+	whereClause := "WHERE 1=1 " + strings.Join(conditions, " ")
+
+	startColumn, endColumn := maplayer.TimeColumns(layer)
+
+	var lo, hi *float64
+	rangeSQL := fmt.Sprintf(`
+		SELECT extract(epoch FROM min(%s))::float8, extract(epoch FROM max(%s))::float8
+		FROM %s.%s
+		%s
+	`, startColumn, endColumn, layer.DbSchema, layer.DbTable, whereClause)
+	if err := DB.DB.Raw(rangeSQL, args...).Row().Scan(&lo, &hi); err != nil {
+		return nil, err
+	}
+
+	extent := &TimeExtent{Buckets: []TimeBucket{}}
+	if lo == nil || hi == nil {
+		return extent, nil
+	}
+	minTime, maxTime := epochTime(*lo), epochTime(*hi)
+	extent.Min, extent.Max = &minTime, &maxTime
+
+	// A single instant still gets one bucket, one second wide
+	width := max(*hi-*lo, 1)
+	step := width / float64(buckets)
+
+	// width_bucket puts the upper bound into bucket n+1, it is folded into the last bucket
+	histogramSQL := fmt.Sprintf(`
+		SELECT LEAST(width_bucket(extract(epoch FROM %s)::float8, ?::float8, ?::float8, ?::int), ?::int) AS bucket, count(*)
+		FROM %s.%s
+		%s AND %s IS NOT NULL
+		GROUP BY bucket
+	`, startColumn, layer.DbSchema, layer.DbTable, whereClause, startColumn)
+	histogramArgs := append([]interface{}{*lo, *lo + width, buckets, buckets}, args...)
+
+	rows, err := DB.DB.Raw(histogramSQL, histogramArgs...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make([]int64, buckets)
+	for rows.Next() {
+		var bucket int
+		var count int64
+		if err := rows.Scan(&bucket, &count); err != nil {
+			return nil, err
+		}
+		if bucket >= 1 && bucket <= buckets {
+			counts[bucket-1] = count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, count := range counts {
+		extent.Buckets = append(extent.Buckets, TimeBucket{
+			Start: epochTime(*lo + step*float64(i)),
+			End:   epochTime(*lo + step*float64(i+1)),
+			Count: count,
+		})
+	}
+	return extent, nil
+}
+
+// epochTime converts Unix seconds to a UTC time
+func epochTime(seconds float64) time.Time {
+	return time.UnixMicro(int64(seconds * 1e6)).UTC()
+}